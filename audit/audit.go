@@ -0,0 +1,209 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Config selects where the audit records are written, a rotating file or syslog, empty to disable auditing.
+// Records are chained with sha256 hashes, or with HMAC-SHA256 when HmacKey is set.
+type Config struct {
+	Path     string // JSON lines file, rotated to Path.1 ... Path.MaxFiles
+	MaxBytes int    // rotate before the file grows beyond MaxBytes, 0 to never rotate
+	MaxFiles int    // rotated files kept
+	Syslog   string // local, udp://HOST:PORT or tcp://HOST:PORT
+	HmacKey  string
+}
+
+// Record is one use of a key. Every record holds the hash of the previous one, so records that were
+// modified, removed or reordered break the chain.
+type Record struct {
+	Seq        int64  `json:"seq"`
+	Time       string `json:"time"`
+	Operation  string `json:"operation"` // encrypt or decrypt
+	Identity   string `json:"identity"`
+	Flow       string `json:"flow,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Object     string `json:"object,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+	Key        string `json:"key"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	Prev       string `json:"prev"` // hash of the previous record, empty for the first record of a chain
+}
+
+type sink interface {
+	write(line []byte) error
+}
+
+var auditLog struct {
+	mutex  sync.Mutex
+	writer *chainWriter
+}
+
+// chainWriter owns the chain of a sink. A single goroutine writes the records in order, so requests
+// wait for their own record without holding a lock while a slow sink, e.g. remote syslog, is written.
+type chainWriter struct {
+	sink    sink
+	hmacKey []byte
+	seq     int64
+	prev    string
+	records chan pendingRecord
+}
+
+type pendingRecord struct {
+	record Record
+	done   chan error
+}
+
+// Configure opens the audit log of config. A file continues the chain of its last record, syslog can't be
+// read back and starts a new chain.
+func Configure(config Config) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	auditLog.writer = nil
+
+	writer := &chainWriter{hmacKey: []byte(config.HmacKey), records: make(chan pendingRecord, 1024)}
+	switch {
+	case config.Path != "":
+		fileSink, last, err := openFileSink(config.Path, config.MaxBytes, config.MaxFiles)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			writer.seq, writer.prev = last.seq, last.hash
+		}
+		writer.sink = fileSink
+		log.Infof("auditing key usage to %v from record %v", config.Path, writer.seq+1)
+	case config.Syslog != "":
+		syslogSink, err := openSyslogSink(config.Syslog)
+		if err != nil {
+			return err
+		}
+		writer.sink = syslogSink
+		log.Infof("auditing key usage to syslog %v", config.Syslog)
+	default:
+		return nil
+	}
+
+	if config.HmacKey == "" {
+		log.Warnf("GCS_PROXY_AUDIT_HMAC_KEY is not set, anyone who can write the audit log can recompute its sha256 chain")
+	}
+	go writer.run()
+	auditLog.writer = writer
+	return nil
+}
+
+func IsEnabled() bool {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	return auditLog.writer != nil
+}
+
+// RecordKeyUse writes the use of key by the subject of ctx, failed when err is set. An error is returned
+// when the record could not be written, the caller must not use the result of the operation.
+func RecordKeyUse(ctx context.Context, operation string, key string, err error) error {
+	auditLog.mutex.Lock()
+	writer := auditLog.writer
+	auditLog.mutex.Unlock()
+	if writer == nil {
+		return nil
+	}
+
+	subject := getSubject(ctx)
+	if subject.Identity == "" && subject.ResolveIdentity != nil {
+		subject.Identity = subject.ResolveIdentity()
+	}
+	record := Record{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Operation:  operation,
+		Identity:   subject.Identity,
+		Flow:       subject.Flow,
+		Bucket:     subject.Bucket,
+		Object:     subject.Object,
+		Generation: subject.Generation,
+		Key:        key,
+		Outcome:    OutcomeSuccess,
+	}
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = err.Error()
+	}
+
+	pending := pendingRecord{record: record, done: make(chan error, 1)}
+	select {
+	case writer.records <- pending:
+	case <-ctx.Done():
+		return fmt.Errorf("unable to write audit record: %w", ctx.Err())
+	}
+	select {
+	case err = <-pending.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("unable to write audit record: %w", ctx.Err())
+	}
+}
+
+func (w *chainWriter) run() {
+	for pending := range w.records {
+		pending.done <- w.write(pending.record)
+	}
+}
+
+// write chains the record to the last one that was written, a record that could not be written is not
+// part of the chain.
+func (w *chainWriter) write(record Record) error {
+	record.Seq, record.Prev = w.seq+1, w.prev
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to write audit record: %w", err)
+	}
+	recordHash := hashRecord(w.hmacKey, body)
+	err = w.sink.write(appendHash(body, recordHash))
+	if err != nil {
+		log.Errorf("unable to write audit record %v: %v", record.Seq, err)
+		return fmt.Errorf("unable to write audit record: %w", err)
+	}
+	w.seq, w.prev = record.Seq, recordHash
+	return nil
+}
+
+// hashRecord returns the hex hash of the JSON body of a record, which includes the hash of the previous record.
+func hashRecord(hmacKey []byte, body []byte) string {
+	var h hash.Hash
+	if len(hmacKey) > 0 {
+		h = hmac.New(sha256.New, hmacKey)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashField ends every line, the body of a record is the line without it
+const hashField = `,"hash":"`
+
+func appendHash(body []byte, recordHash string) []byte {
+	line := append(body[:len(body)-1:len(body)-1], hashField...)
+	line = append(line, recordHash...)
+	return append(line, "\"}\n"...)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRecordKeyUseConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err := Configure(Config{Path: path, MaxBytes: 4096, MaxFiles: 10, HmacKey: "secret"})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer Configure(Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := WithObject(context.Background(), "bucket", fmt.Sprintf("object-%v", i), 0)
+			if err := RecordKeyUse(ctx, "decrypt", "k", nil); err != nil {
+				t.Errorf("RecordKeyUse: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result, err := Verify(path, "secret")
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if result.Records != 50 || result.LastSeq != 50 || len(result.Files) < 2 {
+		t.Errorf("Verify() = %+v, want 50 records across rotated files", result)
+	}
+}
+
+func TestRecordKeyUseDisabled(t *testing.T) {
+	Configure(Config{})
+	if IsEnabled() {
+		t.Fatalf("IsEnabled() without a sink = true")
+	}
+	ctx := WithSubject(context.Background(), Subject{ResolveIdentity: func() string {
+		t.Errorf("the identity was looked up without a sink")
+		return ""
+	}})
+	if err := RecordKeyUse(ctx, "encrypt", "k", nil); err != nil {
+		t.Errorf("RecordKeyUse() without a sink error = %v", err)
+	}
+}
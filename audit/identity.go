@@ -0,0 +1,140 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// identities are cached until their token expires, tokeninfo returns the expiry. Tokens without one
+	// are looked up again after identityTTL.
+	identityTTL        = 5 * time.Minute
+	failedIdentityTTL  = time.Minute
+	maxIdentityEntries = 10000
+
+	AnonymousIdentity = "anonymous"
+	UnknownIdentity   = "unknown"
+)
+
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+type identityEntry struct {
+	identity string
+	expiry   time.Time
+}
+
+var (
+	identityMutex sync.Mutex
+	identities    = map[[sha256.Size]byte]identityEntry{} // by the hash of the token, tokens are never kept
+	tokenInfo     = &http.Client{Timeout: 5 * time.Second}
+)
+
+// Identity returns the email, or the subject, of the bearer token in the Authorization header. Access
+// tokens and ID tokens are looked up with the Google tokeninfo endpoint, which verifies them, and cached
+// until they expire. The claims of an ID token are never read without it, anyone can sign a JWT that names
+// someone else.
+func Identity(ctx context.Context, authorization string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return AnonymousIdentity
+	}
+
+	tokenHash := sha256.Sum256([]byte(token))
+	identityMutex.Lock()
+	entry, ok := identities[tokenHash]
+	identityMutex.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.identity
+	}
+
+	identity, expiry, err := lookupTokenInfo(ctx, token)
+	if err != nil {
+		log.Warnf("unable to look up the identity of an access token: %v", err)
+		identity = UnknownIdentity
+		expiry = time.Now().Add(failedIdentityTTL)
+	}
+	if expiry.IsZero() {
+		expiry = time.Now().Add(identityTTL)
+	}
+	entry = identityEntry{identity: identity, expiry: expiry}
+
+	identityMutex.Lock()
+	if len(identities) >= maxIdentityEntries {
+		for key, e := range identities {
+			if time.Now().After(e.expiry) {
+				delete(identities, key)
+			}
+		}
+	}
+	if len(identities) < maxIdentityEntries {
+		identities[tokenHash] = entry
+	}
+	identityMutex.Unlock()
+	return identity
+}
+
+type tokenClaims struct {
+	Email string      `json:"email"`
+	Sub   string      `json:"sub"`
+	Azp   string      `json:"azp"`
+	Exp   json.Number `json:"exp"` // seconds since the epoch, tokeninfo returns it as a string
+}
+
+func (c tokenClaims) identity() string {
+	switch {
+	case c.Email != "":
+		return c.Email
+	case c.Sub != "":
+		return c.Sub
+	}
+	return c.Azp
+}
+
+// lookupTokenInfo posts the token, tokens are never sent in URLs. ID tokens are JWTs, access tokens are not.
+// The expiry is zero when tokeninfo returned none.
+func lookupTokenInfo(ctx context.Context, token string) (identity string, expiry time.Time, err error) {
+	form := url.Values{"access_token": {token}}
+	if strings.Count(token, ".") == 2 {
+		form = url.Values{"id_token": {token}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenInfoURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tokenInfo.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("tokeninfo returned %v", resp.Status)
+	}
+
+	var claims tokenClaims
+	err = json.NewDecoder(resp.Body).Decode(&claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if claims.identity() == "" {
+		return "", time.Time{}, fmt.Errorf("tokeninfo returned no email or subject")
+	}
+	if exp, err := claims.Exp.Int64(); err == nil {
+		expiry = time.Unix(exp, 0)
+	}
+	return claims.identity(), expiry, nil
+}
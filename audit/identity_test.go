@@ -0,0 +1,67 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdentity(t *testing.T) {
+	// the fake tokeninfo knows two access tokens and one ID token, anything else is invalid
+	expired := strconv.FormatInt(time.Now().Unix(), 10)
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.Method != http.MethodPost || r.URL.RawQuery != "" {
+			http.Error(w, "tokens must be posted", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.PostFormValue("access_token") == "ya29.access":
+			json.NewEncoder(w).Encode(map[string]string{"email": "user@example.com", "sub": "1", "exp": "4102444800"})
+		case r.PostFormValue("access_token") == "ya29.expired":
+			json.NewEncoder(w).Encode(map[string]string{"email": "other@example.com", "exp": expired})
+		case r.PostFormValue("id_token") == "header.payload.signature":
+			json.NewEncoder(w).Encode(map[string]string{"sub": "2"})
+		default:
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	previousURL := tokenInfoURL
+	tokenInfoURL = server.URL
+	defer func() { tokenInfoURL = previousURL }()
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{"no authorization", "", AnonymousIdentity},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", AnonymousIdentity},
+		{"access token", "Bearer ya29.access", "user@example.com"},
+		{"id token", "Bearer header.payload.signature", "2"},
+		{"unsigned jwt claims are not trusted", "Bearer eyJhbGciOiJub25lIn0.eyJlbWFpbCI6ImFkbWluQGV4YW1wbGUuY29tIn0.", UnknownIdentity},
+		{"cached access token", "Bearer ya29.access", "user@example.com"},
+		{"expired access token", "Bearer ya29.expired", "other@example.com"},
+		{"expired access token is looked up again", "Bearer ya29.expired", "other@example.com"},
+	}
+	for _, test := range tests {
+		if got := Identity(context.Background(), test.authorization); got != test.want {
+			t.Errorf("%v: Identity() = %v, want %v", test.name, got, test.want)
+		}
+	}
+	if lookups != 5 {
+		t.Errorf("tokeninfo was called %v times, want 5", lookups)
+	}
+}
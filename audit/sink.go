@@ -0,0 +1,165 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// records are much smaller, the last one is found in the tail of a file
+const maxRecordBytes = 64 * 1024
+
+// fileSink appends records to path and rotates it to path.1, path.1 to path.2 and so on. The chain of
+// hashes continues across the rotated files.
+type fileSink struct {
+	path     string
+	maxBytes int
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+type lastRecord struct {
+	seq  int64
+	hash string
+}
+
+func openFileSink(path string, maxBytes int, maxFiles int) (*fileSink, *lastRecord, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	s := &fileSink{path: path, maxBytes: maxBytes, maxFiles: maxFiles, file: file, size: info.Size()}
+
+	// a file that was just rotated is empty, its chain continues from the last rotated file
+	last, err := readLastRecord(path)
+	if err == nil && last == nil {
+		last, err = readLastRecord(rotatedPath(path, 1))
+	}
+	if err != nil {
+		// a new chain would hide what happened to the broken record
+		file.Close()
+		return nil, nil, fmt.Errorf("%w, check it with -verify_audit and move it away to start a new audit log", err)
+	}
+	return s, last, nil
+}
+
+func (s *fileSink) write(line []byte) error {
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > int64(s.maxBytes) {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	if err != nil {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	err = os.Remove(rotatedPath(s.path, s.maxFiles))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(rotatedPath(s.path, i), rotatedPath(s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to rotate audit log: %w", err)
+		}
+	}
+	err = os.Rename(s.path, rotatedPath(s.path, 1))
+	if err != nil {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	s.size = 0
+	return nil
+}
+
+func rotatedPath(path string, i int) string {
+	return fmt.Sprintf("%v.%v", path, i)
+}
+
+// readLastRecord returns nil for a missing or empty file
+func readLastRecord(path string) (*lastRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-maxRecordBytes, 0)
+	tail := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(tail, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	line := tail[bytes.LastIndexByte(tail, '\n')+1:]
+	record, recordHash, err := parseLine(line)
+	if err != nil {
+		return nil, fmt.Errorf("the last record of %v is broken: %w", path, err)
+	}
+	return &lastRecord{seq: record.Seq, hash: recordHash}, nil
+}
+
+// syslogSink sends records to the local syslog daemon or a remote one. Syslog can't be read back, every
+// start of the proxy starts a new chain.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func openSyslogSink(address string) (*syslogSink, error) {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid audit syslog '%v', expected local, udp://HOST:PORT or tcp://HOST:PORT", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "go-gcsproxy-audit")
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to syslog: %w", err)
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(line []byte) error {
+	_, err := s.writer.Write([]byte(strings.TrimSuffix(string(line), "\n")))
+	return err
+}
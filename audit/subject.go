@@ -0,0 +1,48 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import "context"
+
+// Subject is who used a key on which object
+type Subject struct {
+	Identity   string
+	Flow       string
+	Bucket     string
+	Object     string
+	Generation int64 // 0 when unknown, e.g. for uploads that create the generation
+
+	// looks up the identity when a key use is recorded and Identity is empty, requests that use no key
+	// don't look it up
+	ResolveIdentity func() string
+}
+
+type subjectKey struct{}
+
+// WithSubject returns a context whose key usage is recorded for subject.
+func WithSubject(ctx context.Context, subject Subject) context.Context {
+	return context.WithValue(ctx, subjectKey{}, subject)
+}
+
+// WithObject returns a context whose key usage is recorded for the object, e.g. one object of a listing.
+func WithObject(ctx context.Context, bucket string, object string, generation int64) context.Context {
+	subject := getSubject(ctx)
+	subject.Bucket, subject.Object, subject.Generation = bucket, object, generation
+	return WithSubject(ctx, subject)
+}
+
+// WithGeneration returns a context whose key usage is recorded for the generation of the object.
+func WithGeneration(ctx context.Context, generation int64) context.Context {
+	subject := getSubject(ctx)
+	subject.Generation = generation
+	return WithSubject(ctx, subject)
+}
+
+// getSubject returns the proxy itself, an empty identity, when ctx has no subject.
+func getSubject(ctx context.Context) Subject {
+	subject, _ := ctx.Value(subjectKey{}).(Subject)
+	return subject
+}
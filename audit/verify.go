@@ -0,0 +1,127 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// VerifyResult summarizes an audit log whose chain is intact
+type VerifyResult struct {
+	Files    []string
+	Records  int64
+	FirstSeq int64
+	LastSeq  int64
+	Chains   int      // a chain starts with the first record and every restart of a syslog sink
+	Restarts []string // file:line of the chains after the first, only lines extracted from syslog restart
+}
+
+// Verify checks the chain of the audit log at path and its rotated files, oldest first. Modified records,
+// records that are missing or reordered and records of another HMAC key fail verification, and so does a
+// chain that restarts in a file sink, it never restarts. Records that were removed from the end of the newest
+// file, or files that were rotated away, can't be detected.
+func Verify(path string, hmacKey string) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	var files []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath(path, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedPath(path, i)}, files...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no audit log at %v", path)
+	}
+
+	var prev string
+	for _, file := range files {
+		err := verifyFile(file, []byte(hmacKey), result, &prev)
+		if err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, file)
+	}
+	return result, nil
+}
+
+func verifyFile(path string, hmacKey []byte, result *VerifyResult, prev *string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, maxRecordBytes), maxRecordBytes)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		// lines extracted from syslog start with the syslog header
+		fromSyslog := false
+		if start := bytes.Index(line, []byte(`{"seq":`)); start > 0 {
+			line, fromSyslog = line[start:], true
+		}
+
+		record, recordHash, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %w", path, lineNumber, err)
+		}
+		body, _ := bytes.CutSuffix(line, []byte(hashField+recordHash+`"}`))
+		if !hmac.Equal([]byte(hashRecord(hmacKey, append(body, '}'))), []byte(recordHash)) {
+			return fmt.Errorf("%v:%v: record %v was modified", path, lineNumber, record.Seq)
+		}
+
+		switch {
+		case result.Records == 0:
+			// the chain may start in a file that was rotated away
+			result.FirstSeq = record.Seq
+			result.Chains++
+		case record.Seq == 1 && record.Prev == "" && !fromSyslog:
+			return fmt.Errorf("%v:%v: the chain restarts after record %v, records were removed or replaced", path, lineNumber, result.LastSeq)
+		case record.Seq == 1 && record.Prev == "":
+			result.Chains++
+			result.Restarts = append(result.Restarts, fmt.Sprintf("%v:%v", path, lineNumber))
+		case record.Seq != result.LastSeq+1:
+			return fmt.Errorf("%v:%v: record %v follows record %v, records are missing or reordered", path, lineNumber, record.Seq, result.LastSeq)
+		case record.Prev != *prev:
+			return fmt.Errorf("%v:%v: record %v does not chain to record %v", path, lineNumber, record.Seq, result.LastSeq)
+		}
+		result.Records++
+		result.LastSeq = record.Seq
+		*prev = recordHash
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return fmt.Errorf("%v: a line is longer than %v bytes, not an audit record", path, maxRecordBytes)
+	}
+	return scanner.Err()
+}
+
+// parseLine returns the record and the hash of a line
+func parseLine(line []byte) (*Record, string, error) {
+	var withHash struct {
+		Record
+		Hash string `json:"hash"`
+	}
+	err := json.Unmarshal(line, &withHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("not an audit record: %w", err)
+	}
+	if withHash.Hash == "" || !bytes.HasSuffix(line, []byte(hashField+withHash.Hash+`"}`)) {
+		return nil, "", fmt.Errorf("record %v has no hash", withHash.Seq)
+	}
+	return &withHash.Record, withHash.Hash, nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package audit
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAuditLog writes records key uses to a new audit log and returns its lines
+func writeAuditLog(t *testing.T, hmacKey string, records int) [][]byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err := Configure(Config{Path: path, HmacKey: hmacKey})
+	if err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer Configure(Config{})
+
+	ctx := WithSubject(context.Background(), Subject{Identity: "user@example.com", Bucket: "bucket", Object: "object"})
+	for i := 0; i < records; i++ {
+		err := RecordKeyUse(ctx, "encrypt", "projects/p/locations/l/keyRings/r/cryptoKeys/k", nil)
+		if err != nil {
+			t.Fatalf("RecordKeyUse: %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+}
+
+func TestVerify(t *testing.T) {
+	chain := writeAuditLog(t, "secret", 4)
+	restart := writeAuditLog(t, "secret", 2)
+	modified := bytes.Replace(chain[1], []byte(`"encrypt"`), []byte(`"decrypt"`), 1)
+	truncated := []byte(string(chain[1][:len(chain[1])/2]) + "\n")
+	var syslog [][]byte
+	for _, line := range [][]byte{chain[0], chain[1], restart[0], restart[1]} {
+		syslog = append(syslog, []byte("Oct 19 12:00:00 host gcsproxy[1]: "+string(line)))
+	}
+
+	tests := []struct {
+		name    string
+		lines   [][]byte
+		hmacKey string
+		chains  int
+		wantErr string
+	}{
+		{name: "intact", lines: chain, hmacKey: "secret", chains: 1},
+		{name: "modified", lines: [][]byte{chain[0], modified, chain[2], chain[3]}, hmacKey: "secret", wantErr: "record 2 was modified"},
+		{name: "missing", lines: [][]byte{chain[0], chain[2], chain[3]}, hmacKey: "secret", wantErr: "record 3 follows record 1"},
+		{name: "reordered", lines: [][]byte{chain[0], chain[2], chain[1], chain[3]}, hmacKey: "secret", wantErr: "record 3 follows record 1"},
+		{name: "wrong hmac key", lines: chain, hmacKey: "other", wantErr: "record 1 was modified"},
+		{name: "no hmac key", lines: chain, wantErr: "record 1 was modified"},
+		{name: "file restart", lines: [][]byte{chain[0], chain[1], restart[0], restart[1]}, hmacKey: "secret", wantErr: "the chain restarts after record 2"},
+		{name: "syslog restart", lines: syslog, hmacKey: "secret", chains: 2},
+		{name: "not a record", lines: [][]byte{chain[0], []byte("garbage\n")}, hmacKey: "secret", wantErr: "not an audit record"},
+		{name: "last record truncated", lines: [][]byte{chain[0], truncated}, hmacKey: "secret", wantErr: "not an audit record"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(path, bytes.Join(test.lines, nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+			result, err := Verify(path, test.hmacKey)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Verify() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if result.Chains != test.chains || result.Records != int64(len(test.lines)) {
+				t.Errorf("Verify() = %v chains of %v records, want %v chains of %v", result.Chains, result.Records, test.chains, len(test.lines))
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedFiles(t *testing.T) {
+	chain := writeAuditLog(t, "", 3)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i, file := range []string{path, rotatedPath(path, 1), rotatedPath(path, 2)} {
+		if err := os.WriteFile(file, chain[2-i], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := Verify(path, "")
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if result.FirstSeq != 1 || result.LastSeq != 3 || len(result.Files) != 3 {
+		t.Errorf("Verify() = %+v, want records 1 to 3 in 3 files", result)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	body := []byte(`{"seq":7,"time":"t","operation":"decrypt","identity":"i","key":"k","outcome":"success","prev":"p"}`)
+	recordHash := hashRecord(nil, body)
+
+	record, parsedHash, err := parseLine(bytes.TrimSuffix(appendHash(body, recordHash), []byte("\n")))
+	if err != nil {
+		t.Fatalf("parseLine() error = %v", err)
+	}
+	if parsedHash != recordHash || record.Seq != 7 || record.Operation != "decrypt" || record.Prev != "p" {
+		t.Errorf("parseLine() = %+v, %v, want record 7 with hash %v", record, parsedHash, recordHash)
+	}
+
+	_, _, err = parseLine(body)
+	if err == nil || !strings.Contains(err.Error(), "has no hash") {
+		t.Errorf("parseLine() of a line without hash error = %v", err)
+	}
+}
+
+func TestConfigureContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		err := Configure(Config{Path: path})
+		if err != nil {
+			t.Fatalf("Configure: %v", err)
+		}
+		err = RecordKeyUse(context.Background(), "encrypt", "k", nil)
+		if err != nil {
+			t.Fatalf("RecordKeyUse: %v", err)
+		}
+	}
+	Configure(Config{})
+
+	result, err := Verify(path, "")
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if result.Chains != 1 || result.LastSeq != 2 {
+		t.Errorf("Verify() = %+v, want one chain of 2 records", result)
+	}
+}
+
+func TestConfigureRefusesBrokenTail(t *testing.T) {
+	chain := writeAuditLog(t, "", 2)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	truncated := string(chain[0]) + string(chain[1][:len(chain[1])/2]) + "\n"
+	if err := os.WriteFile(path, []byte(truncated), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Configure(Config{Path: path})
+	defer Configure(Config{})
+	if err == nil || !strings.Contains(err.Error(), "move it away") {
+		t.Fatalf("Configure() error = %v, want the broken tail to be refused", err)
+	}
+}
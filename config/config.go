@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,13 +25,116 @@ type Config struct {
 	CertPath string // path of generate cert files
 	Debug    int    // debug mode: 1 - print debug log, 2 - show debug from
 
+	LogFormat string // json (default) or text, credentials are redacted in both
+
 	Dump      string // dump filename
-	DumpLevel int    // dump level: 0 - header, 1 - header + body
+	DumpLevel int    // dump level: 0 - header, 1 - header + body length
 
 	// kms options
 	kmsBucketKeyMappingString string
 	KmsBucketKeyMapping       map[string]string
 
+	// what to do when a write to a mapped bucket can't be encrypted: closed (default) or open
+	failurePolicyString string
+	FailurePolicy       map[string]string
+
+	// what to do with writes to buckets that are neither mapped nor exempt: allow (default), deny or report
+	UnmappedBucketMode     string
+	plaintextBucketsString string
+	PlaintextBuckets       map[string]bool // buckets allowed to receive plaintext writes
+
+	// compress plaintext before encrypting it: none (default), gzip or zstd
+	compressionString string
+	Compression       map[string]string
+
+	// pad plaintext before encrypting it to hide its length: none (default), pow2 or a block size in bytes
+	paddingString string
+	Padding       map[string]string
+
+	// reuse a wrapped DEK for a bounded number of objects, bytes and time instead of calling KMS for every object
+	DekCacheMaxObjects     int // 0 disables the encrypt cache
+	DekCacheMaxBytes       int
+	DekCacheMaxAge         time.Duration
+	DekCacheDecryptEntries int // unwrapped DEKs kept for decryption, 0 disables the decrypt cache
+
+	// read the key of buckets missing from the static mapping from a bucket label, the static mapping wins
+	KeyLabel          string
+	KeyLabelPrefix    string
+	KeyLabelTTL       time.Duration
+	KeyMetadataObject string // its custom metadata names the key of buckets without the label
+
+	// keys a request may select with the x-gcsproxy-key header, by bucket
+	requestKeysString string
+	RequestKeys       map[string][]string
+
+	// objects under these prefixes are encrypted with a key of their own kept in the local key registry,
+	// destroying the key shreds them. A * segment gives every value of the segment its own key, e.g. a tenant.
+	keyScopesString string
+	KeyScopes       map[string][]string
+	KeyRegistryPath string
+	Shred           string // destroy the keys of gs://BUCKET/PREFIX, mark its objects and exit
+
+	// keys objects are decrypted with when their stored key was renamed, moved or is missing
+	keyAliasesString      string
+	KeyAliases            map[string]string // stored key to the key it is decrypted with
+	decryptKeysString     string
+	DecryptKeys           []string // decrypt-only keys tried in order after the stored key
+	DecryptKeyNegativeTTL time.Duration
+
+	// Vault server of vault-transit:// keys, authenticated with a token or AppRole
+	VaultAddr         string
+	VaultNamespace    string
+	VaultToken        string `json:"-"`
+	VaultRoleID       string
+	VaultSecretID     string `json:"-"`
+	VaultAppRoleMount string
+
+	// timeouts, retries with exponential backoff and a circuit breaker per key around every KMS call
+	KmsTimeout          time.Duration // per attempt
+	KmsMaxAttempts      int
+	KmsInitialBackoff   time.Duration
+	KmsMaxBackoff       time.Duration
+	KmsBreakerThreshold int // consecutive failed calls that open the breaker of a key, 0 disables it
+	KmsBreakerCooldown  time.Duration
+
+	// encrypt custom metadata values, and optionally contentDisposition, of objects in these buckets
+	encryptMetadataString     string
+	EncryptMetadataBuckets    map[string]bool
+	EncryptContentDisposition bool
+
+	// how the plaintext md5 hash is stored in the x-md5Hash metadata: plaintext (default) or encrypted
+	Md5Metadata string
+
+	// encrypt object names of these buckets with an AES-SIV keyset that is encrypted with a KMS key
+	encryptNamesString  string
+	EncryptNamesBuckets map[string]bool
+	NameKeysetPath      string
+	NameKeysetKey       string
+	GenerateNameKeyset  bool // write a new keyset to NameKeysetPath and exit
+
+	// verify a plaintext file against the x-md5Hash of an object and exit
+	VerifyObject string
+	VerifyFile   string
+
+	gcsHostsString string
+	GcsHosts       []HostMatcher // hosts intercepted as GCS traffic
+
+	// endpoint mode: listen as a plain GCS endpoint in addition to the MITM proxy
+	EndpointAddr     string // endpoint listen addr, empty to disable
+	EndpointUpstream string // GCS host the endpoint forwards to
+	EndpointCertFile string // optional TLS cert for the endpoint
+	EndpointKeyFile  string // optional TLS key for the endpoint
+
+	MetricsAddr string // prometheus /metrics listen addr, empty to disable
+
+	// hash-chained audit log of every encryption and decryption, a rotating file or syslog
+	AuditLog      string
+	AuditMaxBytes int
+	AuditMaxFiles int
+	AuditSyslog   string
+	AuditHmacKey  string `json:"-"`
+	VerifyAudit   string // verify the chain of this audit log and exit
+
 	Upstream        string // upstream proxy
 	UpstreamCert    bool   // Connect to upstream server to look up certificate details. Default: True
 	EncryptDisabled bool
@@ -39,6 +143,28 @@ type Config struct {
 
 var GlobalConfig *Config // Global variable
 
+const (
+	FailClosed = "closed"
+	FailOpen   = "open"
+
+	UnmappedBucketAllow  = "allow"
+	UnmappedBucketDeny   = "deny"
+	UnmappedBucketReport = "report"
+
+	LogFormatJson = "json"
+	LogFormatText = "text"
+
+	Md5MetadataPlaintext = "plaintext"
+	Md5MetadataEncrypted = "encrypted"
+
+	PaddingNone = "none"
+	PaddingPow2 = "pow2"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
 func LoadConfig() *Config {
 	config := new(Config)
 	config.EncryptDisabled = isEncryptDisabled()
@@ -46,7 +172,53 @@ func LoadConfig() *Config {
 	defaultSslInsecure := envConfigBoolWithDefault("SSL_INSECURE", true)
 	defaultCertPath := envConfigStringWithDefault("PROXY_CERT_PATH", "/proxy/certs")
 	defaultDebug := envConfigIntWithDefault("DEBUG_LEVEL", 0)
+	defaultLogFormat := envConfigStringWithDefault("GCS_PROXY_LOG_FORMAT", LogFormatJson)
 	defaultKmsBucketKeyMappingString := envConfigStringWithDefault("GCP_KMS_BUCKET_KEY_MAPPING", "")
+	defaultFailurePolicyString := envConfigStringWithDefault("GCS_PROXY_FAILURE_POLICY", "")
+	defaultUnmappedBucketMode := envConfigStringWithDefault("GCS_PROXY_UNMAPPED_BUCKET_MODE", UnmappedBucketAllow)
+	defaultPlaintextBucketsString := envConfigStringWithDefault("GCS_PROXY_PLAINTEXT_BUCKETS", "")
+	defaultCompressionString := envConfigStringWithDefault("GCS_PROXY_COMPRESSION", "")
+	defaultPaddingString := envConfigStringWithDefault("GCS_PROXY_PADDING", "")
+	defaultDekCacheMaxObjects := envConfigIntWithDefault("GCS_PROXY_DEK_CACHE_MAX_OBJECTS", 0)
+	defaultDekCacheMaxBytes := envConfigIntWithDefault("GCS_PROXY_DEK_CACHE_MAX_BYTES", 1<<30)
+	defaultDekCacheMaxAge := envConfigDurationWithDefault("GCS_PROXY_DEK_CACHE_MAX_AGE", 5*time.Minute)
+	defaultDekCacheDecryptEntries := envConfigIntWithDefault("GCS_PROXY_DEK_CACHE_DECRYPT_ENTRIES", 0)
+	defaultKeyLabel := envConfigStringWithDefault("GCS_PROXY_KEY_LABEL", "")
+	defaultKeyLabelPrefix := envConfigStringWithDefault("GCS_PROXY_KEY_LABEL_PREFIX", "")
+	defaultKeyLabelTTL := envConfigDurationWithDefault("GCS_PROXY_KEY_LABEL_TTL", 5*time.Minute)
+	defaultKeyMetadataObject := envConfigStringWithDefault("GCS_PROXY_KEY_METADATA_OBJECT", "")
+	defaultRequestKeysString := envConfigStringWithDefault("GCS_PROXY_REQUEST_KEYS", "")
+	defaultKeyScopesString := envConfigStringWithDefault("GCS_PROXY_KEY_SCOPES", "")
+	defaultKeyRegistryPath := envConfigStringWithDefault("GCS_PROXY_KEY_REGISTRY", "")
+	defaultKeyAliasesString := envConfigStringWithDefault("GCS_PROXY_KEY_ALIASES", "")
+	defaultDecryptKeysString := envConfigStringWithDefault("GCS_PROXY_DECRYPT_KEYS", "")
+	defaultDecryptKeyNegativeTTL := envConfigDurationWithDefault("GCS_PROXY_DECRYPT_KEY_NEGATIVE_TTL", 10*time.Minute)
+	defaultVaultAddr := envConfigStringWithDefault("VAULT_ADDR", "")
+	defaultVaultNamespace := envConfigStringWithDefault("VAULT_NAMESPACE", "")
+	defaultVaultRoleID := envConfigStringWithDefault("VAULT_ROLE_ID", "")
+	defaultVaultAppRoleMount := envConfigStringWithDefault("VAULT_APPROLE_MOUNT", "approle")
+	defaultKmsTimeout := envConfigDurationWithDefault("GCS_PROXY_KMS_TIMEOUT", 10*time.Second)
+	defaultKmsMaxAttempts := envConfigIntWithDefault("GCS_PROXY_KMS_MAX_ATTEMPTS", 3)
+	defaultKmsInitialBackoff := envConfigDurationWithDefault("GCS_PROXY_KMS_INITIAL_BACKOFF", 100*time.Millisecond)
+	defaultKmsMaxBackoff := envConfigDurationWithDefault("GCS_PROXY_KMS_MAX_BACKOFF", 2*time.Second)
+	defaultKmsBreakerThreshold := envConfigIntWithDefault("GCS_PROXY_KMS_BREAKER_THRESHOLD", 5)
+	defaultKmsBreakerCooldown := envConfigDurationWithDefault("GCS_PROXY_KMS_BREAKER_COOLDOWN", 30*time.Second)
+	defaultEncryptMetadataString := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_METADATA", "")
+	defaultEncryptContentDisposition := envConfigBoolWithDefault("GCS_PROXY_ENCRYPT_CONTENT_DISPOSITION", false)
+	defaultMd5Metadata := envConfigStringWithDefault("GCS_PROXY_MD5_METADATA", Md5MetadataPlaintext)
+	defaultEncryptNamesString := envConfigStringWithDefault("GCS_PROXY_ENCRYPT_NAMES", "")
+	defaultNameKeysetPath := envConfigStringWithDefault("GCS_PROXY_NAME_KEYSET", "")
+	defaultNameKeysetKey := envConfigStringWithDefault("GCS_PROXY_NAME_KEYSET_KEY", "")
+	defaultGcsHostsString := envConfigStringWithDefault("GCS_PROXY_HOSTS", "")
+	defaultEndpointAddr := envConfigStringWithDefault("GCS_PROXY_ENDPOINT_ADDR", "")
+	defaultEndpointUpstream := envConfigStringWithDefault("GCS_PROXY_ENDPOINT_UPSTREAM", "storage.googleapis.com")
+	defaultEndpointCertFile := envConfigStringWithDefault("GCS_PROXY_ENDPOINT_CERT_FILE", "")
+	defaultEndpointKeyFile := envConfigStringWithDefault("GCS_PROXY_ENDPOINT_KEY_FILE", "")
+	defaultMetricsAddr := envConfigStringWithDefault("GCS_PROXY_METRICS_ADDR", "")
+	defaultAuditLog := envConfigStringWithDefault("GCS_PROXY_AUDIT_LOG", "")
+	defaultAuditMaxBytes := envConfigIntWithDefault("GCS_PROXY_AUDIT_MAX_BYTES", 100<<20)
+	defaultAuditMaxFiles := envConfigIntWithDefault("GCS_PROXY_AUDIT_MAX_FILES", 10)
+	defaultAuditSyslog := envConfigStringWithDefault("GCS_PROXY_AUDIT_SYSLOG", "")
 
 	flag.BoolVar(&config.Version, "version", false, "show go-gcsproxy version")
 	flag.StringVar(&config.Addr, "port", ":9080", "proxy listen addr")
@@ -55,15 +227,126 @@ func LoadConfig() *Config {
 
 	flag.StringVar(&config.CertPath, "cert_path", defaultCertPath, "path to cert. if 'mitmproxy-ca.pem' is not present here, it will be generated.")
 	flag.IntVar(&config.Debug, "debug", defaultDebug, "debug level: 0 - ERROR, 1 - DEBUG, 2 - TRACE")
-	flag.StringVar(&config.Dump, "dump", "", "filename to dump req/responses for debugging")
-	flag.IntVar(&config.DumpLevel, "dump_level", 0, "dump level: 0 - header, 1 - header + body")
+	flag.StringVar(&config.LogFormat, "log_format", defaultLogFormat, "`json` or `text` logs. Tokens and signed URL signatures are redacted and bodies are never logged at any debug level.")
+	flag.StringVar(&config.Dump, "dump", "", "filename to dump req/responses for debugging, credentials are redacted like in the logs")
+	flag.IntVar(&config.DumpLevel, "dump_level", 0, "dump level: 0 - header, 1 - header + body length. Bodies are plaintext and never dumped")
 	flag.StringVar(&config.Upstream, "upstream", "", "upstream proxy")
 	// "*:global-key" or "bucket/path:project/key,bucket2:key2" but the global key overrides all the other keys
 	flag.StringVar(&config.kmsBucketKeyMappingString, "kms_bucket_key_mappings", defaultKmsBucketKeyMappingString, "Maps Bucket name to KMS keys. Proxy encrypts object uploaded to BUCKET with KEY stored in KMS. Setting BUCKET to * will encrypt/decrypt all GCS calls. Format is `BUCKET:KEY1,BUCKET2:KEY2` for example: `mygcsbucket:projects/<project_id>/locations/<global|region>/keyRings/<key_ring>/cryptoKeys/<key>`")
+	flag.StringVar(&config.failurePolicyString, "failure_policy", defaultFailurePolicyString, "What to do with writes to a mapped bucket that fail to encrypt or are not recognized. `closed` rejects the request, `open` forwards it unencrypted. Format is `BUCKET:POLICY,*:POLICY`, default is closed for every bucket.")
+	flag.StringVar(&config.UnmappedBucketMode, "unmapped_bucket_mode", defaultUnmappedBucketMode, "What to do with writes to buckets not in kms_bucket_key_mappings or plaintext_buckets. `allow` forwards them unencrypted, `deny` rejects them with a 403, `report` forwards them and logs a violation.")
+	flag.StringVar(&config.plaintextBucketsString, "plaintext_buckets", defaultPlaintextBucketsString, "Buckets allowed to receive unencrypted writes when unmapped_bucket_mode is deny or report. Format is `BUCKET1,BUCKET2`")
+	flag.StringVar(&config.compressionString, "compression", defaultCompressionString, "Compress objects before encrypting them, ciphertext doesn't compress. Sizes and hashes are still reported for the plaintext. Format is `BUCKET:none|gzip|zstd,*:none|gzip|zstd`, default is none for every bucket.")
+	flag.StringVar(&config.paddingString, "padding", defaultPaddingString, "Pad objects before encrypting them so the ciphertext length does not reveal the plaintext length. `pow2` pads to the next power of two, a number pads to a multiple of that many bytes. Format is `BUCKET:none|pow2|BLOCKSIZE,*:none|pow2|BLOCKSIZE`, default is none for every bucket.")
+	flag.IntVar(&config.DekCacheMaxObjects, "dek_cache_max_objects", defaultDekCacheMaxObjects, "Number of objects encrypted with one wrapped data encryption key before a new one is wrapped by KMS. 0 wraps a new key for every object.")
+	flag.IntVar(&config.DekCacheMaxBytes, "dek_cache_max_bytes", defaultDekCacheMaxBytes, "Plaintext bytes encrypted with one cached data encryption key, 0 for no limit")
+	flag.DurationVar(&config.DekCacheMaxAge, "dek_cache_max_age", defaultDekCacheMaxAge, "How long a cached data encryption key is used for encryption and kept for decryption, 0 for no limit")
+	flag.IntVar(&config.DekCacheDecryptEntries, "dek_cache_decrypt_entries", defaultDekCacheDecryptEntries, "Number of unwrapped data encryption keys kept to decrypt objects without calling KMS. 0 disables the decrypt cache.")
+	flag.StringVar(&config.KeyLabel, "key_label", defaultKeyLabel, "Bucket label that names the key of buckets missing from kms_bucket_key_mappings, e.g. `gcsproxy-kms-key`. Disabled when empty.")
+	flag.StringVar(&config.KeyLabelPrefix, "key_label_prefix", defaultKeyLabelPrefix, "Prefix of the key named by key_label, label values can't contain '/'. e.g. `projects/<project_id>/locations/<global|region>/keyRings/<key_ring>/cryptoKeys/`")
+	flag.DurationVar(&config.KeyLabelTTL, "key_label_ttl", defaultKeyLabelTTL, "how long the key label of a bucket is cached")
+	flag.StringVar(&config.KeyMetadataObject, "key_metadata_object", defaultKeyMetadataObject, "Object whose custom metadata key_label names the key of its bucket when the bucket has no such label, e.g. `.gcsproxy`. Disabled when empty.")
+	flag.StringVar(&config.requestKeysString, "request_keys", defaultRequestKeysString, "Keys a request may select with the x-gcsproxy-key header instead of the key of the bucket, e.g. a key per tenant. The header is never forwarded. Format is `BUCKET:KEY1|KEY2,*:KEY3`, a bucket's own list replaces the * list.")
+	flag.StringVar(&config.keyScopesString, "key_scopes", defaultKeyScopesString, "Object prefixes encrypted with a key of their own from key_registry, so they can be shredded by destroying the key. A * segment gives each of its values a key, e.g. one per tenant. Format is `BUCKET:PREFIX1|PREFIX2,*:PREFIX3` for example `shared:tenants/*/`")
+	flag.StringVar(&config.KeyRegistryPath, "key_registry", defaultKeyRegistryPath, "path to the local registry of key_scopes keys, each key is wrapped with the KMS key of its bucket")
+	flag.StringVar(&config.Shred, "shred", "", "destroy the keys of the key scopes under `gs://BUCKET/PREFIX` in key_registry, mark the objects encrypted with them and exit")
+	flag.StringVar(&config.keyAliasesString, "key_aliases", defaultKeyAliasesString, "Decrypt objects stored with an old key name with its new name, e.g. after a key moved projects. Writes always use kms_bucket_key_mappings. Format is `OLDKEY=NEWKEY,OLDKEY2=NEWKEY2`")
+	flag.StringVar(&config.decryptKeysString, "decrypt_keys", defaultDecryptKeysString, "Decrypt-only keys tried in order when the stored key (or its alias) can't decrypt an object or x-encryption-key is missing. Format is `KEY1,KEY2`")
+	flag.DurationVar(&config.DecryptKeyNegativeTTL, "decrypt_key_negative_ttl", defaultDecryptKeyNegativeTTL, "how long a key that failed to decrypt an object is not tried for it again")
+	flag.StringVar(&config.VaultAddr, "vault_addr", defaultVaultAddr, "Vault server of vault-transit://<mount>/<key> keys in kms_bucket_key_mappings, e.g. https://vault:8200")
+	flag.StringVar(&config.VaultNamespace, "vault_namespace", defaultVaultNamespace, "Vault Enterprise namespace of the transit mount")
+	flag.StringVar(&config.VaultRoleID, "vault_role_id", defaultVaultRoleID, "AppRole role id to log in to Vault with when VAULT_TOKEN is not set. The secret id is read from VAULT_SECRET_ID.")
+	flag.StringVar(&config.VaultAppRoleMount, "vault_approle_mount", defaultVaultAppRoleMount, "mount path of the AppRole auth method")
+	flag.DurationVar(&config.KmsTimeout, "kms_timeout", defaultKmsTimeout, "timeout of a single KMS call, 0 for no timeout")
+	flag.IntVar(&config.KmsMaxAttempts, "kms_max_attempts", defaultKmsMaxAttempts, "attempts of a KMS call that fails with a transient error (unavailable, resource exhausted, timeout)")
+	flag.DurationVar(&config.KmsInitialBackoff, "kms_initial_backoff", defaultKmsInitialBackoff, "backoff before the first KMS retry, doubled for each further retry with full jitter")
+	flag.DurationVar(&config.KmsMaxBackoff, "kms_max_backoff", defaultKmsMaxBackoff, "longest backoff between KMS retries")
+	flag.IntVar(&config.KmsBreakerThreshold, "kms_breaker_threshold", defaultKmsBreakerThreshold, "Consecutive KMS calls of a key that fail with transient errors before its circuit breaker opens and requests fail fast with a 503. 0 disables the circuit breaker.")
+	flag.DurationVar(&config.KmsBreakerCooldown, "kms_breaker_cooldown", defaultKmsBreakerCooldown, "how long an open circuit breaker fails fast before it lets a probe call through")
+	flag.StringVar(&config.encryptMetadataString, "encrypt_metadata", defaultEncryptMetadataString, "Buckets whose custom metadata values are encrypted with the bucket's KMS key. Format is `BUCKET1,BUCKET2` or `*` for every mapped bucket.")
+	flag.BoolVar(&config.EncryptContentDisposition, "encrypt_content_disposition", defaultEncryptContentDisposition, "also encrypt contentDisposition in encrypt_metadata buckets. Browsers can't use the header of objects downloaded without the proxy.")
+	flag.StringVar(&config.Md5Metadata, "md5_metadata", defaultMd5Metadata, "How the md5 and crc32c hashes of the plaintext are stored in the x-md5Hash and x-crc32c metadata. `plaintext` allows confirmation attacks against known files, `encrypted` encrypts them with the bucket's KMS key.")
+	flag.StringVar(&config.VerifyObject, "verify_object", "", "verify the md5 hash of verify_file against the x-md5Hash metadata of `gs://BUCKET/OBJECT` and exit")
+	flag.StringVar(&config.VerifyFile, "verify_file", "", "plaintext copy of verify_object")
+	flag.StringVar(&config.encryptNamesString, "encrypt_names", defaultEncryptNamesString, "Buckets whose object names are encrypted, each path segment is encrypted deterministically with AES-SIV. Format is `BUCKET1,BUCKET2` or `*` for every mapped bucket.")
+	flag.StringVar(&config.NameKeysetPath, "name_keyset", defaultNameKeysetPath, "path to the AES-SIV keyset used by encrypt_names")
+	flag.StringVar(&config.NameKeysetKey, "name_keyset_key", defaultNameKeysetKey, "KMS key the name keyset is encrypted with, e.g. `projects/<project_id>/locations/<global|region>/keyRings/<key_ring>/cryptoKeys/<key>`")
+	flag.BoolVar(&config.GenerateNameKeyset, "generate_name_keyset", false, "write a new name keyset to name_keyset, encrypted with name_keyset_key, and exit")
+	flag.StringVar(&config.gcsHostsString, "gcs_hosts", defaultGcsHostsString, "Additional hosts to intercept as GCS, e.g. private service connect or custom endpoints. storage.googleapis.com, regional endpoints and STORAGE_EMULATOR_HOST are always intercepted. Format is `HOST,suffix:.SUFFIX,regex:REGEX`")
+	flag.StringVar(&config.EndpointAddr, "endpoint_port", defaultEndpointAddr, "endpoint mode listen addr, e.g. :9090. Clients use it as a GCS endpoint (STORAGE_EMULATOR_HOST or a custom endpoint) instead of a proxy. Without endpoint_cert_file an addr without host listens on 127.0.0.1 only, plain HTTP exposes bearer tokens and plaintext objects. Disabled when empty.")
+	flag.StringVar(&config.EndpointUpstream, "endpoint_upstream", defaultEndpointUpstream, "GCS host the endpoint forwards requests to")
+	flag.StringVar(&config.EndpointCertFile, "endpoint_cert_file", defaultEndpointCertFile, "TLS certificate for the endpoint. The endpoint serves plain HTTP on loopback when empty.")
+	flag.StringVar(&config.EndpointKeyFile, "endpoint_key_file", defaultEndpointKeyFile, "TLS private key for the endpoint")
+	flag.StringVar(&config.MetricsAddr, "metrics_port", defaultMetricsAddr, "prometheus metrics listen addr, e.g. :9464. Metrics are served at /metrics. Disabled when empty.")
+	flag.StringVar(&config.AuditLog, "audit_log", defaultAuditLog, "file the hash-chained audit records of every encryption and decryption are appended to. Disabled when empty.")
+	flag.IntVar(&config.AuditMaxBytes, "audit_max_bytes", defaultAuditMaxBytes, "size the audit log is rotated at, 0 to never rotate")
+	flag.IntVar(&config.AuditMaxFiles, "audit_max_files", defaultAuditMaxFiles, "rotated audit logs kept, audit_log.1 is the newest")
+	flag.StringVar(&config.AuditSyslog, "audit_syslog", defaultAuditSyslog, "send the audit records to syslog instead of audit_log: `local`, `udp://HOST:PORT` or `tcp://HOST:PORT`")
+	flag.StringVar(&config.VerifyAudit, "verify_audit", "", "verify the hash chain of the audit log at `PATH` and its rotated files and exit")
 
 	flag.BoolVar(&config.UpstreamCert, "upstream_cert", false, "connect to upstream server to look up certificate details")
 	flag.Parse()
+	// secrets are only read from the environment, command lines are visible to other processes
+	config.VaultToken = os.Getenv("VAULT_TOKEN")
+	config.VaultSecretID = os.Getenv("VAULT_SECRET_ID")
+	config.AuditHmacKey = os.Getenv("GCS_PROXY_AUDIT_HMAC_KEY")
 	config.KmsBucketKeyMapping = getBucketKeyMappings(config.kmsBucketKeyMappingString)
+	config.RequestKeys = getBucketLists("request_keys", config.requestKeysString)
+	config.KeyScopes = getBucketLists("key_scopes", config.keyScopesString)
+	config.KeyAliases = getKeyAliases(config.keyAliasesString)
+	config.DecryptKeys = getKeyList(config.decryptKeysString)
+	config.FailurePolicy = getFailurePolicy(config.failurePolicyString)
+	config.PlaintextBuckets = getBucketSet(config.plaintextBucketsString)
+	config.Compression = getCompression(config.compressionString)
+	config.Padding = getPadding(config.paddingString)
+	config.EncryptMetadataBuckets = getBucketSet(config.encryptMetadataString)
+	config.EncryptNamesBuckets = getBucketSet(config.encryptNamesString)
+	config.GcsHosts = getGcsHosts(config.gcsHostsString, os.Getenv("STORAGE_EMULATOR_HOST"))
+	config.UnmappedBucketMode = strings.ToLower(config.UnmappedBucketMode)
+	if config.UnmappedBucketMode != UnmappedBucketAllow && config.UnmappedBucketMode != UnmappedBucketDeny && config.UnmappedBucketMode != UnmappedBucketReport {
+		log.Fatalf("invalid unmapped_bucket_mode '%v', expected allow, deny or report", config.UnmappedBucketMode)
+	}
+	config.LogFormat = strings.ToLower(config.LogFormat)
+	if config.LogFormat != LogFormatJson && config.LogFormat != LogFormatText {
+		log.Fatalf("invalid log_format '%v', expected json or text", config.LogFormat)
+	}
+	config.Md5Metadata = strings.ToLower(config.Md5Metadata)
+	if config.Md5Metadata != Md5MetadataPlaintext && config.Md5Metadata != Md5MetadataEncrypted {
+		log.Fatalf("invalid md5_metadata '%v', expected plaintext or encrypted", config.Md5Metadata)
+	}
+	if config.KeyLabel != "" && config.KeyLabelPrefix == "" {
+		log.Fatalf("key_label requires key_label_prefix, label values can't contain a key name")
+	}
+	if config.KeyMetadataObject != "" && config.KeyLabel == "" {
+		log.Fatalf("key_metadata_object requires key_label, the metadata key that names the key")
+	}
+	if config.AuditLog != "" && config.AuditSyslog != "" {
+		log.Fatalf("audit_log and audit_syslog can't be combined, the hash chain is written to one of them")
+	}
+	if config.AuditMaxBytes < 0 || config.AuditMaxFiles < 1 {
+		log.Fatalf("audit_max_bytes must not be negative and audit_max_files must be at least 1")
+	}
+	if (len(config.KeyScopes) > 0 || config.Shred != "") && config.KeyRegistryPath == "" {
+		log.Fatalf("key_scopes and shred require key_registry")
+	}
+	for bucket, prefixes := range config.KeyScopes {
+		if config.EncryptNamesBuckets[bucket] || config.EncryptNamesBuckets["*"] || (bucket == "*" && len(config.EncryptNamesBuckets) > 0) {
+			log.Fatalf("key_scopes of bucket '%v' can't be combined with encrypt_names, prefixes are matched against the stored names", bucket)
+		}
+		for _, prefix := range prefixes {
+			for _, segment := range strings.Split(prefix, "/") {
+				if strings.Contains(segment, "*") && segment != "*" {
+					log.Fatalf("invalid key scope '%v', * must be a whole path segment", prefix)
+				}
+			}
+		}
+	}
+	if config.DekCacheMaxObjects < 0 || config.DekCacheMaxBytes < 0 || config.DekCacheMaxAge < 0 || config.DekCacheDecryptEntries < 0 {
+		log.Fatalf("invalid dek_cache limits, expected values >= 0")
+	}
+	if config.KmsTimeout < 0 || config.KmsMaxAttempts < 1 || config.KmsInitialBackoff < 0 || config.KmsMaxBackoff < 0 || config.KmsBreakerThreshold < 0 || config.KmsBreakerCooldown < 0 {
+		log.Fatalf("invalid kms policy, expected kms_max_attempts >= 1 and other values >= 0")
+	}
 	config.GCSProxyVersion = "0.3"
 	GlobalConfig = config
 	return config
@@ -81,7 +364,8 @@ func getBucketKeyMappings(bucketKeyMapString string) map[string]string {
 	bucketKeys := strings.Split(bucketKeyMapString, ",")
 	for i := 0; i < len(bucketKeys); i++ {
 
-		bucketKeyArray := strings.Split(bucketKeys[i], ":")
+		// keys may contain ":" themselves, e.g. vault-transit://transit/key
+		bucketKeyArray := strings.SplitN(bucketKeys[i], ":", 2)
 		bucketKeyMap[bucketKeyArray[0]] = bucketKeyArray[1]
 	}
 
@@ -90,6 +374,147 @@ func getBucketKeyMappings(bucketKeyMapString string) map[string]string {
 
 }
 
+// Parsing "bucket:open,*:closed".
+func getFailurePolicy(failurePolicyString string) map[string]string {
+	failurePolicy := make(map[string]string)
+	if failurePolicyString == "" {
+		return failurePolicy
+	}
+
+	for _, bucketPolicy := range strings.Split(failurePolicyString, ",") {
+		bucketPolicyArray := strings.Split(bucketPolicy, ":")
+		if len(bucketPolicyArray) != 2 {
+			log.Fatalf("invalid failure policy '%v', expected BUCKET:open|closed", bucketPolicy)
+		}
+		policy := strings.ToLower(strings.TrimSpace(bucketPolicyArray[1]))
+		if policy != FailOpen && policy != FailClosed {
+			log.Fatalf("invalid failure policy '%v' for bucket '%v', expected open or closed", policy, strings.TrimSpace(bucketPolicyArray[0]))
+		}
+		failurePolicy[strings.TrimSpace(bucketPolicyArray[0])] = policy
+	}
+
+	log.Debugf("FailurePolicy: %v", failurePolicy)
+	return failurePolicy
+}
+
+// Parsing "bucket:zstd,*:none"
+func getCompression(compressionString string) map[string]string {
+	compression := make(map[string]string)
+	if compressionString == "" {
+		return compression
+	}
+
+	for _, bucketCompression := range strings.Split(compressionString, ",") {
+		bucketCompressionArray := strings.Split(bucketCompression, ":")
+		if len(bucketCompressionArray) != 2 {
+			log.Fatalf("invalid compression '%v', expected BUCKET:none|gzip|zstd", bucketCompression)
+		}
+		algorithm := strings.ToLower(strings.TrimSpace(bucketCompressionArray[1]))
+		if algorithm != CompressionNone && algorithm != CompressionGzip && algorithm != CompressionZstd {
+			log.Fatalf("invalid compression '%v', expected BUCKET:none|gzip|zstd", bucketCompression)
+		}
+		compression[strings.TrimSpace(bucketCompressionArray[0])] = algorithm
+	}
+
+	log.Debugf("Compression: %v", compression)
+	return compression
+}
+
+// Parsing "bucket:projects/p/.../cryptoKeys/a|projects/p/.../cryptoKeys/b,*:key3" or "bucket:tenants/*/|logs/"
+func getBucketLists(flagName string, bucketListsString string) map[string][]string {
+	bucketLists := make(map[string][]string)
+	if bucketListsString == "" {
+		return bucketLists
+	}
+
+	for _, bucketList := range strings.Split(bucketListsString, ",") {
+		// bucket names contain no ":" but vault-transit:// keys do, split at the first one only
+		bucketListArray := strings.SplitN(bucketList, ":", 2)
+		if len(bucketListArray) != 2 || strings.TrimSpace(bucketListArray[0]) == "" {
+			log.Fatalf("invalid %v '%v', expected BUCKET:VALUE1|VALUE2", flagName, bucketList)
+		}
+		bucket := strings.TrimSpace(bucketListArray[0])
+		for _, value := range strings.Split(bucketListArray[1], "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				bucketLists[bucket] = append(bucketLists[bucket], value)
+			}
+		}
+		if len(bucketLists[bucket]) == 0 {
+			log.Fatalf("invalid %v '%v', expected BUCKET:VALUE1|VALUE2", flagName, bucketList)
+		}
+	}
+
+	log.Debugf("%v: %v", flagName, bucketLists)
+	return bucketLists
+}
+
+// Parsing "projects/p/.../cryptoKeys/old=projects/q/.../cryptoKeys/new,old2=new2"
+func getKeyAliases(keyAliasesString string) map[string]string {
+	keyAliases := make(map[string]string)
+	if keyAliasesString == "" {
+		return keyAliases
+	}
+
+	for _, keyAlias := range strings.Split(keyAliasesString, ",") {
+		keyAliasArray := strings.Split(keyAlias, "=")
+		if len(keyAliasArray) != 2 || strings.TrimSpace(keyAliasArray[0]) == "" || strings.TrimSpace(keyAliasArray[1]) == "" {
+			log.Fatalf("invalid key alias '%v', expected OLDKEY=NEWKEY", keyAlias)
+		}
+		keyAliases[strings.TrimSpace(keyAliasArray[0])] = strings.TrimSpace(keyAliasArray[1])
+	}
+
+	log.Debugf("KeyAliases: %v", keyAliases)
+	return keyAliases
+}
+
+// Parsing "key1,key2" keeping the order
+func getKeyList(keysString string) []string {
+	keys := []string{}
+	for _, key := range strings.Split(keysString, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Parsing "bucket:pow2,bucket2:65536,*:none"
+func getPadding(paddingString string) map[string]string {
+	padding := make(map[string]string)
+	if paddingString == "" {
+		return padding
+	}
+
+	for _, bucketPadding := range strings.Split(paddingString, ",") {
+		bucketPaddingArray := strings.Split(bucketPadding, ":")
+		if len(bucketPaddingArray) != 2 {
+			log.Fatalf("invalid padding '%v', expected BUCKET:none|pow2|BLOCKSIZE", bucketPadding)
+		}
+		policy := strings.ToLower(strings.TrimSpace(bucketPaddingArray[1]))
+		if policy != PaddingNone && policy != PaddingPow2 {
+			if blockSize, err := strconv.Atoi(policy); err != nil || blockSize < 1 {
+				log.Fatalf("invalid padding '%v', expected BUCKET:none|pow2|BLOCKSIZE", bucketPadding)
+			}
+		}
+		padding[strings.TrimSpace(bucketPaddingArray[0])] = policy
+	}
+
+	log.Debugf("Padding: %v", padding)
+	return padding
+}
+
+// Parsing "bucket1,bucket2"
+func getBucketSet(bucketsString string) map[string]bool {
+	buckets := make(map[string]bool)
+	for _, bucket := range strings.Split(bucketsString, ",") {
+		bucket = strings.TrimSpace(bucket)
+		if bucket != "" {
+			buckets[bucket] = true
+		}
+	}
+	return buckets
+}
+
 func isEncryptDisabled() bool {
 	if os.Getenv("GCS_PROXY_DISABLE_ENCRYPTION") == "" {
 		return false
@@ -113,6 +538,14 @@ func envConfigBoolWithDefault(key string, defValue bool) bool {
 	return defValue
 }
 
+func envConfigDurationWithDefault(key string, defValue time.Duration) time.Duration {
+	envVar, durationError := time.ParseDuration(os.Getenv(key))
+	if durationError == nil {
+		return envVar
+	}
+	return defValue
+}
+
 func envConfigIntWithDefault(key string, defValue int) int {
 	envVar, intError := strconv.Atoi(os.Getenv(key))
 	if intError == nil {
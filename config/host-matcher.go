@@ -0,0 +1,104 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package cfg
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HostMatcher matches the host of a request to decide if it is GCS traffic.
+type HostMatcher struct {
+	Kind  string // exact, suffix or regex
+	Value string
+	regex *regexp.Regexp
+}
+
+// hosts intercepted in addition to the gcs_hosts setting
+var defaultGcsHosts = []string{
+	"exact:storage.googleapis.com",
+	"exact:www.googleapis.com",
+	"exact:storage.mtls.googleapis.com",
+	"suffix:.storage.googleapis.com",                          // virtual hosted XML API buckets
+	`regex:^storage\.[a-z0-9-]+\.rep\.googleapis\.com$`,       // regional endpoints
+	`regex:^storage\.[a-z0-9-]+\.rep\.mtls\.googleapis\.com$`, // regional mtls endpoints
+	`regex:^storage-[a-z0-9-]+\.p\.googleapis\.com$`,          // private service connect endpoints
+}
+
+// Parsing "kind:value" where kind is exact, suffix or regex. A value without a kind is exact.
+func NewHostMatcher(hostMatcherString string) (HostMatcher, error) {
+	kind, value, found := strings.Cut(hostMatcherString, ":")
+	if !found || (kind != "exact" && kind != "suffix" && kind != "regex") {
+		// host:port without a kind
+		kind, value = "exact", hostMatcherString
+	}
+
+	matcher := HostMatcher{Kind: kind, Value: strings.ToLower(value)}
+	if kind == "regex" {
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return matcher, fmt.Errorf("invalid host regex '%v': %w", value, err)
+		}
+		matcher.regex = regex
+	}
+	return matcher, nil
+}
+
+// Matches checks host with and without the port so "localhost:9023" and "storage.googleapis.com" both work.
+func (m HostMatcher) Matches(host string) bool {
+	host = strings.ToLower(host)
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+
+	switch m.Kind {
+	case "exact":
+		return host == m.Value || hostname == m.Value
+	case "suffix":
+		return strings.HasSuffix(hostname, m.Value)
+	case "regex":
+		return m.regex.MatchString(host) || m.regex.MatchString(hostname)
+	}
+	return false
+}
+
+// Parsing "storage.example.com,suffix:.corp.example.com,regex:^gcs-[0-9]+\.example\.com$" plus
+// the default GCS hosts and STORAGE_EMULATOR_HOST.
+func getGcsHosts(gcsHostsString string, emulatorHost string) []HostMatcher {
+	hostStrings := append([]string{}, defaultGcsHosts...)
+
+	if emulatorHost != "" {
+		// STORAGE_EMULATOR_HOST may be host:port or a url
+		if u, err := url.Parse(emulatorHost); err == nil && u.Host != "" {
+			emulatorHost = u.Host
+		}
+		hostStrings = append(hostStrings, "exact:"+emulatorHost)
+	}
+
+	for _, hostString := range strings.Split(gcsHostsString, ",") {
+		hostString = strings.TrimSpace(hostString)
+		if hostString != "" {
+			hostStrings = append(hostStrings, hostString)
+		}
+	}
+
+	var gcsHosts []HostMatcher
+	for _, hostString := range hostStrings {
+		matcher, err := NewHostMatcher(hostString)
+		if err != nil {
+			log.Fatalf("invalid gcs_hosts entry: %v", err)
+		}
+		gcsHosts = append(gcsHosts, matcher)
+	}
+
+	log.Debugf("GcsHosts: %v", gcsHosts)
+	return gcsHosts
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/registry"
+	"github.com/google/tink/go/tink"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/proto"
+)
+
+// DekCacheLimits bounds how long a data encryption key (DEK) wrapped by KMS is reused.
+type DekCacheLimits struct {
+	MaxObjects     int           // objects encrypted with one DEK, 0 disables the encrypt cache
+	MaxBytes       int           // plaintext bytes encrypted with one DEK, 0 for no limit
+	MaxAge         time.Duration // lifetime of a cached DEK, 0 for no limit
+	DecryptEntries int           // unwrapped DEKs kept for decryption, 0 disables the decrypt cache
+}
+
+// the ciphertext format of the tink KMS envelope AEAD: the 4 byte big endian length of the wrapped DEK,
+// the wrapped DEK and the payload. Objects encrypted with a cached DEK are decrypted by the envelope too.
+const wrappedDEKLengthSize = 4
+
+var dekTemplate = aead.AES256GCMKeyTemplate()
+
+var (
+	dekCacheLimits DekCacheLimits
+	dekCacheMutex  sync.Mutex
+	encryptDEKs    = map[string]*cachedDEK{} // by KMS key
+	decryptDEKs    = map[string]*cachedDEK{} // by hash of the KMS key and wrapped DEK
+
+	DekCacheHits   metric.Int64Counter
+	DekCacheMisses metric.Int64Counter
+	DekRotations   metric.Int64Counter
+)
+
+type cachedDEK struct {
+	wrappedDEK []byte
+	primitive  tink.AEAD
+	created    time.Time
+	objects    int
+	bytes      int
+}
+
+// ConfigureDekCache sets the limits of the DEK cache, it is disabled until it is configured.
+func ConfigureDekCache(limits DekCacheLimits) {
+	dekCacheMutex.Lock()
+	defer dekCacheMutex.Unlock()
+	dekCacheLimits = limits
+	encryptDEKs = map[string]*cachedDEK{}
+	decryptDEKs = map[string]*cachedDEK{}
+}
+
+// GetDekCacheLimits returns the configured limits, e.g. to report them as metrics.
+func GetDekCacheLimits() DekCacheLimits {
+	return dekCacheLimits
+}
+
+func isEncryptDekCacheEnabled() bool {
+	return dekCacheLimits.MaxObjects > 0
+}
+
+func isDecryptDekCacheEnabled() bool {
+	return dekCacheLimits.DecryptEntries > 0
+}
+
+// encryptWithCachedDEK encrypts with the cached DEK of resourceName and only calls KMS to wrap a new DEK
+// once the cached DEK reached one of its limits.
+func encryptWithCachedDEK(ctx context.Context, resourceName string, bytesToEncrypt []byte) ([]byte, error) {
+	dek, err := getEncryptDEK(ctx, resourceName, len(bytesToEncrypt))
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := dek.primitive.Encrypt(bytesToEncrypt, []byte(""))
+	if err != nil {
+		return nil, err
+	}
+
+	return joinEnvelope(dek.wrappedDEK, payload), nil
+}
+
+func getEncryptDEK(ctx context.Context, resourceName string, length int) (*cachedDEK, error) {
+	dekCacheMutex.Lock()
+	dek := encryptDEKs[resourceName]
+	reason := dekRotationReason(dek, length)
+	if reason == "" {
+		dek.objects++
+		dek.bytes += length
+		dekCacheMutex.Unlock()
+		recordDekCacheMetric(ctx, DekCacheHits, attribute.String("operation", "encrypt"))
+		return dek, nil
+	}
+	dekCacheMutex.Unlock()
+
+	recordDekCacheMetric(ctx, DekCacheMisses, attribute.String("operation", "encrypt"))
+	if dek != nil {
+		log.Debugf("rotating the DEK of %v after %v objects and %v bytes: %v limit", resourceName, dek.objects, dek.bytes, reason)
+		recordDekCacheMetric(ctx, DekRotations, attribute.String("reason", reason))
+	}
+
+	// wrap the new DEK outside of the lock, concurrent misses each wrap their own
+	dek, err := newCachedDEK(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	dek.objects = 1
+	dek.bytes = length
+
+	dekCacheMutex.Lock()
+	encryptDEKs[resourceName] = dek
+	dekCacheMutex.Unlock()
+	return dek, nil
+}
+
+// dekRotationReason returns the limit that keeps dek from encrypting another length bytes, empty if it can.
+func dekRotationReason(dek *cachedDEK, length int) string {
+	switch {
+	case dek == nil:
+		return "new"
+	case dek.objects >= dekCacheLimits.MaxObjects:
+		return "objects"
+	case dekCacheLimits.MaxBytes > 0 && dek.bytes+length > dekCacheLimits.MaxBytes:
+		return "bytes"
+	case isDekExpired(dek):
+		return "age"
+	}
+	return ""
+}
+
+func isDekExpired(dek *cachedDEK) bool {
+	return dekCacheLimits.MaxAge > 0 && time.Since(dek.created) >= dekCacheLimits.MaxAge
+}
+
+func newCachedDEK(ctx context.Context, resourceName string) (*cachedDEK, error) {
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := registry.NewKey(dekTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DEK: %w", err)
+	}
+	dek, err := proto.Marshal(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize DEK: %w", err)
+	}
+	wrappedDEK, err := kmsAEAD.Encrypt(dek, []byte{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap DEK: %w", err)
+	}
+
+	primitive, err := newDEKPrimitive(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedDEK{wrappedDEK: wrappedDEK, primitive: primitive, created: time.Now()}, nil
+}
+
+func newDEKPrimitive(dek []byte) (tink.AEAD, error) {
+	primitive, err := registry.Primitive(dekTemplate.TypeUrl, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DEK primitive: %w", err)
+	}
+	aeadPrimitive, ok := primitive.(tink.AEAD)
+	if !ok {
+		return nil, fmt.Errorf("DEK primitive is not an AEAD")
+	}
+	return aeadPrimitive, nil
+}
+
+// decryptWithCachedDEK decrypts with a cached unwrapped DEK, objects written with a cached DEK share
+// the wrapped DEK so KMS is only called once for all of them.
+func decryptWithCachedDEK(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
+	wrappedDEK, payload, err := splitEnvelope(bytesToDecrypt)
+	if err != nil {
+		return nil, err
+	}
+	primitive, err := unwrapCachedDEK(ctx, resourceName, wrappedDEK)
+	if err != nil {
+		return nil, err
+	}
+	return primitive.Decrypt(payload, []byte(""))
+}
+
+// unwrapCachedDEK returns the primitive of wrappedDEK unwrapped with resourceName, KMS is only called
+// when the decrypt cache is disabled or does not hold the DEK.
+func unwrapCachedDEK(ctx context.Context, resourceName string, wrappedDEK []byte) (tink.AEAD, error) {
+	cacheKey := wrappedDEKHash(resourceName, wrappedDEK)
+
+	if isDecryptDekCacheEnabled() {
+		dekCacheMutex.Lock()
+		dek, ok := decryptDEKs[cacheKey]
+		if ok && isDekExpired(dek) {
+			delete(decryptDEKs, cacheKey)
+			ok = false
+		}
+		dekCacheMutex.Unlock()
+
+		if ok {
+			recordDekCacheMetric(ctx, DekCacheHits, attribute.String("operation", "decrypt"))
+			return dek.primitive, nil
+		}
+		recordDekCacheMetric(ctx, DekCacheMisses, attribute.String("operation", "decrypt"))
+	}
+
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	unwrappedDEK, err := kmsAEAD.Decrypt(wrappedDEK, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	primitive, err := newDEKPrimitive(unwrappedDEK)
+	if err != nil {
+		return nil, err
+	}
+	if isDecryptDekCacheEnabled() {
+		storeDecryptDEK(cacheKey, &cachedDEK{primitive: primitive, created: time.Now()})
+	}
+	return primitive, nil
+}
+
+// joinEnvelope returns the envelope ciphertext of a payload encrypted with the wrapped DEK.
+func joinEnvelope(wrappedDEK []byte, payload []byte) []byte {
+	var ciphertext bytes.Buffer
+	ciphertext.Grow(wrappedDEKLengthSize + len(wrappedDEK) + len(payload))
+	binary.Write(&ciphertext, binary.BigEndian, uint32(len(wrappedDEK)))
+	ciphertext.Write(wrappedDEK)
+	ciphertext.Write(payload)
+	return ciphertext.Bytes()
+}
+
+// splitEnvelope returns the wrapped DEK and the payload of an envelope ciphertext.
+func splitEnvelope(ciphertext []byte) (wrappedDEK []byte, payload []byte, err error) {
+	if len(ciphertext) <= wrappedDEKLengthSize {
+		return nil, nil, fmt.Errorf("invalid ciphertext")
+	}
+	wrappedDEKLength := int(binary.BigEndian.Uint32(ciphertext))
+	if wrappedDEKLength <= 0 || len(ciphertext)-wrappedDEKLengthSize < wrappedDEKLength {
+		return nil, nil, fmt.Errorf("invalid ciphertext")
+	}
+	return ciphertext[wrappedDEKLengthSize : wrappedDEKLengthSize+wrappedDEKLength], ciphertext[wrappedDEKLengthSize+wrappedDEKLength:], nil
+}
+
+// wrappedDEKHash identifies a wrapped DEK and the key it is unwrapped with, a DEK unwrapped with one
+// key is never used for another.
+func wrappedDEKHash(resourceName string, wrappedDEK []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(resourceName))
+	hash.Write([]byte{0})
+	hash.Write(wrappedDEK)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// storeDecryptDEK evicts the oldest DEK when the cache is full
+func storeDecryptDEK(cacheKey string, dek *cachedDEK) {
+	dekCacheMutex.Lock()
+	defer dekCacheMutex.Unlock()
+
+	if len(decryptDEKs) >= dekCacheLimits.DecryptEntries {
+		var oldestKey string
+		var oldest *cachedDEK
+		for key, cached := range decryptDEKs {
+			if oldest == nil || cached.created.Before(oldest.created) {
+				oldestKey, oldest = key, cached
+			}
+		}
+		delete(decryptDEKs, oldestKey)
+	}
+	decryptDEKs[cacheKey] = dek
+}
+
+func recordDekCacheMetric(ctx context.Context, counter metric.Int64Counter, attr attribute.KeyValue) {
+	if counter != nil {
+		counter.Add(ctx, 1, metric.WithAttributes(attr))
+	}
+}
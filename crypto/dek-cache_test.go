@@ -0,0 +1,134 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDekRotationReason(t *testing.T) {
+	defer ConfigureDekCache(DekCacheLimits{})
+
+	tests := []struct {
+		name   string
+		limits DekCacheLimits
+		dek    *cachedDEK
+		length int
+		want   string
+	}{
+		{"no DEK", DekCacheLimits{MaxObjects: 2}, nil, 10, "new"},
+		{"within the limits", DekCacheLimits{MaxObjects: 2, MaxBytes: 100, MaxAge: time.Minute}, &cachedDEK{objects: 1, bytes: 80, created: time.Now()}, 20, ""},
+		{"object limit", DekCacheLimits{MaxObjects: 2}, &cachedDEK{objects: 2, created: time.Now()}, 10, "objects"},
+		{"byte limit", DekCacheLimits{MaxObjects: 2, MaxBytes: 100}, &cachedDEK{objects: 1, bytes: 95, created: time.Now()}, 10, "bytes"},
+		{"no byte limit", DekCacheLimits{MaxObjects: 2}, &cachedDEK{objects: 1, bytes: 1 << 30, created: time.Now()}, 10, ""},
+		{"max age", DekCacheLimits{MaxObjects: 2, MaxAge: time.Minute}, &cachedDEK{objects: 1, created: time.Now().Add(-2 * time.Minute)}, 10, "age"},
+	}
+	for _, test := range tests {
+		ConfigureDekCache(test.limits)
+		if got := dekRotationReason(test.dek, test.length); got != test.want {
+			t.Errorf("%v: dekRotationReason() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDekCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   DekCacheLimits
+		objects  int
+		length   int
+		encrypts int // DEKs wrapped by KMS
+		decrypts int // DEKs unwrapped by KMS
+	}{
+		{"disabled", DekCacheLimits{}, 4, 10, 4, 4},
+		{"object limit", DekCacheLimits{MaxObjects: 2, DecryptEntries: 10}, 5, 10, 3, 3},
+		{"byte limit", DekCacheLimits{MaxObjects: 100, MaxBytes: 25, DecryptEntries: 10}, 4, 10, 2, 2},
+		{"decrypt cache only", DekCacheLimits{DecryptEntries: 10}, 3, 10, 3, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault := startTestVault(t, VaultConfig{Token: "static"})
+			ConfigureDekCache(test.limits)
+			defer ConfigureDekCache(DekCacheLimits{})
+			ctx := context.Background()
+
+			var ciphertexts [][]byte
+			for i := 0; i < test.objects; i++ {
+				ciphertext, err := EncryptBytes(ctx, testVaultKey, bytes.Repeat([]byte{byte(i)}, test.length))
+				if err != nil {
+					t.Fatalf("EncryptBytes() error = %v", err)
+				}
+				ciphertexts = append(ciphertexts, ciphertext)
+			}
+			for i, ciphertext := range ciphertexts {
+				plaintext, err := DecryptBytes(ctx, testVaultKey, ciphertext)
+				if err != nil || !bytes.Equal(plaintext, bytes.Repeat([]byte{byte(i)}, test.length)) {
+					t.Fatalf("DecryptBytes() of object %v = %v, %v", i, plaintext, err)
+				}
+			}
+
+			_, encrypts, decrypts := vault.counts()
+			if encrypts != test.encrypts || decrypts != test.decrypts {
+				t.Errorf("KMS wrapped %v and unwrapped %v DEKs, want %v and %v", encrypts, decrypts, test.encrypts, test.decrypts)
+			}
+		})
+	}
+}
+
+func TestDekCacheMaxAge(t *testing.T) {
+	vault := startTestVault(t, VaultConfig{Token: "static"})
+	ConfigureDekCache(DekCacheLimits{MaxObjects: 100, MaxAge: 20 * time.Millisecond})
+	defer ConfigureDekCache(DekCacheLimits{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := EncryptBytes(context.Background(), testVaultKey, []byte("plaintext")); err != nil {
+			t.Fatalf("EncryptBytes() error = %v", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	if _, encrypts, _ := vault.counts(); encrypts != 2 {
+		t.Errorf("KMS wrapped %v DEKs, want a new DEK after the max age", encrypts)
+	}
+}
+
+func TestSplitEnvelope(t *testing.T) {
+	wrappedDEK, payload, err := splitEnvelope(joinEnvelope([]byte("wrapped"), []byte("payload")))
+	if err != nil || string(wrappedDEK) != "wrapped" || string(payload) != "payload" {
+		t.Errorf("splitEnvelope(joinEnvelope()) = %q, %q, %v", wrappedDEK, payload, err)
+	}
+
+	for _, ciphertext := range [][]byte{nil, {0, 0, 0, 0}, {0, 0, 0, 0, 1}, {0, 0, 0, 9, 1, 2}} {
+		if _, _, err := splitEnvelope(ciphertext); err == nil {
+			t.Errorf("splitEnvelope(%v) succeeded", ciphertext)
+		}
+	}
+}
+
+func TestResourceEnvelopeDekCache(t *testing.T) {
+	vault := startTestVault(t, VaultConfig{Token: "static"})
+	ConfigureDekCache(DekCacheLimits{DecryptEntries: 10})
+	defer ConfigureDekCache(DekCacheLimits{})
+	ctx := context.Background()
+
+	ciphertext, err := NewResourceEnvelope(ctx, testVaultKey).Encrypt([]byte("blue"), []byte("color"))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	// every listing decrypts with an envelope of its own
+	for i := 0; i < 3; i++ {
+		plaintext, err := NewResourceEnvelope(ctx, testVaultKey).Decrypt(ciphertext, []byte("color"))
+		if err != nil || string(plaintext) != "blue" {
+			t.Fatalf("Decrypt() = %q, %v, want blue", plaintext, err)
+		}
+	}
+	if _, _, decrypts := vault.counts(); decrypts != 1 {
+		t.Errorf("KMS unwrapped %v DEKs, want the DEK cached", decrypts)
+	}
+}
@@ -9,28 +9,56 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
+	"strings"
 	"time"
 
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
 	"github.com/google/tink/go/aead"
-	"github.com/google/tink/go/core/registry"
-	"github.com/google/tink/go/integration/gcpkms"
+	"github.com/google/tink/go/tink"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const scopeName = "github.com/byronwhitlock-google/go-gcsproxy"
 
 var (
-	otelEnabled = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
 	Meter       = otel.Meter(scopeName)
-	EncryptTime metric.Float64Gauge
-	DecryptTime metric.Float64Gauge
+	Tracer      = otel.Tracer(scopeName)
+	EncryptTime metric.Float64Histogram
+	DecryptTime metric.Float64Histogram
+	KmsTime     metric.Float64Histogram
 )
 
+// LatencyBuckets are the bucket boundaries in seconds of the latency histograms, from a cached DEK to a
+// KMS call that timed out.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metricLabelsKey struct{}
+
+// WithMetricLabels returns a context whose encryptions, decryptions and KMS calls are recorded for the
+// bucket and GCS operation of the request. The bucket is a mapped bucket or "other", never a name a
+// client made up.
+func WithMetricLabels(ctx context.Context, bucket string, operation string) context.Context {
+	return context.WithValue(ctx, metricLabelsKey{}, []attribute.KeyValue{
+		attribute.String("bucket", bucket),
+		attribute.String("operation", operation),
+	})
+}
+
+func metricLabels(ctx context.Context) []attribute.KeyValue {
+	if labels, ok := ctx.Value(metricLabelsKey{}).([]attribute.KeyValue); ok {
+		return labels
+	}
+	return []attribute.KeyValue{attribute.String("bucket", "other"), attribute.String("operation", "other")}
+}
+
 func Base64MD5Hash(byteStream []byte) string {
 	hashProvider := md5.New()
 	var base64MD5Hash string
@@ -44,101 +72,187 @@ func Base64MD5Hash(byteStream []byte) string {
 
 	// Step 2: Encode the MD5 hash as Base64
 	base64MD5Hash = base64.StdEncoding.EncodeToString(md5Hash)
-
-	// Print the result
-	log.Debugf("Base64-encoded MD5 hash:%v", base64MD5Hash)
 	return base64MD5Hash
 }
 
+// Base64Crc32cHash returns the big-endian CRC32C (Castagnoli) checksum of byteStream
+// encoded as base64, which is the format GCS uses for the crc32c field.
+func Base64Crc32cHash(byteStream []byte) string {
+	checksum := crc32.Checksum(byteStream, crc32.MakeTable(crc32.Castagnoli))
+
+	crc32cBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc32cBytes, checksum)
+
+	return base64.StdEncoding.EncodeToString(crc32cBytes)
+}
+
+// getKmsAEAD returns the AEAD that wraps DEKs with the key resourceName, a Cloud KMS key or a
+// vault-transit:// key, with the timeouts, retries and circuit breaker of the KMS policy. Scope keys are
+// local, only unwrapping them calls KMS.
+func getKmsAEAD(ctx context.Context, resourceName string) (tink.AEAD, error) {
+	if IsScopeKey(resourceName) {
+		return getScopeAEAD(ctx, resourceName)
+	}
+	if strings.HasPrefix(resourceName, VaultTransitScheme) {
+		vaultAEAD, err := newVaultTransitAEAD(resourceName)
+		if err != nil {
+			return nil, err
+		}
+		return &policyAEAD{ctx: ctx, resourceName: resourceName, remote: vaultAEAD}, nil
+	}
+
+	// projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
+	return &policyAEAD{ctx: ctx, resourceName: resourceName, remote: &gcpKmsAEAD{resourceName: resourceName}}, nil
+}
+
 // Encrypt bytes with KMS key referenced by resourceName in the format:
 // projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
+// or a Vault Transit key in the format vault-transit://<mount>/<key> or a scope key scope-key://<id>
 func EncryptBytes(ctx context.Context, resourceName string, bytesToEncrypt []byte) ([]byte, error) {
+	ctx, span := Tracer.Start(ctx, "encrypt", trace.WithAttributes(
+		attribute.String("key", resourceName),
+		attribute.Int("size", len(bytesToEncrypt)),
+	))
+	encryptedBytes, err := encryptBytes(ctx, resourceName, bytesToEncrypt)
+	if auditErr := audit.RecordKeyUse(ctx, "encrypt", resourceName, err); auditErr != nil && err == nil {
+		// ciphertext without an audit record is not returned
+		err = fmt.Errorf("error encrypting data: %w", auditErr)
+	}
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedBytes, nil
+}
+
+func encryptBytes(ctx context.Context, resourceName string, bytesToEncrypt []byte) ([]byte, error) {
 	// Capture the encryption latency
 	latencyStart := time.Now()
 
-	// Construct the full key URI for Google Cloud KMS
-	//projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
-	keyURI := fmt.Sprintf("gcp-kms://%s", resourceName)
+	// a DEK cached for a scope key must not outlive the key
+	if err := scopeKeyError(resourceName); err != nil {
+		return nil, fmt.Errorf("error encrypting data: %w", err)
+	}
 
-	// Create a KMS client
-	kmsClient, err := gcpkms.NewClientWithOptions(ctx, keyURI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	// reuse a wrapped DEK instead of calling KMS for every object
+	if isEncryptDekCacheEnabled() {
+		encryptedBytes, err := encryptWithCachedDEK(ctx, resourceName, bytesToEncrypt)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting data: %w", err)
+		}
+		recordLatency(ctx, EncryptTime, latencyStart)
+		return encryptedBytes, nil
 	}
 
-	// Create a KMS AEAD client
-	kmsAEAD, err := kmsClient.GetAEAD(keyURI)
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+		return nil, err
 	}
 
-	// 2. Register the KMS AEAD primitive wrapper.
-	registry.RegisterKMSClient(kmsClient)
-
-	// 3. Create the KMS-backed envelope AEAD.
+	// Create the KMS-backed envelope AEAD.
 	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kmsAEAD)
 	if envAEAD == nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %v", err)
+		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %w", err)
 	}
 
 	// Encrypt the bytes
 	aad := []byte("")
 	encryptedBytes, err := envAEAD.Encrypt(bytesToEncrypt, aad)
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting data: %v", err)
+		return nil, fmt.Errorf("error encrypting data: %w", err)
 	}
 
-	elapsed := time.Since(latencyStart).Seconds()
-	requestId, ok := ctx.Value("requestid").(string)
-	if otelEnabled != "" && ok {
-		metricAttribute := attribute.String("gcsproxy-request-id", requestId)
-		EncryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttribute))
-	}
+	recordLatency(ctx, EncryptTime, latencyStart)
 
 	return encryptedBytes, nil
 }
 
+// DecryptBytes decrypts bytes encrypted with resourceName, the key in the x-encryption-key metadata. The
+// aliases and decrypt-only keys of the keyring are tried when the key was renamed, moved or is missing.
+func DecryptBytes(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
+	ctx, span := Tracer.Start(ctx, "decrypt", trace.WithAttributes(
+		attribute.String("key", resourceName),
+		attribute.Int("size", len(bytesToDecrypt)),
+	))
+	decryptedBytes, err := decryptBytes(ctx, resourceName, bytesToDecrypt)
+	if auditErr := audit.RecordKeyUse(ctx, "decrypt", resourceName, err); auditErr != nil && err == nil {
+		// plaintext without an audit record is not returned
+		err = fmt.Errorf("error decrypting data: %w", auditErr)
+	}
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return decryptedBytes, nil
+}
+
+func decryptBytes(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
+	candidates := decryptKeyCandidates(resourceName)
+	switch {
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("error decrypting data: the x-encryption-key metadata is missing and no decrypt keys are configured")
+	case len(candidates) == 1 && candidates[0] == resourceName:
+		return decryptBytesWithKey(ctx, resourceName, bytesToDecrypt)
+	}
+	return decryptWithKeyring(ctx, resourceName, candidates, bytesToDecrypt)
+}
+
 // Decrypts bytes with using KMS key referenced by resourceName in the format:
 // projects/<projectname>/locations/<location>/keyRings/<project>/cryptoKeys/<key-ring>/cryptoKeyVersions/1
-func DecryptBytes(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
+// or a Vault Transit key in the format vault-transit://<mount>/<key>
+func decryptBytesWithKey(ctx context.Context, resourceName string, bytesToDecrypt []byte) ([]byte, error) {
 	// Capture the decryption latency
 	latencyStart := time.Now()
-	// Construct the full key URI for Google Cloud KMS
-	keyURI := fmt.Sprintf("gcp-kms://%s", resourceName)
 
-	// Create a KMS client
-	kmsClient, err := gcpkms.NewClientWithOptions(ctx, keyURI /*, option.WithCredentialsFile("path/to/credentials.json")*/)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	// a DEK cached for a scope key must not outlive the key
+	if err := scopeKeyError(resourceName); err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
 	}
 
-	// Create a KMS AEAD client
-	kmsAEAD, err := kmsClient.GetAEAD(keyURI)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD client: %v", err)
+	if isDecryptDekCacheEnabled() {
+		decryptedBytes, err := decryptWithCachedDEK(ctx, resourceName, bytesToDecrypt)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting data: %w", err)
+		}
+		recordLatency(ctx, DecryptTime, latencyStart)
+		return decryptedBytes, nil
 	}
 
-	// Register the KMS AEAD primitive wrapper.
-	registry.RegisterKMSClient(kmsClient)
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the KMS-backed envelope AEAD.
 	envAEAD := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kmsAEAD)
 	if envAEAD == nil {
-		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %v", err)
+		return nil, fmt.Errorf("failed to create KMS AEAD envelope: %w", err)
 	}
 	// Decrypt bytes with KMS key
 	aad := []byte("")
 	decryptedBytes, err := envAEAD.Decrypt(bytesToDecrypt, aad)
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting data: %v", err)
+		return nil, fmt.Errorf("error encrypting data: %w", err)
 	}
 
-	elapsed := time.Since(latencyStart).Seconds()
-	requestId, ok := ctx.Value("requestid").(string)
-	if otelEnabled != "" && ok {
-		metricAttribute := attribute.String("gcsproxy-request-id", requestId)
-		DecryptTime.Record(ctx, elapsed, metric.WithAttributes(metricAttribute))
-	}
+	recordLatency(ctx, DecryptTime, latencyStart)
 
 	return decryptedBytes, nil
 }
+
+// recordLatency records the seconds since latencyStart with the labels of the request, never its id.
+func recordLatency(ctx context.Context, histogram metric.Float64Histogram, latencyStart time.Time, attributes ...attribute.KeyValue) {
+	if histogram != nil {
+		attributes = append(attributes, metricLabels(ctx)...)
+		histogram.Record(ctx, time.Since(latencyStart).Seconds(), metric.WithAttributes(attributes...))
+	}
+}
+
+// EndSpan ends span, failed when err is set.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+)
+
+var (
+	gcpKmsClientMutex sync.Mutex
+	gcpKmsClient      *kms.KeyManagementClient // shared by all keys, it outlives the requests
+)
+
+// gcpKmsAEAD wraps and unwraps DEKs with a Cloud KMS key. The ciphertext is the one the tink gcpkms
+// integration produced, so DEKs it wrapped still unwrap.
+type gcpKmsAEAD struct {
+	resourceName string
+}
+
+func getGcpKmsClient() (*kms.KeyManagementClient, error) {
+	gcpKmsClientMutex.Lock()
+	defer gcpKmsClientMutex.Unlock()
+	if gcpKmsClient == nil {
+		client, err := kms.NewKeyManagementClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create KMS client: %w", err)
+		}
+		gcpKmsClient = client
+	}
+	return gcpKmsClient, nil
+}
+
+// the KMS policy retries, the client must not retry on its own
+var noKmsClientRetry = gax.WithRetry(nil)
+
+func (a *gcpKmsAEAD) Encrypt(ctx context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	client, err := getGcpKmsClient()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:                        a.resourceName,
+		Plaintext:                   plaintext,
+		AdditionalAuthenticatedData: associatedData,
+	}, noKmsClientRetry)
+	if err != nil {
+		return nil, err
+	}
+	return response.Ciphertext, nil
+}
+
+func (a *gcpKmsAEAD) Decrypt(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	client, err := getGcpKmsClient()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:                        a.resourceName,
+		Ciphertext:                  ciphertext,
+		AdditionalAuthenticatedData: associatedData,
+	}, noKmsClientRetry)
+	if err != nil {
+		return nil, err
+	}
+	return response.Plaintext, nil
+}
@@ -0,0 +1,395 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScopeKeyScheme prefixes the keys of key scopes in the x-encryption-key metadata: scope-key://<id>. A scope
+// key is an AES-GCM keyset in the local key registry wrapped with a KMS key, it wraps the DEKs of the scope
+// like a KMS key does. Destroying it makes every object of the scope unreadable.
+const ScopeKeyScheme = "scope-key://"
+
+// ErrScopeKeyShredded is returned for objects whose scope key was destroyed.
+var ErrScopeKeyShredded = errors.New("scope key shredded")
+
+// ScopeKey is a key of the registry. Shredding removes the wrapped keyset, the entry stays as the record
+// of the erasure.
+type ScopeKey struct {
+	Id               string     `json:"id"`
+	Bucket           string     `json:"bucket"`
+	Prefix           string     `json:"prefix"`
+	KeyEncryptionKey string     `json:"keyEncryptionKey"` // KMS key the keyset is wrapped with
+	Keyset           string     `json:"keyset,omitempty"`
+	Created          time.Time  `json:"created"`
+	Shredded         *time.Time `json:"shredded,omitempty"`
+}
+
+type keyRegistryFile struct {
+	Keys []*ScopeKey `json:"keys"`
+}
+
+// the proxy and the shred command update the registry, a lock file older than this was left by a process
+// that died while holding it
+const staleRegistryLock = 30 * time.Second
+
+var (
+	registryMutex   sync.Mutex
+	registryPath    string
+	registryKeys    []*ScopeKey
+	registryInfo    os.FileInfo
+	scopePrimitives = map[string]tink.AEAD{} // unwrapped keysets by id
+)
+
+// ConfigureKeyRegistry sets the path of the registry, scope keys can't be used until it is configured.
+func ConfigureKeyRegistry(path string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registryPath = path
+	registryKeys = nil
+	registryInfo = nil
+	scopePrimitives = map[string]tink.AEAD{}
+}
+
+func IsScopeKey(resourceName string) bool {
+	return strings.HasPrefix(resourceName, ScopeKeyScheme)
+}
+
+// IsScopeKeyShredded reports if resourceName is a scope key that was destroyed.
+func IsScopeKeyShredded(resourceName string) bool {
+	return errors.Is(scopeKeyError(resourceName), ErrScopeKeyShredded)
+}
+
+// GetScopeKey returns the key of the scope gs://bucket/prefix. Scopes without a key, or whose key was
+// shredded, get a new key wrapped with keyEncryptionKey.
+func GetScopeKey(ctx context.Context, bucket string, prefix string, keyEncryptionKey string) (string, error) {
+	registryMutex.Lock()
+	err := reloadRegistry()
+	key := findScopeKey(registryKeys, bucket, prefix)
+	registryMutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		return ScopeKeyScheme + key.Id, nil
+	}
+
+	// wrap the new keyset before taking the lock, it is a KMS call
+	newKey, err := newScopeKey(ctx, bucket, prefix, keyEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	id := newKey.Id
+	err = updateRegistry(func(keys []*ScopeKey) ([]*ScopeKey, bool) {
+		// another request or the proxy of another host registered the scope meanwhile
+		if key := findScopeKey(keys, bucket, prefix); key != nil {
+			id = key.Id
+			return keys, false
+		}
+		return append(keys, newKey), true
+	})
+	if err != nil {
+		return "", err
+	}
+	if id == newKey.Id {
+		log.Infof("registered key %v%v for scope gs://%v/%v wrapped with %v", ScopeKeyScheme, id, bucket, prefix, keyEncryptionKey)
+	}
+	return ScopeKeyScheme + id, nil
+}
+
+// ShredScopeKeys destroys the keys of the scope prefix of bucket, or of every scope under prefix when it
+// ends with "/", and returns them. Keys that were shredded before are returned as well, so objects left
+// unmarked by an earlier run can be marked.
+func ShredScopeKeys(bucket string, prefix string) ([]ScopeKey, error) {
+	var shredded []ScopeKey
+	now := time.Now().UTC()
+	err := updateRegistry(func(keys []*ScopeKey) ([]*ScopeKey, bool) {
+		changed := false
+		for _, key := range keys {
+			// tenants/acme must not shred tenants/acme2/
+			underPrefix := (prefix == "" || strings.HasSuffix(prefix, "/")) && strings.HasPrefix(key.Prefix, prefix)
+			if key.Bucket != bucket || (key.Prefix != prefix && !underPrefix) {
+				continue
+			}
+			if key.Shredded == nil {
+				key.Keyset = ""
+				key.Shredded = &now
+				changed = true
+				log.Warnf("shredded key %v%v of scope gs://%v/%v", ScopeKeyScheme, key.Id, key.Bucket, key.Prefix)
+			}
+			shredded = append(shredded, *key)
+		}
+		return keys, changed
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(shredded) == 0 {
+		return nil, fmt.Errorf("no keys are registered for scopes under gs://%v/%v", bucket, prefix)
+	}
+	return shredded, nil
+}
+
+func newScopeKey(ctx context.Context, bucket string, prefix string, keyEncryptionKey string) (*ScopeKey, error) {
+	kmsAEAD, err := getKmsAEAD(ctx, keyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate scope key: %w", err)
+	}
+	var wrappedKeyset bytes.Buffer
+	err = handle.Write(keyset.NewJSONWriter(&wrappedKeyset), kmsAEAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap scope key: %w", err)
+	}
+
+	// the id is random, it is stored in the object metadata and must not reveal the scope
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate scope key id: %w", err)
+	}
+	return &ScopeKey{
+		Id:               hex.EncodeToString(id),
+		Bucket:           bucket,
+		Prefix:           prefix,
+		KeyEncryptionKey: keyEncryptionKey,
+		Keyset:           wrappedKeyset.String(),
+		Created:          time.Now().UTC(),
+	}, nil
+}
+
+// getScopeAEAD returns the unwrapped keyset of a scope key. The registry is checked on every call, so a
+// key shredded by the shred command stops decrypting without restarting the proxy.
+func getScopeAEAD(ctx context.Context, resourceName string) (tink.AEAD, error) {
+	id := strings.TrimPrefix(resourceName, ScopeKeyScheme)
+
+	registryMutex.Lock()
+	err := reloadRegistry()
+	key := findScopeKeyById(registryKeys, id)
+	primitive := scopePrimitives[id]
+	registryMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScopeKey(resourceName, key); err != nil {
+		return nil, err
+	}
+	if primitive != nil {
+		return primitive, nil
+	}
+
+	kmsAEAD, err := getKmsAEAD(ctx, key.KeyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := keyset.Read(keyset.NewJSONReader(strings.NewReader(key.Keyset)), kmsAEAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap scope key %v: %w", resourceName, err)
+	}
+	primitive, err = aead.New(handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scope key primitive: %w", err)
+	}
+
+	registryMutex.Lock()
+	scopePrimitives[id] = primitive
+	registryMutex.Unlock()
+	return primitive, nil
+}
+
+// scopeKeyError returns why resourceName can't be used, nil for usable scope keys and other keys.
+func scopeKeyError(resourceName string) error {
+	if !IsScopeKey(resourceName) {
+		return nil
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	err := reloadRegistry()
+	if err != nil {
+		return err
+	}
+	return checkScopeKey(resourceName, findScopeKeyById(registryKeys, strings.TrimPrefix(resourceName, ScopeKeyScheme)))
+}
+
+func checkScopeKey(resourceName string, key *ScopeKey) error {
+	switch {
+	case key == nil:
+		return fmt.Errorf("scope key %v is not in the key registry", resourceName)
+	case key.Shredded != nil:
+		return fmt.Errorf("scope key %v of gs://%v/%v was shredded %v: %w", resourceName, key.Bucket, key.Prefix, key.Shredded.Format(time.RFC3339), ErrScopeKeyShredded)
+	}
+	return nil
+}
+
+func findScopeKey(keys []*ScopeKey, bucket string, prefix string) *ScopeKey {
+	for _, key := range keys {
+		if key.Bucket == bucket && key.Prefix == prefix && key.Shredded == nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func findScopeKeyById(keys []*ScopeKey, id string) *ScopeKey {
+	for _, key := range keys {
+		if key.Id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// reloadRegistry reads the registry when the file was replaced, the caller holds registryMutex. Unwrapped
+// keysets of shredded keys are dropped.
+func reloadRegistry() error {
+	if registryPath == "" {
+		return fmt.Errorf("key registry is not configured")
+	}
+
+	info, err := os.Stat(registryPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		registryKeys = nil
+		registryInfo = nil
+		scopePrimitives = map[string]tink.AEAD{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read key registry: %w", err)
+	}
+	if registryInfo != nil && os.SameFile(info, registryInfo) && info.ModTime().Equal(registryInfo.ModTime()) && info.Size() == registryInfo.Size() {
+		return nil
+	}
+
+	keys, err := readRegistryFile()
+	if err != nil {
+		return err
+	}
+	registryKeys = keys
+	registryInfo = info
+	for id := range scopePrimitives {
+		if key := findScopeKeyById(keys, id); key == nil || key.Shredded != nil {
+			delete(scopePrimitives, id)
+		}
+	}
+	return nil
+}
+
+func readRegistryFile() ([]*ScopeKey, error) {
+	data, err := os.ReadFile(registryPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key registry: %w", err)
+	}
+	var registry keyRegistryFile
+	err = json.Unmarshal(data, &registry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key registry %v: %w", registryPath, err)
+	}
+	return registry.Keys, nil
+}
+
+// updateRegistry applies update to the registry on disk under the registry lock, and writes the registry
+// when update changed it. The file is replaced, a reader never sees a partial registry.
+func updateRegistry(update func(keys []*ScopeKey) ([]*ScopeKey, bool)) error {
+	unlock, err := lockRegistry()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	keys, err := readRegistryFile()
+	if err != nil {
+		return err
+	}
+	keys, changed := update(keys)
+	if !changed {
+		return nil
+	}
+	err = writeRegistryFile(keys)
+	if err != nil {
+		return err
+	}
+	registryInfo = nil
+	return reloadRegistry()
+}
+
+func writeRegistryFile(keys []*ScopeKey) error {
+	data, err := json.MarshalIndent(keyRegistryFile{Keys: keys}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(registryPath), filepath.Base(registryPath)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write key registry: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), registryPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write key registry: %w", err)
+	}
+	return nil
+}
+
+func lockRegistry() (func(), error) {
+	lockPath := registryPath + ".lock"
+	deadline := time.Now().Add(staleRegistryLock)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to lock key registry: %w", err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleRegistryLock {
+			log.Warnf("removing stale key registry lock %v", lockPath)
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for key registry lock %v", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
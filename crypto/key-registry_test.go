@@ -0,0 +1,68 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestShredScopeKeys(t *testing.T) {
+	startTestVault(t, VaultConfig{Token: "static"})
+	ConfigureKeyRegistry(filepath.Join(t.TempDir(), "keys.json"))
+	defer ConfigureKeyRegistry("")
+	ctx := context.Background()
+
+	scopes := []string{"tenants/acme/", "tenants/acme2/", "tenants/other/"}
+	keys := map[string]string{}
+	ciphertexts := map[string][]byte{}
+	for _, prefix := range scopes {
+		key, err := GetScopeKey(ctx, "bkt", prefix, testVaultKey)
+		if err != nil {
+			t.Fatalf("GetScopeKey(%v) error = %v", prefix, err)
+		}
+		if again, _ := GetScopeKey(ctx, "bkt", prefix, testVaultKey); again != key {
+			t.Errorf("GetScopeKey(%v) = %v then %v, want the registered key", prefix, key, again)
+		}
+		keys[prefix] = key
+		ciphertexts[prefix], err = EncryptBytes(ctx, key, []byte(prefix))
+		if err != nil {
+			t.Fatalf("EncryptBytes() with %v error = %v", key, err)
+		}
+	}
+
+	shredded, err := ShredScopeKeys("bkt", "tenants/acme/")
+	if err != nil || len(shredded) != 1 || shredded[0].Prefix != "tenants/acme/" || shredded[0].Keyset != "" {
+		t.Fatalf("ShredScopeKeys() = %+v, %v, want the key of tenants/acme/ without its keyset", shredded, err)
+	}
+
+	for _, prefix := range scopes {
+		plaintext, err := DecryptBytes(ctx, keys[prefix], ciphertexts[prefix])
+		if prefix == "tenants/acme/" {
+			if !errors.Is(err, ErrScopeKeyShredded) || !IsScopeKeyShredded(keys[prefix]) {
+				t.Errorf("DecryptBytes() of a shredded scope error = %v, want %v", err, ErrScopeKeyShredded)
+			}
+			continue
+		}
+		if err != nil || string(plaintext) != prefix || IsScopeKeyShredded(keys[prefix]) {
+			t.Errorf("DecryptBytes() of %v = %q, %v, want the plaintext", prefix, plaintext, err)
+		}
+	}
+
+	// the shredded scope gets a new key, shredding it again returns the old key as well
+	newKey, err := GetScopeKey(ctx, "bkt", "tenants/acme/", testVaultKey)
+	if err != nil || newKey == keys["tenants/acme/"] {
+		t.Errorf("GetScopeKey() of a shredded scope = %v, %v, want a new key", newKey, err)
+	}
+	if shredded, err := ShredScopeKeys("bkt", "tenants/acme/"); err != nil || len(shredded) != 2 {
+		t.Errorf("ShredScopeKeys() again = %v keys, %v, want 2", len(shredded), err)
+	}
+	if _, err := ShredScopeKeys("bkt", "unknown/"); err == nil {
+		t.Errorf("ShredScopeKeys() of a scope without keys succeeded")
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Keyring is how objects are decrypted when the key in their x-encryption-key metadata was renamed,
+// moved or is missing. Writes always use the key of the bucket key mapping.
+type Keyring struct {
+	Aliases     map[string]string // stored key to the key it is decrypted with
+	DecryptKeys []string          // decrypt-only keys tried in order after the stored key
+	NegativeTTL time.Duration     // how long a key that can't unwrap a DEK is not tried for it again
+}
+
+// maximum number of negative cache entries, expired entries are dropped when it is reached
+const maxNegativeEntries = 10000
+
+var (
+	keyring Keyring
+
+	negativeMutex sync.Mutex
+	negativeCache = map[string]time.Time{} // by hash of the key and wrapped DEK, to the expiry
+
+	DecryptKeyFallbacks metric.Int64Counter
+)
+
+// ConfigureKeyring sets the aliases and decrypt-only keys, objects are only decrypted with their stored key
+// until it is configured.
+func ConfigureKeyring(k Keyring) {
+	keyring = k
+	negativeMutex.Lock()
+	negativeCache = map[string]time.Time{}
+	negativeMutex.Unlock()
+}
+
+// decryptKeyCandidates returns the keys to decrypt an object stored with resourceName with, in order.
+func decryptKeyCandidates(resourceName string) []string {
+	candidates := []string{}
+	seen := map[string]bool{"": true}
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			candidates = append(candidates, key)
+		}
+	}
+
+	if alias, ok := keyring.Aliases[resourceName]; ok {
+		add(alias)
+	}
+	add(resourceName)
+	for _, key := range keyring.DecryptKeys {
+		add(key)
+	}
+	return candidates
+}
+
+// decryptWithKeyring tries the candidate keys of resourceName in order. Keys that fail with a permanent
+// error, e.g. permission denied or a DEK wrapped by another key, are skipped for the wrapped DEK until
+// the negative cache entry expires. Transient errors are not cached.
+func decryptWithKeyring(ctx context.Context, resourceName string, candidates []string, bytesToDecrypt []byte) ([]byte, error) {
+	wrappedDEK, _, err := splitEnvelope(bytesToDecrypt)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+	return tryKeyring(ctx, resourceName, candidates, wrappedDEK, func(key string) ([]byte, error) {
+		return decryptBytesWithKey(ctx, key, bytesToDecrypt)
+	})
+}
+
+// tryKeyring calls decrypt with the candidate keys of the wrapped DEK until one succeeds.
+func tryKeyring(ctx context.Context, resourceName string, candidates []string, wrappedDEK []byte, decrypt func(key string) ([]byte, error)) ([]byte, error) {
+	var errs []error
+	for _, key := range candidates {
+		hash := wrappedDEKHash(key, wrappedDEK)
+		if isNegativeCached(hash) {
+			continue
+		}
+
+		decryptedBytes, err := decrypt(key)
+		if err == nil {
+			if key != resourceName {
+				log.Infof("decrypted object stored with key '%v' with keyring key '%v'", resourceName, key)
+				if DecryptKeyFallbacks != nil {
+					DecryptKeyFallbacks.Add(ctx, 1, metric.WithAttributes(attribute.String("key", key)))
+				}
+			}
+			return decryptedBytes, nil
+		}
+
+		log.Debugf("keyring key '%v' failed to decrypt object stored with key '%v': %v", key, resourceName, err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		if !isRetryableKmsError(err) && !errors.Is(err, ErrKmsCircuitOpen) {
+			storeNegative(hash)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("error decrypting data: no keyring key can decrypt the object stored with key '%v'", resourceName)
+	}
+	// the error of the first key is the one to report, it is the stored key or its alias
+	return nil, errs[0]
+}
+
+func isNegativeCached(hash string) bool {
+	negativeMutex.Lock()
+	defer negativeMutex.Unlock()
+	expiry, ok := negativeCache[hash]
+	if ok && time.Now().After(expiry) {
+		delete(negativeCache, hash)
+		return false
+	}
+	return ok
+}
+
+func storeNegative(hash string) {
+	if keyring.NegativeTTL <= 0 {
+		return
+	}
+
+	negativeMutex.Lock()
+	defer negativeMutex.Unlock()
+	if len(negativeCache) >= maxNegativeEntries {
+		now := time.Now()
+		for key, expiry := range negativeCache {
+			if now.After(expiry) {
+				delete(negativeCache, key)
+			}
+		}
+		if len(negativeCache) >= maxNegativeEntries {
+			return
+		}
+	}
+	negativeCache[hash] = time.Now().Add(keyring.NegativeTTL)
+}
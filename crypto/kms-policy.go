@@ -0,0 +1,314 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/tink/go/tink"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// KmsPolicy bounds every KMS call: a timeout per attempt, retries with exponential backoff and jitter
+// on transient errors, and a circuit breaker per key that fails fast while KMS is unavailable.
+type KmsPolicy struct {
+	Timeout          time.Duration // per attempt, 0 for no timeout
+	MaxAttempts      int
+	InitialBackoff   time.Duration
+	MaxBackoff       time.Duration
+	BreakerThreshold int // consecutive failed calls that open the breaker, 0 disables it
+	BreakerCooldown  time.Duration
+}
+
+// ErrKmsCircuitOpen is returned without calling KMS while the circuit breaker of a key is open.
+var ErrKmsCircuitOpen = errors.New("circuit breaker open")
+
+// KmsError is the error of a call to KMS or Vault, so it isn't mistaken for an error of GCS.
+type KmsError struct {
+	Key       string
+	Operation string
+	Err       error
+}
+
+func (e *KmsError) Error() string {
+	return fmt.Sprintf("KMS %v with %v: %v", e.Operation, e.Key, e.Err)
+}
+
+func (e *KmsError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var (
+	kmsPolicy = KmsPolicy{MaxAttempts: 1}
+
+	breakersMutex sync.Mutex
+	breakers      = map[string]*circuitBreaker{} // by KMS key
+
+	KmsRetries            metric.Int64Counter
+	KmsTimeouts           metric.Int64Counter
+	KmsRejected           metric.Int64Counter
+	KmsBreakerTransitions metric.Int64Counter
+)
+
+type circuitBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open breaker lets a single call through
+}
+
+// ConfigureKmsPolicy sets the policy of all KMS calls, a single attempt without timeout until it is configured.
+func ConfigureKmsPolicy(policy KmsPolicy) {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	kmsPolicy = policy
+}
+
+// GetKmsBreakerStates returns the breaker state of every key KMS was called with, e.g. to report them as metrics.
+func GetKmsBreakerStates() map[string]string {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	states := make(map[string]string, len(breakers))
+	for resourceName, breaker := range breakers {
+		states[resourceName] = breaker.state
+	}
+	return states
+}
+
+// remoteAEAD is the AEAD of a Cloud KMS or Vault key, its calls are cancelled with their context.
+type remoteAEAD interface {
+	Encrypt(ctx context.Context, plaintext, associatedData []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error)
+}
+
+// policyAEAD applies the KMS policy to the AEAD of a KMS key. tink doesn't pass a context to the
+// AEAD, so it carries the context of the request and every attempt gets its timeout from it.
+type policyAEAD struct {
+	ctx          context.Context
+	resourceName string
+	remote       remoteAEAD
+}
+
+var _ tink.AEAD = (*policyAEAD)(nil)
+
+func (a *policyAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return callKms(a.ctx, a.resourceName, "encrypt", func(ctx context.Context) ([]byte, error) {
+		return a.remote.Encrypt(ctx, plaintext, associatedData)
+	})
+}
+
+func (a *policyAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	return callKms(a.ctx, a.resourceName, "decrypt", func(ctx context.Context) ([]byte, error) {
+		return a.remote.Decrypt(ctx, ciphertext, associatedData)
+	})
+}
+
+func callKms(ctx context.Context, resourceName string, operation string, call func(ctx context.Context) ([]byte, error)) (result []byte, err error) {
+	ctx, span := Tracer.Start(ctx, "kms."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("key", resourceName)))
+	defer func() { EndSpan(span, err) }()
+
+	// the latency the request sees, including retries and backoff
+	defer recordLatency(ctx, KmsTime, time.Now(), attribute.String("call", operation))
+
+	if !allowKmsCall(resourceName) {
+		recordKmsMetric(ctx, KmsRejected, operation)
+		return nil, &KmsError{Key: resourceName, Operation: operation, Err: ErrKmsCircuitOpen}
+	}
+
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("attempts", attempt))
+		result, err = callKmsWithTimeout(ctx, call)
+		if err == nil || attempt >= kmsPolicy.MaxAttempts || ctx.Err() != nil || !isRetryableKmsError(err) {
+			break
+		}
+
+		backoff := kmsBackoff(attempt)
+		log.Warnf("KMS %v with %v failed on attempt %v, retrying in %v: %v", operation, resourceName, attempt, backoff, err)
+		recordKmsMetric(ctx, KmsRetries, operation)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil && err != nil:
+		// the request went away, that says nothing about KMS
+		releaseKmsProbe(resourceName)
+		return nil, &KmsError{Key: resourceName, Operation: operation, Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		recordKmsMetric(ctx, KmsTimeouts, operation)
+	}
+	// permission and not found errors say nothing about the availability of KMS either
+	recordKmsResult(ctx, resourceName, err == nil || !isRetryableKmsError(err))
+	if err != nil {
+		return nil, &KmsError{Key: resourceName, Operation: operation, Err: err}
+	}
+	return result, nil
+}
+
+// callKmsWithTimeout cancels an attempt that outlives its timeout. gRPC reports a cancelled call with its
+// own status, so the error of a cancelled call wraps the error of the context.
+func callKmsWithTimeout(ctx context.Context, call func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if kmsPolicy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, kmsPolicy.Timeout)
+		defer cancel()
+	}
+
+	result, err := call(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("KMS call cancelled: %w (%v)", ctx.Err(), err)
+	}
+	return result, err
+}
+
+// kmsBackoff returns a random delay up to the exponential backoff of attempt ("full jitter")
+func kmsBackoff(attempt int) time.Duration {
+	backoff := kmsPolicy.InitialBackoff << (attempt - 1)
+	if backoff <= 0 || (kmsPolicy.MaxBackoff > 0 && backoff > kmsPolicy.MaxBackoff) {
+		backoff = kmsPolicy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+func isRetryableKmsError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var vaultErr *VaultError
+	if errors.As(err, &vaultErr) {
+		return vaultErr.Code == http.StatusTooManyRequests || vaultErr.Code >= 500
+	}
+
+	if grpcStatus, ok := status.FromError(err); ok {
+		switch grpcStatus.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+			return true
+		}
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// allowKmsCall reports if the breaker of resourceName lets a call through. An open breaker turns
+// half-open after the cooldown and lets one probe through, its result closes or opens it again.
+func allowKmsCall(resourceName string) bool {
+	if kmsPolicy.BreakerThreshold <= 0 {
+		return true
+	}
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker, ok := breakers[resourceName]
+	if !ok {
+		breaker = &circuitBreaker{state: breakerClosed}
+		breakers[resourceName] = breaker
+	}
+
+	switch breaker.state {
+	case breakerOpen:
+		if time.Since(breaker.openedAt) < kmsPolicy.BreakerCooldown {
+			return false
+		}
+		breaker.setState(resourceName, breakerHalfOpen)
+		breaker.probing = true
+		return true
+	case breakerHalfOpen:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+		return true
+	}
+	return true
+}
+
+func recordKmsResult(ctx context.Context, resourceName string, available bool) {
+	if kmsPolicy.BreakerThreshold <= 0 {
+		return
+	}
+
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker, ok := breakers[resourceName]
+	if !ok {
+		return
+	}
+	breaker.probing = false
+
+	if available {
+		breaker.failures = 0
+		if breaker.state != breakerClosed {
+			breaker.setState(resourceName, breakerClosed)
+			recordBreakerTransition(ctx, resourceName, breakerClosed)
+		}
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == breakerHalfOpen || breaker.failures >= kmsPolicy.BreakerThreshold {
+		if breaker.state != breakerOpen {
+			recordBreakerTransition(ctx, resourceName, breakerOpen)
+		}
+		breaker.setState(resourceName, breakerOpen)
+		breaker.openedAt = time.Now()
+	}
+}
+
+func releaseKmsProbe(resourceName string) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	if breaker, ok := breakers[resourceName]; ok {
+		breaker.probing = false
+	}
+}
+
+func (b *circuitBreaker) setState(resourceName string, state string) {
+	if b.state != state {
+		log.Warnf("KMS circuit breaker of %v is %v after %v failed calls", resourceName, state, b.failures)
+	}
+	b.state = state
+}
+
+func recordKmsMetric(ctx context.Context, counter metric.Int64Counter, operation string) {
+	if counter != nil {
+		counter.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", operation)))
+	}
+}
+
+func recordBreakerTransition(ctx context.Context, resourceName string, state string) {
+	if KmsBreakerTransitions != nil {
+		KmsBreakerTransitions.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("key", resourceName),
+			attribute.String("state", state)))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRemoteAEAD fails the first len(errs) calls with errs, then returns the plaintext. A nil error blocks
+// the call until its context is done.
+type fakeRemoteAEAD struct {
+	errs  []error
+	calls int
+}
+
+func (a *fakeRemoteAEAD) call(ctx context.Context, data []byte) ([]byte, error) {
+	a.calls++
+	if a.calls > len(a.errs) {
+		return data, nil
+	}
+	if err := a.errs[a.calls-1]; err != nil {
+		return nil, err
+	}
+	<-ctx.Done()
+	return nil, status.Error(codes.Canceled, "context canceled")
+}
+
+func (a *fakeRemoteAEAD) Encrypt(ctx context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	return a.call(ctx, plaintext)
+}
+
+func (a *fakeRemoteAEAD) Decrypt(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	return a.call(ctx, ciphertext)
+}
+
+func TestCallKmsRetries(t *testing.T) {
+	ConfigureKmsPolicy(KmsPolicy{Timeout: 20 * time.Millisecond, MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	defer ConfigureKmsPolicy(KmsPolicy{})
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	denied := status.Error(codes.PermissionDenied, "denied")
+
+	tests := []struct {
+		name     string
+		errs     []error
+		calls    int
+		wantErr  error
+		deadline bool
+	}{
+		{name: "success", calls: 1},
+		{name: "transient error is retried", errs: []error{unavailable, unavailable}, calls: 3},
+		{name: "attempts are bounded", errs: []error{unavailable, unavailable, unavailable}, calls: 3, wantErr: unavailable},
+		{name: "permission denied is not retried", errs: []error{denied}, calls: 1, wantErr: denied},
+		{name: "timeout is retried", errs: []error{nil}, calls: 2},
+		{name: "timeout cancels the call", errs: []error{nil, nil, nil}, calls: 3, deadline: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := &fakeRemoteAEAD{errs: test.errs}
+			aead := &policyAEAD{ctx: context.Background(), resourceName: test.name, remote: remote}
+
+			result, err := aead.Encrypt([]byte("dek"), nil)
+			if remote.calls != test.calls {
+				t.Errorf("KMS was called %v times, want %v", remote.calls, test.calls)
+			}
+			switch {
+			case test.deadline:
+				var kmsErr *KmsError
+				if !errors.As(err, &kmsErr) || !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("Encrypt() error = %v, want a KmsError of the deadline", err)
+				}
+			case test.wantErr != nil:
+				if status.Code(errors.Unwrap(err)) != status.Code(test.wantErr) {
+					t.Errorf("Encrypt() error = %v, want %v", err, test.wantErr)
+				}
+			case err != nil || string(result) != "dek":
+				t.Errorf("Encrypt() = %q, %v, want dek", result, err)
+			}
+		})
+	}
+}
+
+func TestCallKmsCircuitBreaker(t *testing.T) {
+	ConfigureKmsPolicy(KmsPolicy{MaxAttempts: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	defer ConfigureKmsPolicy(KmsPolicy{})
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	remote := &fakeRemoteAEAD{errs: []error{unavailable, unavailable, unavailable}}
+	aead := &policyAEAD{ctx: context.Background(), resourceName: "breaker", remote: remote}
+
+	for i := 0; i < 2; i++ {
+		if _, err := aead.Decrypt([]byte("dek"), nil); err == nil {
+			t.Fatalf("Decrypt() %v succeeded", i)
+		}
+	}
+	if _, err := aead.Decrypt([]byte("dek"), nil); !errors.Is(err, ErrKmsCircuitOpen) || remote.calls != 2 {
+		t.Fatalf("Decrypt() of an open breaker error = %v after %v calls, want %v without a call", err, remote.calls, ErrKmsCircuitOpen)
+	}
+	if GetKmsBreakerStates()["breaker"] != breakerOpen {
+		t.Errorf("breaker state = %v, want %v", GetKmsBreakerStates()["breaker"], breakerOpen)
+	}
+
+	// a failed probe opens the breaker again, a successful one closes it
+	time.Sleep(60 * time.Millisecond)
+	if _, err := aead.Decrypt([]byte("dek"), nil); err == nil || errors.Is(err, ErrKmsCircuitOpen) {
+		t.Fatalf("Decrypt() of the probe error = %v, want the KMS error", err)
+	}
+	if GetKmsBreakerStates()["breaker"] != breakerOpen {
+		t.Errorf("breaker state after a failed probe = %v, want %v", GetKmsBreakerStates()["breaker"], breakerOpen)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := aead.Decrypt([]byte("dek"), nil); err != nil {
+		t.Fatalf("Decrypt() of the probe error = %v", err)
+	}
+	if GetKmsBreakerStates()["breaker"] != breakerClosed {
+		t.Errorf("breaker state after a successful probe = %v, want %v", GetKmsBreakerStates()["breaker"], breakerClosed)
+	}
+}
+
+func TestCallKmsCancelledRequest(t *testing.T) {
+	ConfigureKmsPolicy(KmsPolicy{MaxAttempts: 3, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	defer ConfigureKmsPolicy(KmsPolicy{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	remote := &fakeRemoteAEAD{errs: []error{nil}}
+	aead := &policyAEAD{ctx: ctx, resourceName: "cancelled", remote: remote}
+
+	// the request went away, KMS is not to blame
+	if _, err := aead.Encrypt([]byte("dek"), nil); err == nil || remote.calls != 1 {
+		t.Fatalf("Encrypt() error = %v after %v calls, want an error after 1 call", err, remote.calls)
+	}
+	if state := GetKmsBreakerStates()["cancelled"]; state != breakerClosed {
+		t.Errorf("breaker state = %v, want %v", state, breakerClosed)
+	}
+}
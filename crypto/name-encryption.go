@@ -0,0 +1,87 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/google/tink/go/daead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	log "github.com/sirupsen/logrus"
+)
+
+// object names are encrypted deterministically so the same name always maps to the same stored name,
+// the AES-SIV keyset is stored in a file encrypted with a KMS key.
+var nameEncryption tink.DeterministicAEAD
+
+// GenerateNameKeyset writes a new AES-SIV keyset to keysetPath, encrypted with the KMS key resourceName.
+// An existing keyset is never overwritten, the names of objects written with it could not be decrypted.
+func GenerateNameKeyset(ctx context.Context, keysetPath string, resourceName string) error {
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
+	if err != nil {
+		return err
+	}
+
+	handle, err := keyset.NewHandle(daead.AESSIVKeyTemplate())
+	if err != nil {
+		return fmt.Errorf("failed to generate name keyset: %w", err)
+	}
+
+	file, err := os.OpenFile(keysetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create name keyset file: %w", err)
+	}
+	defer file.Close()
+
+	err = handle.Write(keyset.NewJSONWriter(file), kmsAEAD)
+	if err != nil {
+		return fmt.Errorf("failed to write name keyset: %w", err)
+	}
+	log.Infof("wrote name keyset to %v encrypted with %v", keysetPath, resourceName)
+	return nil
+}
+
+// LoadNameKeyset reads the AES-SIV keyset used for object names.
+func LoadNameKeyset(ctx context.Context, keysetPath string, resourceName string) error {
+	kmsAEAD, err := getKmsAEAD(ctx, resourceName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(keysetPath)
+	if err != nil {
+		return fmt.Errorf("failed to open name keyset file: %w", err)
+	}
+	defer file.Close()
+
+	handle, err := keyset.Read(keyset.NewJSONReader(file), kmsAEAD)
+	if err != nil {
+		return fmt.Errorf("failed to read name keyset: %w", err)
+	}
+
+	nameEncryption, err = daead.New(handle)
+	if err != nil {
+		return fmt.Errorf("failed to create name encryption primitive: %w", err)
+	}
+	return nil
+}
+
+func EncryptName(plaintext []byte, associatedData []byte) ([]byte, error) {
+	if nameEncryption == nil {
+		return nil, fmt.Errorf("name keyset is not loaded")
+	}
+	return nameEncryption.EncryptDeterministically(plaintext, associatedData)
+}
+
+func DecryptName(ciphertext []byte, associatedData []byte) ([]byte, error) {
+	if nameEncryption == nil {
+		return nil, fmt.Errorf("name keyset is not loaded")
+	}
+	return nameEncryption.DecryptDeterministically(ciphertext, associatedData)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/tink/go/daead"
+	"github.com/google/tink/go/keyset"
+)
+
+func TestEncryptName(t *testing.T) {
+	if _, err := EncryptName([]byte("dir"), []byte("bkt")); err == nil {
+		t.Errorf("EncryptName() without a keyset succeeded")
+	}
+
+	handle, err := keyset.NewHandle(daead.AESSIVKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameEncryption, err = daead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { nameEncryption = nil }()
+
+	ciphertext, err := EncryptName([]byte("dir"), []byte("bkt"))
+	if err != nil {
+		t.Fatalf("EncryptName() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		plaintext      string
+		associatedData string
+		same           bool
+	}{
+		{"same name", "dir", "bkt", true},
+		{"other name", "dir2", "bkt", false},
+		{"other associated data", "dir", "other", false},
+	}
+	for _, test := range tests {
+		again, err := EncryptName([]byte(test.plaintext), []byte(test.associatedData))
+		if err != nil || bytes.Equal(again, ciphertext) != test.same {
+			t.Errorf("%v: EncryptName() = %x, %v, want the same ciphertext %v", test.name, again, err, test.same)
+		}
+	}
+
+	plaintext, err := DecryptName(ciphertext, []byte("bkt"))
+	if err != nil || string(plaintext) != "dir" {
+		t.Errorf("DecryptName() = %q, %v, want dir", plaintext, err)
+	}
+	if _, err := DecryptName(ciphertext, []byte("other")); err == nil {
+		t.Errorf("DecryptName() with other associated data succeeded")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
+	"github.com/google/tink/go/tink"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ResourceEnvelope encrypts the small values of one object resource, e.g. its custom metadata and hashes,
+// with a single DEK so KMS wraps or unwraps one DEK per resource instead of one per value. Every value
+// carries the wrapped DEK in the envelope format, a patch that replaces some values of a resource leaves
+// the others decryptable. A ResourceEnvelope is used by one request and is not safe for concurrent use.
+type ResourceEnvelope struct {
+	ctx          context.Context
+	resourceName string
+	encryptDEK   *cachedDEK
+	decryptDEKs  map[string]tink.AEAD // by wrapped DEK
+}
+
+// NewResourceEnvelope returns an envelope for the key resourceName, KMS is called on first use.
+func NewResourceEnvelope(ctx context.Context, resourceName string) *ResourceEnvelope {
+	return &ResourceEnvelope{ctx: ctx, resourceName: resourceName, decryptDEKs: map[string]tink.AEAD{}}
+}
+
+// Encrypt encrypts plaintext bound to associatedData, it only decrypts with the same associated data.
+func (e *ResourceEnvelope) Encrypt(plaintext []byte, associatedData []byte) ([]byte, error) {
+	if e.encryptDEK == nil {
+		dek, err := e.wrapDEK()
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting data: %w", err)
+		}
+		e.encryptDEK = dek
+	}
+
+	payload, err := e.encryptDEK.primitive.Encrypt(plaintext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting data: %w", err)
+	}
+	return joinEnvelope(e.encryptDEK.wrappedDEK, payload), nil
+}
+
+// Decrypt decrypts a value encrypted by Encrypt, the DEK of each resource is unwrapped once.
+func (e *ResourceEnvelope) Decrypt(ciphertext []byte, associatedData []byte) ([]byte, error) {
+	wrappedDEK, payload, err := splitEnvelope(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+
+	primitive, ok := e.decryptDEKs[string(wrappedDEK)]
+	if !ok {
+		primitive, err = e.unwrapDEK(wrappedDEK)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting data: %w", err)
+		}
+		e.decryptDEKs[string(wrappedDEK)] = primitive
+	}
+
+	decryptedBytes, err := primitive.Decrypt(payload, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+	return decryptedBytes, nil
+}
+
+// wrapDEK is the use of the key that is audited for all values the envelope encrypts.
+func (e *ResourceEnvelope) wrapDEK() (dek *cachedDEK, err error) {
+	ctx, span := Tracer.Start(e.ctx, "encrypt", trace.WithAttributes(attribute.String("key", e.resourceName)))
+	latencyStart := time.Now()
+	defer func() {
+		if auditErr := audit.RecordKeyUse(ctx, "encrypt", e.resourceName, err); auditErr != nil && err == nil {
+			dek, err = nil, auditErr
+		}
+		EndSpan(span, err)
+	}()
+
+	if err := scopeKeyError(e.resourceName); err != nil {
+		return nil, err
+	}
+	dek, err = newCachedDEK(ctx, e.resourceName)
+	if err != nil {
+		return nil, err
+	}
+	recordLatency(ctx, EncryptTime, latencyStart)
+	return dek, nil
+}
+
+// unwrapDEK tries the keyring like DecryptBytes, it is the use of the key that is audited for all values
+// of the resource encrypted with the DEK.
+func (e *ResourceEnvelope) unwrapDEK(wrappedDEK []byte) (primitive tink.AEAD, err error) {
+	ctx, span := Tracer.Start(e.ctx, "decrypt", trace.WithAttributes(attribute.String("key", e.resourceName)))
+	latencyStart := time.Now()
+	defer func() {
+		if auditErr := audit.RecordKeyUse(ctx, "decrypt", e.resourceName, err); auditErr != nil && err == nil {
+			primitive, err = nil, auditErr
+		}
+		EndSpan(span, err)
+	}()
+
+	candidates := decryptKeyCandidates(e.resourceName)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("the x-encryption-key metadata is missing and no decrypt keys are configured")
+	}
+	_, err = tryKeyring(ctx, e.resourceName, candidates, wrappedDEK, func(key string) ([]byte, error) {
+		if err := scopeKeyError(key); err != nil {
+			return nil, err
+		}
+		// a listing unwraps the DEK of every object, objects written with a cached DEK share it
+		primitive, err = unwrapCachedDEK(ctx, key, wrappedDEK)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordLatency(ctx, DecryptTime, latencyStart)
+	return primitive, nil
+}
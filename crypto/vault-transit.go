@@ -0,0 +1,240 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VaultTransitScheme prefixes keys of the Vault Transit secrets engine in the bucket key mapping and the
+// x-encryption-key metadata: vault-transit://<mount>/<key>, e.g. vault-transit://transit/gcs-proxy.
+const VaultTransitScheme = "vault-transit://"
+
+// VaultConfig is how the proxy reaches and authenticates to Vault. A token is used as is, without a
+// token the proxy logs in with AppRole and logs in again when the token expires.
+type VaultConfig struct {
+	Addr         string
+	Namespace    string
+	Token        string
+	RoleID       string
+	SecretID     string
+	AppRoleMount string
+}
+
+// VaultError is an error response of the Vault API.
+type VaultError struct {
+	Code   int
+	Errors []string
+}
+
+func (e *VaultError) Error() string {
+	return fmt.Sprintf("vault returned %v: %v", e.Code, strings.Join(e.Errors, ", "))
+}
+
+var vault = &vaultClient{httpClient: &http.Client{}}
+
+type vaultClient struct {
+	httpClient *http.Client
+
+	mutex       sync.Mutex
+	config      VaultConfig
+	token       string
+	tokenExpiry time.Time // zero for tokens that don't expire
+}
+
+// ConfigureVault sets the Vault server used by vault-transit:// keys.
+func ConfigureVault(config VaultConfig) {
+	vault.mutex.Lock()
+	defer vault.mutex.Unlock()
+	if config.AppRoleMount == "" {
+		config.AppRoleMount = "approle"
+	}
+	vault.config = config
+	vault.token = config.Token
+	vault.tokenExpiry = time.Time{}
+}
+
+// vaultTransitAEAD wraps and unwraps DEKs with the encrypt and decrypt endpoints of Vault Transit. The
+// ciphertext is the vault:v1:... string Vault returns, the key version is part of it.
+type vaultTransitAEAD struct {
+	mount   string
+	keyName string
+}
+
+func newVaultTransitAEAD(keyURI string) (*vaultTransitAEAD, error) {
+	path := strings.Trim(strings.TrimPrefix(keyURI, VaultTransitScheme), "/")
+	lastSlash := strings.LastIndex(path, "/")
+	if lastSlash <= 0 || lastSlash == len(path)-1 {
+		return nil, fmt.Errorf("invalid vault transit key '%v', expected %v<mount>/<key>", keyURI, VaultTransitScheme)
+	}
+	return &vaultTransitAEAD{mount: path[:lastSlash], keyName: path[lastSlash+1:]}, nil
+}
+
+// Transit has no associated data for keys that are not derived, tink only wraps DEKs and keysets without it.
+func (a *vaultTransitAEAD) Encrypt(ctx context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) > 0 {
+		return nil, fmt.Errorf("vault transit does not support associated data")
+	}
+
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := vault.call(ctx, fmt.Sprintf("/v1/%v/encrypt/%v", a.mount, a.keyName), map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(response.Data.Ciphertext), nil
+}
+
+func (a *vaultTransitAEAD) Decrypt(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) > 0 {
+		return nil, fmt.Errorf("vault transit does not support associated data")
+	}
+
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err := vault.call(ctx, fmt.Sprintf("/v1/%v/decrypt/%v", a.mount, a.keyName), map[string]string{
+		"ciphertext": string(ciphertext),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Data.Plaintext)
+}
+
+// call posts request to a Vault endpoint. A token that was revoked or expired early is renewed once
+// with AppRole.
+func (c *vaultClient) call(ctx context.Context, path string, request interface{}, response interface{}) error {
+	token, err := c.getToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.post(ctx, path, token, request, response)
+	if vaultErr, ok := err.(*VaultError); ok && vaultErr.Code == http.StatusForbidden && c.canLogin() {
+		c.resetToken(token)
+		token, err = c.getToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.post(ctx, path, token, request, response)
+	}
+	return err
+}
+
+func (c *vaultClient) canLogin() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.config.Token == "" && c.config.RoleID != ""
+}
+
+func (c *vaultClient) getToken(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.config.Addr == "" {
+		return "", fmt.Errorf("vault address is not configured")
+	}
+	if c.token != "" && (c.tokenExpiry.IsZero() || time.Now().Before(c.tokenExpiry)) {
+		return c.token, nil
+	}
+	if c.config.RoleID == "" {
+		return "", fmt.Errorf("vault token or AppRole role id is not configured")
+	}
+
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	err := c.post(ctx, fmt.Sprintf("/v1/auth/%v/login", c.config.AppRoleMount), "", map[string]string{
+		"role_id":   c.config.RoleID,
+		"secret_id": c.config.SecretID,
+	}, &response)
+	if err != nil {
+		return "", fmt.Errorf("vault AppRole login failed: %w", err)
+	}
+
+	c.token = response.Auth.ClientToken
+	c.tokenExpiry = time.Time{}
+	if response.Auth.LeaseDuration > 0 {
+		// log in again before the token expires rather than fail a request with it
+		lease := time.Duration(response.Auth.LeaseDuration) * time.Second
+		c.tokenExpiry = time.Now().Add(lease - lease/10)
+	}
+	log.Debugf("logged in to vault with AppRole, token expires %v", c.tokenExpiry)
+	return c.token, nil
+}
+
+func (c *vaultClient) resetToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+func (c *vaultClient) post(ctx context.Context, path string, token string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	// the config only changes at startup, the caller may hold the mutex for an AppRole login
+	addr := strings.TrimSuffix(c.config.Addr, "/")
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpRequest.Header.Set("X-Vault-Token", token)
+	}
+	if c.config.Namespace != "" {
+		httpRequest.Header.Set("X-Vault-Namespace", c.config.Namespace)
+	}
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		vaultErr := &VaultError{Code: httpResponse.StatusCode}
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(responseBody, &errorResponse) == nil {
+			vaultErr.Errors = errorResponse.Errors
+		}
+		return vaultErr
+	}
+	return json.Unmarshal(responseBody, response)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testVaultKey = VaultTransitScheme + "transit/k"
+
+// testVault serves AppRole logins and the Transit encrypt and decrypt endpoints. Its "ciphertext" is the
+// plaintext behind the vault prefix, only the current token is accepted.
+type testVault struct {
+	mutex    sync.Mutex
+	token    string
+	logins   int
+	encrypts int
+	decrypts int
+}
+
+func startTestVault(t *testing.T, config VaultConfig) *testVault {
+	t.Helper()
+	v := &testVault{token: config.Token}
+	server := httptest.NewServer(http.HandlerFunc(v.serve))
+	t.Cleanup(server.Close)
+	config.Addr = server.URL
+	ConfigureVault(config)
+	return v
+}
+
+func (v *testVault) serve(w http.ResponseWriter, r *http.Request) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"errors":["invalid request"]}`, http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		if request["role_id"] != "role" || request["secret_id"] != "secret" {
+			http.Error(w, `{"errors":["invalid role or secret id"]}`, http.StatusBadRequest)
+			return
+		}
+		v.logins++
+		v.token = fmt.Sprintf("token-%v", v.logins)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": v.token, "lease_duration": 3600},
+		})
+		return
+	}
+
+	if v.token == "" || r.Header.Get("X-Vault-Token") != v.token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	data := map[string]string{}
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/k":
+		v.encrypts++
+		data["ciphertext"] = "vault:v1:" + request["plaintext"]
+	case "/v1/transit/decrypt/k":
+		v.decrypts++
+		data["plaintext"] = strings.TrimPrefix(request["ciphertext"], "vault:v1:")
+	default:
+		http.Error(w, `{"errors":["unknown path"]}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// revoke invalidates the current token, e.g. an AppRole token revoked before its lease ended
+func (v *testVault) revoke() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.token = "revoked"
+}
+
+func (v *testVault) counts() (logins int, encrypts int, decrypts int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.logins, v.encrypts, v.decrypts
+}
+
+func TestVaultTransitRoundTrip(t *testing.T) {
+	startTestVault(t, VaultConfig{Token: "static"})
+	ctx := context.Background()
+
+	ciphertext, err := EncryptBytes(ctx, testVaultKey, []byte("plaintext"))
+	if err != nil {
+		t.Fatalf("EncryptBytes() error = %v", err)
+	}
+	plaintext, err := DecryptBytes(ctx, testVaultKey, ciphertext)
+	if err != nil || string(plaintext) != "plaintext" {
+		t.Fatalf("DecryptBytes() = %q, %v, want plaintext", plaintext, err)
+	}
+}
+
+func TestVaultAppRoleRenewal(t *testing.T) {
+	vault := startTestVault(t, VaultConfig{RoleID: "role", SecretID: "secret"})
+	ctx := context.Background()
+
+	ciphertext, err := EncryptBytes(ctx, testVaultKey, []byte("plaintext"))
+	if err != nil {
+		t.Fatalf("EncryptBytes() error = %v", err)
+	}
+	if logins, _, _ := vault.counts(); logins != 1 {
+		t.Errorf("logged in %v times, want 1", logins)
+	}
+
+	// a revoked token is renewed once and the call repeated
+	vault.revoke()
+	plaintext, err := DecryptBytes(ctx, testVaultKey, ciphertext)
+	if err != nil || string(plaintext) != "plaintext" {
+		t.Fatalf("DecryptBytes() with a revoked token = %q, %v, want plaintext", plaintext, err)
+	}
+	if logins, _, _ := vault.counts(); logins != 2 {
+		t.Errorf("logged in %v times, want 2", logins)
+	}
+}
+
+func TestVaultStaticTokenIsNotRenewed(t *testing.T) {
+	vault := startTestVault(t, VaultConfig{Token: "static"})
+	vault.revoke()
+
+	_, err := EncryptBytes(context.Background(), testVaultKey, []byte("plaintext"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("EncryptBytes() with a revoked static token error = %v, want a 403", err)
+	}
+	if logins, _, _ := vault.counts(); logins != 0 {
+		t.Errorf("logged in %v times with a static token", logins)
+	}
+}
+
+func TestNewVaultTransitAEAD(t *testing.T) {
+	tests := []struct {
+		keyURI  string
+		mount   string
+		keyName string
+		valid   bool
+	}{
+		{VaultTransitScheme + "transit/k", "transit", "k", true},
+		{VaultTransitScheme + "team/transit/k/", "team/transit", "k", true},
+		{VaultTransitScheme + "k", "", "", false},
+		{VaultTransitScheme + "transit/", "", "", false},
+	}
+	for _, test := range tests {
+		a, err := newVaultTransitAEAD(test.keyURI)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("newVaultTransitAEAD(%v) succeeded", test.keyURI)
+			}
+			continue
+		}
+		if err != nil || a.mount != test.mount || a.keyName != test.keyName {
+			t.Errorf("newVaultTransitAEAD(%v) = %+v, %v, want mount %v key %v", test.keyURI, a, err, test.mount, test.keyName)
+		}
+	}
+}
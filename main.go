@@ -17,9 +17,12 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
 	gcsproxy "github.com/byronwhitlock-google/go-gcsproxy/proxy"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 
 	log "github.com/sirupsen/logrus"
@@ -39,31 +42,30 @@ func main() {
 	}()
 
 	otelEnabled := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	initConfig()
 
-	// If OTEL is configured. Setup the custom metrics to capture encrypt/decrypt time.
-	if otelEnabled != "" {
+	// If OTEL or the prometheus endpoint is configured. Setup the custom metrics of flows and crypto.
+	if otelEnabled != "" || cfg.GlobalConfig.MetricsAddr != "" {
 		initMetrics()
-		initConfig()
 		runner := gcsproxy.NewProxyRunner(cfg.GlobalConfig)
 
 		// Setup metrics, tracing, and context propagation
 		ctx := context.Background()
-		shutdown, err := setupOpenTelemetry(ctx)
+		shutdown, err := setupOpenTelemetry(ctx, otelEnabled != "", cfg.GlobalConfig.MetricsAddr)
 		if err != nil {
-			log.Fatalf("Error setting up OpenTelemetry. Error:", err)
+			log.Fatalf("Error setting up OpenTelemetry. Error: %v", err)
 		}
 
 		// Start the GCS proxy server, and shutdown and flush telemetry after it exits.
 		slog.InfoContext(ctx, "server starting...")
 		if err = errors.Join(runner.Start(), shutdown(ctx)); err != nil {
-			log.Fatalf("Server exited with error. Error:", err)
+			log.Fatalf("Server exited with error. Error: %v", err)
 		}
 	} else {
-		initConfig()
 		runner := gcsproxy.NewProxyRunner(cfg.GlobalConfig)
 		err := runner.Start()
 		if err != nil {
-			log.Fatalf("Fatal error to start the GCS proxy. Error:", err)
+			log.Fatalf("Fatal error to start the GCS proxy. Error: %v", err)
 		} else {
 			log.Info("GCS proxy started successfully")
 		}
@@ -72,19 +74,179 @@ func main() {
 
 func initMetrics() {
 	var err error
-	crypto.EncryptTime, err = crypto.Meter.Float64Gauge(
+	crypto.EncryptTime, err = crypto.Meter.Float64Histogram(
 		"proxy.encryptTime",
 		metric.WithDescription("GCS Proxy Encryption time"),
-		metric.WithUnit("seconds"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(crypto.LatencyBuckets...),
 	)
 	if err != nil {
 		panic(err)
 	}
 
-	crypto.DecryptTime, err = crypto.Meter.Float64Gauge(
+	crypto.DecryptTime, err = crypto.Meter.Float64Histogram(
 		"proxy.decryptTime",
 		metric.WithDescription("GCS Proxy Decryption time"),
-		metric.WithUnit("seconds"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(crypto.LatencyBuckets...),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsTime, err = crypto.Meter.Float64Histogram(
+		"proxy.kmsTime",
+		metric.WithDescription("Time of KMS calls to wrap and unwrap data encryption keys, including retries"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(crypto.LatencyBuckets...),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.Requests, err = crypto.Meter.Int64Counter(
+		"proxy.requests",
+		metric.WithDescription("Requests by bucket and GCS operation"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.RequestBytes, err = crypto.Meter.Int64Counter(
+		"proxy.requestBytes",
+		metric.WithDescription("Request body bytes received from clients"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.ResponseBytes, err = crypto.Meter.Int64Counter(
+		"proxy.responseBytes",
+		metric.WithDescription("Response body bytes returned to clients"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.Errors, err = crypto.Meter.Int64Counter(
+		"proxy.errors",
+		metric.WithDescription("Failed requests by GCS error reason, failOpen for requests forwarded unencrypted and upstream for errors of GCS"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.InFlight, err = crypto.Meter.Int64UpDownCounter(
+		"proxy.inFlight",
+		metric.WithDescription("Requests that are being processed"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DekCacheHits, err = crypto.Meter.Int64Counter(
+		"proxy.dekCacheHits",
+		metric.WithDescription("Encryptions and decryptions with a cached data encryption key"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DekCacheMisses, err = crypto.Meter.Int64Counter(
+		"proxy.dekCacheMisses",
+		metric.WithDescription("Encryptions and decryptions that called KMS to wrap or unwrap a data encryption key"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DekRotations, err = crypto.Meter.Int64Counter(
+		"proxy.dekRotations",
+		metric.WithDescription("Cached data encryption keys replaced because they reached a limit"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.dekCacheLimit",
+		metric.WithDescription("Configured limits of the data encryption key cache"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			limits := crypto.GetDekCacheLimits()
+			observer.Observe(int64(limits.MaxObjects), metric.WithAttributes(attribute.String("limit", "maxObjects")))
+			observer.Observe(int64(limits.MaxBytes), metric.WithAttributes(attribute.String("limit", "maxBytes")))
+			observer.Observe(int64(limits.MaxAge.Seconds()), metric.WithAttributes(attribute.String("limit", "maxAgeSeconds")))
+			observer.Observe(int64(limits.DecryptEntries), metric.WithAttributes(attribute.String("limit", "decryptEntries")))
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsRetries, err = crypto.Meter.Int64Counter(
+		"proxy.kmsRetries",
+		metric.WithDescription("KMS calls retried after a transient error"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsTimeouts, err = crypto.Meter.Int64Counter(
+		"proxy.kmsTimeouts",
+		metric.WithDescription("KMS calls that failed because they timed out"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsRejected, err = crypto.Meter.Int64Counter(
+		"proxy.kmsRejected",
+		metric.WithDescription("KMS calls failed fast by an open circuit breaker"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.KmsBreakerTransitions, err = crypto.Meter.Int64Counter(
+		"proxy.kmsBreakerTransitions",
+		metric.WithDescription("KMS circuit breakers that opened or closed"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = crypto.Meter.Int64ObservableGauge(
+		"proxy.kmsBreakerOpen",
+		metric.WithDescription("1 while the circuit breaker of a KMS key fails fast or probes, 0 when it is closed"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			for resourceName, state := range crypto.GetKmsBreakerStates() {
+				var open int64
+				if state != "closed" {
+					open = 1
+				}
+				observer.Observe(open, metric.WithAttributes(attribute.String("key", resourceName)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	crypto.DecryptKeyFallbacks, err = crypto.Meter.Int64Counter(
+		"proxy.decryptKeyFallbacks",
+		metric.WithDescription("Objects decrypted with a key alias or decrypt-only key instead of their stored key"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	gcsproxy.UnmappedBucketWrites, err = crypto.Meter.Int64Counter(
+		"proxy.unmappedBucketWrites",
+		metric.WithDescription("Writes to buckets without a KMS key that are not exempt from encryption"),
 	)
 	if err != nil {
 		panic(err)
@@ -110,15 +272,103 @@ func initConfig() {
 		log.SetReportCaller(true)
 	}
 	log.SetOutput(os.Stdout)
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
+	var formatter log.Formatter = &log.JSONFormatter{}
+	if config.LogFormat == cfg.LogFormatText {
+		formatter = &log.TextFormatter{FullTimestamp: true}
+	}
+	log.SetFormatter(&util.RedactingFormatter{Formatter: formatter})
+
+	crypto.ConfigureDekCache(crypto.DekCacheLimits{
+		MaxObjects:     config.DekCacheMaxObjects,
+		MaxBytes:       config.DekCacheMaxBytes,
+		MaxAge:         config.DekCacheMaxAge,
+		DecryptEntries: config.DekCacheDecryptEntries,
+	})
+
+	crypto.ConfigureVault(crypto.VaultConfig{
+		Addr:         config.VaultAddr,
+		Namespace:    config.VaultNamespace,
+		Token:        config.VaultToken,
+		RoleID:       config.VaultRoleID,
+		SecretID:     config.VaultSecretID,
+		AppRoleMount: config.VaultAppRoleMount,
+	})
+	crypto.ConfigureKeyring(crypto.Keyring{
+		Aliases:     config.KeyAliases,
+		DecryptKeys: config.DecryptKeys,
+		NegativeTTL: config.DecryptKeyNegativeTTL,
+	})
+	crypto.ConfigureKeyRegistry(config.KeyRegistryPath)
+	crypto.ConfigureKmsPolicy(crypto.KmsPolicy{
+		Timeout:          config.KmsTimeout,
+		MaxAttempts:      config.KmsMaxAttempts,
+		InitialBackoff:   config.KmsInitialBackoff,
+		MaxBackoff:       config.KmsMaxBackoff,
+		BreakerThreshold: config.KmsBreakerThreshold,
+		BreakerCooldown:  config.KmsBreakerCooldown,
 	})
 
-	err := checkKmsBucketKeyMapping()
+	if config.GenerateNameKeyset {
+		err := crypto.GenerateNameKeyset(context.Background(), config.NameKeysetPath, config.NameKeysetKey)
+		if err != nil {
+			log.Fatalf("unable to generate name keyset. %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if config.VerifyAudit != "" {
+		result, err := audit.Verify(config.VerifyAudit, config.AuditHmacKey)
+		if err != nil {
+			log.Fatalf("audit log verification failed: %v", err)
+		}
+		log.Infof("audit log intact: %v records %v to %v in %v chains, files %v",
+			result.Records, result.FirstSeq, result.LastSeq, result.Chains, result.Files)
+		for _, restart := range result.Restarts {
+			log.Warnf("the audit chain restarts at %v, the proxy restarted while auditing to syslog", restart)
+		}
+		os.Exit(0)
+	}
+
+	err := audit.Configure(audit.Config{
+		Path:     config.AuditLog,
+		MaxBytes: config.AuditMaxBytes,
+		MaxFiles: config.AuditMaxFiles,
+		Syslog:   config.AuditSyslog,
+		HmacKey:  config.AuditHmacKey,
+	})
+	if err != nil {
+		log.Fatalf("unable to open the audit log. %v", err)
+	}
+
+	err = checkKmsBucketKeyMapping()
 	if err != nil {
 		log.Fatalf("\n>>> unable to initialize KmsBucketKeyMapping. %v", err)
 	}
 
+	if len(config.EncryptNamesBuckets) > 0 {
+		err = crypto.LoadNameKeyset(context.Background(), config.NameKeysetPath, config.NameKeysetKey)
+		if err != nil {
+			log.Fatalf("\n>>> unable to load the name keyset for encrypt_names. %v", err)
+		}
+	}
+
+	if config.Shred != "" {
+		err = util.ShredKeyScope(context.Background(), config.Shred)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		os.Exit(0)
+	}
+
+	if config.VerifyObject != "" {
+		err = util.VerifyObjectFile(context.Background(), config.VerifyObject, config.VerifyFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Infof("%v matches the md5 hash of %v", config.VerifyFile, config.VerifyObject)
+		os.Exit(0)
+	}
+
 	configJson, _ := json.MarshalIndent(config, "", "\t")
 	log.Infof("go-gcsproxy version '%v' Startting... %v", config.Version, string(configJson))
 }
@@ -129,13 +379,66 @@ func usage() {
 	fmt.Println("  PROXY_CERT_PATH")
 	fmt.Println("  SSL_INSECURE")
 	fmt.Println("  DEBUG_LEVEL")
+	fmt.Println("  GCS_PROXY_LOG_FORMAT")
 	fmt.Println("  GCP_KMS_BUCKET_KEY_MAPPING")
+	fmt.Println("  GCS_PROXY_FAILURE_POLICY")
+	fmt.Println("  GCS_PROXY_UNMAPPED_BUCKET_MODE")
+	fmt.Println("  GCS_PROXY_PLAINTEXT_BUCKETS")
+	fmt.Println("  GCS_PROXY_COMPRESSION")
+	fmt.Println("  GCS_PROXY_PADDING")
+	fmt.Println("  GCS_PROXY_DEK_CACHE_MAX_OBJECTS")
+	fmt.Println("  GCS_PROXY_DEK_CACHE_MAX_BYTES")
+	fmt.Println("  GCS_PROXY_DEK_CACHE_MAX_AGE")
+	fmt.Println("  GCS_PROXY_DEK_CACHE_DECRYPT_ENTRIES")
+	fmt.Println("  GCS_PROXY_KEY_LABEL")
+	fmt.Println("  GCS_PROXY_KEY_LABEL_PREFIX")
+	fmt.Println("  GCS_PROXY_KEY_LABEL_TTL")
+	fmt.Println("  GCS_PROXY_REQUEST_KEYS")
+	fmt.Println("  GCS_PROXY_KEY_SCOPES")
+	fmt.Println("  GCS_PROXY_KEY_REGISTRY")
+	fmt.Println("  GCS_PROXY_KEY_ALIASES")
+	fmt.Println("  GCS_PROXY_DECRYPT_KEYS")
+	fmt.Println("  GCS_PROXY_DECRYPT_KEY_NEGATIVE_TTL")
+	fmt.Println("  VAULT_ADDR")
+	fmt.Println("  VAULT_NAMESPACE")
+	fmt.Println("  VAULT_TOKEN")
+	fmt.Println("  VAULT_ROLE_ID")
+	fmt.Println("  VAULT_SECRET_ID")
+	fmt.Println("  VAULT_APPROLE_MOUNT")
+	fmt.Println("  GCS_PROXY_KMS_TIMEOUT")
+	fmt.Println("  GCS_PROXY_KMS_MAX_ATTEMPTS")
+	fmt.Println("  GCS_PROXY_KMS_INITIAL_BACKOFF")
+	fmt.Println("  GCS_PROXY_KMS_MAX_BACKOFF")
+	fmt.Println("  GCS_PROXY_KMS_BREAKER_THRESHOLD")
+	fmt.Println("  GCS_PROXY_KMS_BREAKER_COOLDOWN")
+	fmt.Println("  GCS_PROXY_ENCRYPT_METADATA")
+	fmt.Println("  GCS_PROXY_ENCRYPT_CONTENT_DISPOSITION")
+	fmt.Println("  GCS_PROXY_MD5_METADATA")
+	fmt.Println("  GCS_PROXY_ENCRYPT_NAMES")
+	fmt.Println("  GCS_PROXY_NAME_KEYSET")
+	fmt.Println("  GCS_PROXY_NAME_KEYSET_KEY")
+	fmt.Println("  GCS_PROXY_HOSTS")
+	fmt.Println("  STORAGE_EMULATOR_HOST")
+	fmt.Println("  GCS_PROXY_ENDPOINT_ADDR")
+	fmt.Println("  GCS_PROXY_ENDPOINT_UPSTREAM")
+	fmt.Println("  GCS_PROXY_ENDPOINT_CERT_FILE")
+	fmt.Println("  GCS_PROXY_ENDPOINT_KEY_FILE")
+	fmt.Println("  GCS_PROXY_METRICS_ADDR")
+	fmt.Println("  GCS_PROXY_AUDIT_LOG")
+	fmt.Println("  GCS_PROXY_AUDIT_MAX_BYTES")
+	fmt.Println("  GCS_PROXY_AUDIT_MAX_FILES")
+	fmt.Println("  GCS_PROXY_AUDIT_SYSLOG")
+	fmt.Println("  GCS_PROXY_AUDIT_HMAC_KEY")
 }
 
 func checkKmsBucketKeyMapping() error {
 	var ctx = context.TODO()
 	bucketKeyMap := cfg.GlobalConfig.KmsBucketKeyMapping
 	if bucketKeyMap == nil {
+		// keys of labelled buckets are only known once the buckets are used
+		if util.IsKeyLabelEnabled() {
+			return nil
+		}
 		return fmt.Errorf("No KmsBucketKeyMapping found")
 	}
 	for _, value := range bucketKeyMap {
@@ -9,17 +9,23 @@ package main
 import (
 	"context"
 	"errors"
+	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/exporters/autoexport"
 	"go.opentelemetry.io/contrib/propagators/autoprop"
 	"go.opentelemetry.io/otel"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/trace"
 )
 
-// setupOpenTelemetry sets up the OpenTelemetry SDK and exporters for metrics and
-// traces. If it does not return an error, call shutdown for proper cleanup.
-func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) error, err error) {
+// setupOpenTelemetry sets up the OpenTelemetry SDK and exporters for metrics and traces. Metrics are
+// exported as OTLP when otlpEnabled and served for prometheus at metricsAddr when it is set. If it
+// does not return an error, call shutdown for proper cleanup.
+func setupOpenTelemetry(ctx context.Context, otlpEnabled bool, metricsAddr string) (shutdown func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
 
 	// shutdown combines shutdown functions from multiple OpenTelemetry
@@ -36,27 +42,58 @@ func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) err
 	// Configure Context Propagation to use the default W3C traceparent format
 	otel.SetTextMapPropagator(autoprop.NewTextMapPropagator())
 
-	// Configure Trace Export to send spans as OTLP
-	texporter, err := autoexport.NewSpanExporter(ctx)
-	if err != nil {
-		err = errors.Join(err, shutdown(ctx))
-		return
+	var readers []metric.Option
+	if otlpEnabled {
+		// Configure Trace Export to send spans as OTLP
+		texporter, err := autoexport.NewSpanExporter(ctx)
+		if err != nil {
+			return nil, errors.Join(err, shutdown(ctx))
+		}
+		tp := trace.NewTracerProvider(trace.WithBatcher(texporter))
+		shutdownFuncs = append(shutdownFuncs, tp.Shutdown)
+		otel.SetTracerProvider(tp)
+
+		// Configure Metric Export to send metrics as OTLP
+		mreader, err := autoexport.NewMetricReader(ctx)
+		if err != nil {
+			return nil, errors.Join(err, shutdown(ctx))
+		}
+		readers = append(readers, metric.WithReader(mreader))
 	}
-	tp := trace.NewTracerProvider(trace.WithBatcher(texporter))
-	shutdownFuncs = append(shutdownFuncs, tp.Shutdown)
-	otel.SetTracerProvider(tp)
 
-	// Configure Metric Export to send metrics as OTLP
-	mreader, err := autoexport.NewMetricReader(ctx)
-	if err != nil {
-		err = errors.Join(err, shutdown(ctx))
-		return
+	if metricsAddr != "" {
+		preader, metricsShutdown, err := servePrometheusMetrics(metricsAddr)
+		if err != nil {
+			return nil, errors.Join(err, shutdown(ctx))
+		}
+		shutdownFuncs = append(shutdownFuncs, metricsShutdown)
+		readers = append(readers, metric.WithReader(preader))
 	}
-	mp := metric.NewMeterProvider(
-		metric.WithReader(mreader),
-	)
+
+	mp := metric.NewMeterProvider(readers...)
 	shutdownFuncs = append(shutdownFuncs, mp.Shutdown)
 	otel.SetMeterProvider(mp)
 
 	return shutdown, nil
 }
+
+// servePrometheusMetrics serves the metrics of the returned reader at http://metricsAddr/metrics. Only
+// the proxy metrics are registered, not the go runtime metrics of the default registry.
+func servePrometheusMetrics(metricsAddr string) (metric.Reader, func(context.Context) error, error) {
+	registry := prometheus.NewRegistry()
+	reader, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: metricsAddr, Handler: mux}
+	go func() {
+		log.Infof("prometheus metrics listening at http://%v/metrics", metricsAddr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("prometheus metrics server failed: %v", err)
+		}
+	}()
+	return reader, server.Shutdown, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// RedactingDumper writes the requests and responses of every flow to a file for debugging, with the
+// credentials of headers and URLs masked like the logs. Bodies are plaintext objects and metadata, they are
+// never written, dump_level 1 adds their length.
+type RedactingDumper struct {
+	proxy.BaseAddon
+	mutex sync.Mutex
+	out   io.Writer
+	level int // 0: header 1: header + body length
+}
+
+func NewRedactingDumper(filename string, level int) (*RedactingDumper, error) {
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dump file: %w", err)
+	}
+	return &RedactingDumper{out: out, level: level}, nil
+}
+
+func (d *RedactingDumper) Requestheaders(f *proxy.Flow) {
+	hdl.OnFlowDone(f, func() { d.dump(f) })
+}
+
+func (d *RedactingDumper) dump(f *proxy.Flow) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s %s\r\n", f.Request.Method, util.RedactString(f.Request.URL.RequestURI()), f.Request.Proto)
+	fmt.Fprintf(buf, "Host: %s\r\n", f.Request.URL.Host)
+	util.RedactHeader(f.Request.Header).Write(buf)
+	buf.WriteString("\r\n")
+	if d.level == 1 {
+		fmt.Fprintf(buf, "[%v bytes]\r\n\r\n", len(f.Request.Body))
+	}
+
+	if f.Response != nil {
+		fmt.Fprintf(buf, "%v %v %v\r\n", f.Request.Proto, f.Response.StatusCode, http.StatusText(f.Response.StatusCode))
+		util.RedactHeader(f.Response.Header).Write(buf)
+		buf.WriteString("\r\n")
+		if d.level == 1 {
+			fmt.Fprintf(buf, "[%v bytes]\r\n\r\n", len(f.Response.Body))
+		}
+	}
+	buf.WriteString("\r\n\r\n")
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.out.Write(buf.Bytes())
+	if err != nil {
+		log.Errorf("unable to write dump: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	Endpoint mode lets clients that can't trust the MITM CA (or pin certificates) use the proxy
+	as a GCS endpoint, e.g. STORAGE_EMULATOR_HOST=http://localhost:9090.
+
+	Requests are rewritten to the real GCS host and sent thru the local MITM proxy, so they get
+	exactly the same EncryptGcsPayload/DecryptGcsPayload handling as proxied clients.
+*/
+
+type EndpointRunner struct {
+	config   *cfg.Config
+	upstream *url.URL
+	server   *http.Server
+}
+
+type endpointOriginKey struct{}
+
+// caCert is the MITM root CA, trusted only for the hop from the endpoint to the local MITM proxy.
+func NewEndpointRunner(config *cfg.Config, caCert x509.Certificate) (*EndpointRunner, error) {
+	mitmProxyUrl, err := url.Parse("http://" + loopbackAddr(config.Addr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy listen addr '%v': %w", config.Addr, err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(&caCert)
+
+	r := &EndpointRunner{
+		config:   config,
+		upstream: &url.URL{Scheme: "https", Host: config.EndpointUpstream},
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite:        r.rewrite,
+		ModifyResponse: r.modifyResponse,
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(mitmProxyUrl),
+			TLSClientConfig:    &tls.Config{RootCAs: rootCAs},
+			DisableCompression: true,
+		},
+		FlushInterval: -1,
+	}
+
+	listenAddr := config.EndpointAddr
+	if config.EndpointCertFile == "" {
+		listenAddr = plainEndpointAddr(config.EndpointAddr)
+	}
+	r.server = &http.Server{
+		Addr:    listenAddr,
+		Handler: reverseProxy,
+	}
+	return r, nil
+}
+
+func (r *EndpointRunner) Start() error {
+	if r.config.EndpointCertFile != "" {
+		log.Infof("GCS endpoint listening at https://%v forwarding to %v", r.server.Addr, r.upstream)
+		return r.server.ListenAndServeTLS(r.config.EndpointCertFile, r.config.EndpointKeyFile)
+	}
+	log.Infof("GCS endpoint listening at http://%v forwarding to %v", r.server.Addr, r.upstream)
+	return r.server.ListenAndServe()
+}
+
+func (r *EndpointRunner) rewrite(pr *httputil.ProxyRequest) {
+	// remember how the client reached us so redirects and upload session urls point back here
+	origin := &url.URL{Scheme: "http", Host: pr.In.Host}
+	if pr.In.TLS != nil {
+		origin.Scheme = "https"
+	}
+	pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), endpointOriginKey{}, origin))
+
+	pr.SetURL(r.upstream)
+	log.Debugf("endpoint forwarding %v %v", pr.Out.Method, pr.Out.URL)
+}
+
+// resumable uploads return the session url in the Location header, it has to point at the
+// endpoint or the client would upload the chunks straight to GCS unencrypted.
+func (r *EndpointRunner) modifyResponse(res *http.Response) error {
+	location := res.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	locationUrl, err := url.Parse(location)
+	if err != nil || locationUrl.Host != r.upstream.Host {
+		return nil
+	}
+
+	origin, ok := res.Request.Context().Value(endpointOriginKey{}).(*url.URL)
+	if !ok {
+		return nil
+	}
+	locationUrl.Scheme = origin.Scheme
+	locationUrl.Host = origin.Host
+	res.Header.Set("Location", locationUrl.String())
+	return nil
+}
+
+// plainEndpointAddr listens on loopback when addr names no host, plain HTTP carries bearer tokens and
+// plaintext objects. Other hosts are an explicit choice and only warned about.
+func plainEndpointAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// ListenAndServe reports the invalid addr
+		return addr
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Warnf("the GCS endpoint serves plain HTTP on %v, bearer tokens and plaintext objects can be read on the network. Set endpoint_cert_file and endpoint_key_file to serve HTTPS", addr)
+	}
+	return addr
+}
+
+// ":9080" listens on every interface, the endpoint dials it on loopback.
+func loopbackAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
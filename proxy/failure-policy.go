@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+// requestSnapshot is the client request before any handler rewrote it, so a fail open
+// policy forwards exactly what the client sent instead of a half converted request.
+type requestSnapshot struct {
+	method string
+	url    url.URL
+	header http.Header
+	body   []byte
+}
+
+func snapshotRequest(f *proxy.Flow) requestSnapshot {
+	return requestSnapshot{
+		method: f.Request.Method,
+		url:    *f.Request.URL,
+		header: f.Request.Header.Clone(),
+		body:   f.Request.Body,
+	}
+}
+
+func (s requestSnapshot) restore(f *proxy.Flow) {
+	restoredUrl := s.url
+	f.Request.Method = s.method
+	f.Request.URL = &restoredUrl
+	f.Request.Header = s.header
+	f.Request.Body = s.body
+}
+
+// isUnhandledOperation reports if a request InterceptGcsMethod let pass thru would write object data to a
+// mapped bucket or copy it from one, e.g. XML API uploads, copies, rewrites and composes. The requests of a
+// batch are not handled at all, a batch is unhandled when one of them writes to or reads from a mapped
+// bucket, or when its body can't be parsed. Deletes and ACL changes in a batch pass thru.
+func isUnhandledOperation(op *util.GcsOperation) bool {
+	if op == nil {
+		return false
+	}
+	if op.Type == util.Batch {
+		if op.BatchOperations == nil {
+			return true
+		}
+		for _, batchOp := range op.BatchOperations {
+			if (batchOp.IsObjectWrite() || batchOp.IsObjectRead()) && isAnyBucketMapped(batchOp.Buckets()) {
+				return true
+			}
+		}
+		return false
+	}
+	return op.IsObjectWrite() && isAnyBucketMapped(op.Buckets())
+}
+
+func isAnyBucketMapped(buckets []string) bool {
+	for _, bucketName := range buckets {
+		if util.GetKMSKeyName(bucketName) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceFailurePolicy decides what happens to a request that could not be encrypted. Fail closed
+// answers with a GCS error so nothing reaches GCS, fail open forwards the original request unencrypted.
+func enforceFailurePolicy(f *proxy.Flow, op *util.GcsOperation, snapshot requestSnapshot, err error) {
+	bucketName := op.Bucket
+
+	if util.IsFailOpen(bucketName) {
+		hdl.FlowLogger(f).Warnf("fail open policy for bucket '%v', forwarding %v %v unencrypted: %v", bucketName, snapshot.method, snapshot.url.Path, err)
+		snapshot.restore(f)
+		hdl.SetFailOpen(f)
+		recordError(f, "failOpen")
+		return
+	}
+
+	hdl.FlowLogger(f).Errorf("fail closed policy for bucket '%v', rejecting %v %v: %v", bucketName, snapshot.method, snapshot.url.Path, err)
+	replyGcsError(f, util.ToGcsError(err))
+}
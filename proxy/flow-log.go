@@ -0,0 +1,51 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"time"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// finishFlow ends the span of a flow and logs it once its response was sent.
+func finishFlow(f *proxy.Flow, start time.Time, requestBytes int, span trace.Span) {
+	upstream := upstreamDuration(f)
+	endFlowSpan(f, span)
+
+	// bodies are never logged, only their size
+	fields := log.Fields{
+		"method":       f.Request.Method,
+		"durationMs":   time.Since(start).Milliseconds(),
+		"upstreamMs":   upstream.Milliseconds(),
+		"requestBytes": requestBytes,
+	}
+	if f.Response != nil {
+		fields["status"] = f.Response.StatusCode
+		fields["responseBytes"] = len(f.Response.Body)
+	}
+	hdl.FlowLogger(f).WithFields(fields).Info("flow done")
+}
+
+func debugRequest(f *proxy.Flow) {
+	hdl.FlowLogger(f).WithFields(log.Fields{
+		"method": f.Request.Method,
+		"url":    f.Request.URL.String(),
+		"bytes":  len(f.Request.Body),
+		"header": f.Request.Header,
+	}).Debug("request")
+}
+
+func debugResponse(f *proxy.Flow) {
+	hdl.FlowLogger(f).WithFields(log.Fields{
+		"status": f.Response.StatusCode,
+		"bytes":  len(f.Response.Body),
+		"header": f.Response.Header,
+	}).Debug("response")
+}
@@ -6,13 +6,15 @@ This software is provided as-is, without warranty or representation for any use
 package proxy
 
 import (
-	"strings"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
 
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
 	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
 	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
-	log "github.com/sirupsen/logrus"
 )
 
 type DecryptGcsPayload struct {
@@ -26,7 +28,7 @@ type GetReqHeader struct {
 	proxy.BaseAddon
 }
 
-// https://cloud.google.com/storage/docs/json_api/v1/objects
+// operations with a handler, the full route table is in util.RouteGcsRequest
 type gcsMethod int
 
 const (
@@ -35,96 +37,103 @@ const (
 	resumableUploadPost                  // uploadType=resumable, VERB=POST, path=/upload/storage/v1/b/
 	resumableUploadPut                   // uploadType=resumable, VERB=PUT , path=/upload/storage/v1/b/
 	simpleDownload                       // VERB=GET, path=/storage/v1/b/bucket/o/object?alt=media or path=/bucket-name/object-name
-	streamingDownload                    // unsupported
-	metadataRequest                      // VERB=GET, path=/storage/v1/b/bucket/o/object?alt=json or path=/storage/v1/b/bucket/o/object?fields=size,generation,updated
+	metadataRequest                      // VERB=GET, path=/storage/v1/b/bucket/o/object
+	metadataUpdate                       // VERB=PATCH or PUT, path=/storage/v1/b/bucket/o/object
+	objectList                           // VERB=GET, path=/storage/v1/b/bucket/o
+	xmlMetadataRequest                   // VERB=HEAD, path=/bucket-name/object-name
 	passThru                             // all other requests
 
 )
 
-func InterceptGcsMethod(f *proxy.Flow) gcsMethod {
-	// GCS supports both hostnames
-	if f.Request.URL.Host == "storage.googleapis.com" || f.Request.URL.Host == "www.googleapis.com" {
-		bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-		if util.GetKMSKeyName(bucketName) == "" {
-			return passThru
-		}
-
-		// multi-part or simple upload
-		if strings.HasPrefix(f.Request.URL.Path, "/upload/storage/v1") {
-			if f.Request.Method == "POST" {
-
-				if f.Request.URL.Query().Get("uploadType") == "multipart" {
-					return multiPartUpload
-				}
-				if f.Request.URL.Query().Get("uploadType") == "media" {
-					return singlePartUpload
-				}
-			}
-		}
-
-		// Resumable upload
-		if strings.HasPrefix(f.Request.URL.Path, "/resumable/upload/storage/v1") ||
-			(strings.HasPrefix(f.Request.URL.Path, "/upload/storage/v1") && f.Request.URL.Query().Get("uploadType") == "resumable") {
-			if f.Request.Method == "POST" {
-				return resumableUploadPost
-			} else if f.Request.Method == "PUT" {
-				return resumableUploadPut
-			}
-		}
+var interceptedOperations = map[util.GcsOperationType]gcsMethod{
+	util.MultipartUpload:      multiPartUpload,
+	util.MediaUpload:          singlePartUpload,
+	util.ResumableUploadStart: resumableUploadPost,
+	util.ResumableUploadChunk: resumableUploadPut,
+	util.ObjectDownload:       simpleDownload,
+	util.XmlObjectDownload:    simpleDownload,
+	util.ObjectMetadata:       metadataRequest,
+	util.ObjectPatch:          metadataUpdate,
+	util.ObjectUpdate:         metadataUpdate,
+	util.ObjectList:           objectList,
+	util.XmlObjectMetadata:    xmlMetadataRequest,
+}
 
-		// get metadata
-		if strings.HasPrefix(f.Request.URL.Path, "/storage/v1/b/") {
-			if f.Request.Method == "GET" {
-				// pass through for metadata request for bucket
-				// TODO eshen may need to bypass directory too
-				if strings.HasSuffix(f.Request.URL.Path, "/o") {
-					return passThru
-				}
-				if f.Request.URL.Query().Get("alt") == "json" {
-					return metadataRequest
-				}
-				if f.Request.URL.Query().Get("alt") == "media" {
-					return simpleDownload
-				}
-				if f.Request.URL.Query().Get("fields") != "" {
-					f.Request.URL.RawQuery = "alt=json"
-					return metadataRequest
-				}
-
-			}
+// GCS supports several hostnames, regional and custom endpoints are configured with gcs_hosts
+func isGcsHost(host string) bool {
+	for _, matcher := range cfg.GlobalConfig.GcsHosts {
+		if matcher.Matches(host) {
+			return true
 		}
+	}
+	return false
+}
 
-		// download object when path=/download
-		if strings.HasPrefix(f.Request.URL.Path, "/download") {
-			return simpleDownload
-		}
-		// download when path=/bucket-name/object-name
-		if f.Request.Method == "GET" {
-			if f.Request.URL.Query().Get("alt") == "" || f.Request.URL.Query().Get("fields") == "" {
-				return simpleDownload
-			}
+// InterceptGcsMethod classifies a request with the GCS route table. Requests to buckets without a
+// KMS key and operations without a handler pass thru. The operation is nil for non GCS hosts.
+func InterceptGcsMethod(f *proxy.Flow) (gcsMethod, *util.GcsOperation) {
+	if !isGcsHost(f.Request.URL.Host) {
+		return passThru, nil
+	}
 
-		}
+	op := util.RouteGcsRequest(f.Request)
+	if util.GetKMSKeyName(op.Bucket) == "" {
+		return passThru, op
+	}
 
+	m, ok := interceptedOperations[op.Type]
+	if !ok {
+		return passThru, op
 	}
-	return passThru
+	return m, op
 }
 
 func (c *EncryptGcsPayload) Request(f *proxy.Flow) {
 
+	start := time.Now()
+	span := startFlowSpan(f)
 	debugRequest(f)
+	recordRequest(f)
+	requestBytes := len(f.Request.Body)
+	hdl.OnFlowDone(f, func() { finishFlow(f, start, requestBytes, span) })
+	defer startUpstreamSpan(f)
 	if cfg.GlobalConfig.EncryptDisabled {
 		return
 	}
 
 	var err error
+	snapshot := snapshotRequest(f)
+
+	if isGcsHost(f.Request.URL.Host) && !resolveBucketKeys(f, util.RouteGcsRequest(f.Request)) {
+		return
+	}
+
+	m, op := InterceptGcsMethod(f)
+
+	if !enforceUnmappedBucketPolicy(f, op) {
+		return
+	}
+
+	// the key header is never forwarded, a key not allowed for the bucket is rejected before anything else
+	err = hdl.HandleRequestKey(f, op)
+	if err != nil {
+		replyRequestError(f, op, snapshot, err)
+		return
+	}
+
+	// object names are translated for every operation, the handlers below only see the stored names
+	err = hdl.HandleObjectNamesRequest(f, op)
+	if err != nil {
+		replyRequestError(f, op, snapshot, err)
+		return
+	}
 
 out:
-	switch m := InterceptGcsMethod(f); m {
+	switch m {
 
 	case multiPartUpload:
 		// Parse the multipart request.
-		err = hdl.HandleMultipartRequest(f)
+		err = hdl.HandleMultipartRequest(f, op)
 		break out
 
 	case simpleDownload:
@@ -132,63 +141,155 @@ out:
 		break out
 
 	case singlePartUpload:
-		err = hdl.ConvertSinglePartUploadtoMultiPartUpload(f)
+		err = hdl.ConvertSinglePartUploadtoMultiPartUpload(f, op, nil)
 		break out
 
-	case metadataRequest:
+	case metadataRequest, objectList:
 		err = hdl.HandleMetadataRequest(f)
 		break out
 
+	case metadataUpdate:
+		err = hdl.HandleMetadataUpdateRequest(f, op)
+		break out
+
 	case resumableUploadPost:
-		err = hdl.HandleResumablePostRequest(f)
+		err = hdl.HandleResumablePostRequest(f, op)
 		break out
 
 	case resumableUploadPut:
 		err = hdl.HandleResumablePutRequest(f)
 		break out
 	}
+	if err == nil && m == passThru && isUnhandledOperation(op) {
+		err = util.NewGcsError(http.StatusNotImplemented, "notImplemented",
+			"go-gcsproxy can not encrypt %v %v (%v)", f.Request.Method, f.Request.URL.Path, op.Type)
+	}
 	if err != nil {
-		f.Request.Body = nil // on error don't upload anything
-		log.Error(err)
+		replyRequestError(f, op, snapshot, err)
+		return
+	}
+}
+
+// resolveBucketKeys reads the key labels of the buckets of requests that write or read objects, no other
+// request needs a key. A write to a bucket whose label can't be read would pass thru as unmapped and is
+// rejected, a read passes thru. Returns false when the request was rejected.
+func resolveBucketKeys(f *proxy.Flow, op *util.GcsOperation) bool {
+	isWrite := op.IsObjectWrite() || op.Type == util.ObjectPatch || op.Type == util.ObjectUpdate
+	if !isWrite && !op.IsObjectRead() {
+		return true
+	}
+
+	for _, bucketName := range op.Buckets() {
+		err := util.ResolveBucketKey(hdl.GetTraceContext(f), bucketName)
+		if err == nil {
+			continue
+		}
+		if !isWrite {
+			hdl.FlowLogger(f).Warnf("reading bucket '%v' as unmapped, its key label can't be read: %v", bucketName, err)
+			continue
+		}
+		hdl.FlowLogger(f).Error(err)
+		replyGcsError(f, util.NewGcsError(http.StatusServiceUnavailable, "backendError", "Unable to read the key label of the bucket: %v", err))
+		return false
+	}
+	return true
+}
+
+func replyRequestError(f *proxy.Flow, op *util.GcsOperation, snapshot requestSnapshot, err error) {
+	hdl.FlowLogger(f).Error(err)
+
+	// 4xx errors are the client's fault, there is nothing to fail open to
+	var gcsErr *util.GcsError
+	if errors.As(err, &gcsErr) && gcsErr.Code < 500 {
+		replyGcsError(f, gcsErr)
 		return
 	}
+	enforceFailurePolicy(f, op, snapshot, err)
+}
+
+// replyGcsError answers a request without forwarding it to GCS
+func replyGcsError(f *proxy.Flow, gcsErr *util.GcsError) {
+	f.Response = newGcsErrorResponse(gcsErr)
+	recordError(f, gcsErr.Reason)
+	recordResponse(f)
+}
+
+func newGcsErrorResponse(gcsErr *util.GcsError) *proxy.Response {
+	body := gcsErr.Json()
+	header := gcsErr.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &proxy.Response{
+		StatusCode: gcsErr.Code,
+		Header:     header,
+		Body:       body,
+	}
 }
 
 func (c *DecryptGcsPayload) Response(f *proxy.Flow) {
 
 	var err error
 
+	endUpstreamSpan(f)
 	debugResponse(f)
+	defer recordResponse(f)
 
 	if f.Response.StatusCode < 200 || f.Response.StatusCode > 299 {
-		log.Errorf("got invalid response code! '%s' '%v'......\n\n%s", f.Request.URL, f.Response.StatusCode, f.Response.Body)
+		recordError(f, "upstream")
+		// GCS errors are already in the format clients expect, pass them thru untouched.
+		hdl.FlowLogger(f).WithField("status", f.Response.StatusCode).Error("GCS returned an error")
+		return
 	}
 
 	if cfg.GlobalConfig.EncryptDisabled {
 		return
 	}
 
+	// the request went out unencrypted, so the response is plaintext too
+	if hdl.IsFailOpen(f) {
+		return
+	}
+
+	m, op := InterceptGcsMethod(f)
+	if m == passThru {
+		return
+	}
+
+	// GCS compresses JSON responses for clients that accept gzip, the handlers work on the decoded body
+	f.Response.ReplaceToDecodedBody()
+
 out:
-	switch m := InterceptGcsMethod(f); m {
+	switch m {
 
 	case multiPartUpload:
 		err = hdl.HandleMultipartResponse(f)
 		break out
 
 	case simpleDownload:
-		err = hdl.HandleSimpleDownloadResponse(f)
+		err = hdl.HandleSimpleDownloadResponse(f, op)
 		break out
 
 	case singlePartUpload:
 		err = hdl.HandleSinglePartUploadResponse(f)
 		break out
 
-	case metadataRequest:
+	case metadataRequest, metadataUpdate:
 		err = hdl.HandleMetadataResponse(f)
 		break out
 
+	case objectList:
+		err = hdl.HandleObjectListResponse(f, op)
+		break out
+
+	case xmlMetadataRequest:
+		err = hdl.HandleXmlMetadataResponse(f, op)
+		break out
+
 	case resumableUploadPost:
-		err = hdl.HandleResumablePostResponse(f)
+		err = hdl.HandleResumablePostResponse(f, op)
 		break out
 
 	case resumableUploadPut:
@@ -197,25 +298,23 @@ out:
 
 	}
 	if err != nil {
-		f.Response.StatusCode = 500 // set the error to 500
-		f.Response.Body = []byte(err.Error())
-		log.Error(err)
+		hdl.FlowLogger(f).Error(err)
+		// replace the whole response, none of the GCS headers describe the error body
+		gcsErr := util.ToGcsError(err)
+		recordError(f, gcsErr.Reason)
+		errorResponse := newGcsErrorResponse(gcsErr)
+		f.Response.StatusCode = errorResponse.StatusCode
+		f.Response.Header = errorResponse.Header
+		f.Response.Body = errorResponse.Body
 		return
 	}
 
-	// recalculate content length
-	f.Response.ReplaceToDecodedBody()
-}
-func debugResponse(f *proxy.Flow) {
-	header := "<<<" + f.Id.String()
-	log.Debugf("%v url: %v %v", header, f.Request.Method, f.Request.URL.String())
-	log.Debugf("%v body len: %v, ", header, len(f.Response.Body))
-	log.Debugf("%v header: %#v", header, f.Response.Header)
-}
+	// a HEAD response has no body, its Content-Length is the plaintext length of the object
+	if m == xmlMetadataRequest {
+		return
+	}
 
-func debugRequest(f *proxy.Flow) {
-	header := ">>>" + f.Id.String()
-	log.Debugf("%v url: %v %v", header, f.Request.Method, f.Request.URL.String())
-	log.Debugf("%v body len: %v, ", header, len(f.Request.Body))
-	log.Debugf("%v header: %#v", header, f.Request.Header)
+	// recalculate content length, a download may be served gzip encoded so the body is not decoded again
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(f.Response.Body)))
+	f.Response.Header.Del("Transfer-Encoding")
 }
@@ -0,0 +1,180 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// values the response handlers need from the request, by flow id. They are never sent to GCS, so
+// plaintext hashes and names are kept here.
+var flowStates sync.Map
+
+// flowState is deleted by the single goroutine of a flow that waits until it is done, after running the
+// functions registered with OnFlowDone.
+type flowState struct {
+	values sync.Map
+	mutex  sync.Mutex
+	onDone []func()
+}
+
+const (
+	originalMd5HashState = "original-md5-hash"
+	originalCrc32cState  = "original-crc32c"
+	unencryptedSizeState = "unencrypted-size"
+	flowBucketState      = "flow-bucket"
+	flowObjectState      = "flow-object"
+	flowOperationState   = "flow-operation"
+	flowIdentityState    = "flow-identity"
+	traceContextState    = "trace-context"
+	failOpenState        = "fail-open"
+	sessionResourceState = "session-resource"
+	contentEncodingState = "content-encoding" // the client's content encoding of an upload
+)
+
+func setFlowState(f *proxy.Flow, key string, value string) {
+	storeFlowValue(f, key, value)
+}
+
+// getFlowState returns an empty string when the value was not set
+func getFlowState(f *proxy.Flow, key string) string {
+	value, ok := loadFlowValue(f, key)
+	if !ok {
+		return ""
+	}
+	return value.(string)
+}
+
+func storeFlowValue(f *proxy.Flow, key string, value any) {
+	getOrCreateFlowState(f).values.Store(key, value)
+}
+
+func loadFlowValue(f *proxy.Flow, key string) (any, bool) {
+	state, ok := flowStates.Load(f.Id)
+	if !ok {
+		return nil, false
+	}
+	return state.(*flowState).values.Load(key)
+}
+
+// OnFlowDone runs fn once the response of the flow was sent, while the state of the flow can still be read.
+// The functions of a flow run in the order they were registered.
+func OnFlowDone(f *proxy.Flow, fn func()) {
+	state := getOrCreateFlowState(f)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.onDone = append(state.onDone, fn)
+}
+
+func getOrCreateFlowState(f *proxy.Flow) *flowState {
+	state, loaded := flowStates.LoadOrStore(f.Id, &flowState{})
+	if !loaded {
+		go finishFlowState(f, state.(*flowState))
+	}
+	return state.(*flowState)
+}
+
+func finishFlowState(f *proxy.Flow, state *flowState) {
+	<-f.Done()
+	state.mutex.Lock()
+	onDone := state.onDone
+	state.mutex.Unlock()
+	for _, fn := range onDone {
+		fn()
+	}
+	flowStates.Delete(f.Id)
+}
+
+// SetTraceContext keeps the context of the span of the flow, the parent of the spans of the handlers.
+func SetTraceContext(f *proxy.Flow, ctx context.Context) {
+	storeFlowValue(f, traceContextState, ctx)
+}
+
+// GetTraceContext returns the context of the span of the flow, the context of the client request when
+// the flow has no span.
+func GetTraceContext(f *proxy.Flow) context.Context {
+	if ctx, ok := loadFlowValue(f, traceContextState); ok {
+		return ctx.(context.Context)
+	}
+	return f.Request.Raw().Context()
+}
+
+// SetFlowLabels keeps the bucket, object and GCS operation of the client request for the logs and
+// metrics of the flow, the handlers rewrite the request. Metrics are not labeled by object.
+func SetFlowLabels(f *proxy.Flow, bucket string, object string, operation string) {
+	setFlowState(f, flowBucketState, bucket)
+	setFlowState(f, flowObjectState, object)
+	setFlowState(f, flowOperationState, operation)
+}
+
+// labelFlowObject labels a flow whose client request named the object in the body or in a resumable
+// session, handlers see the stored name.
+func labelFlowObject(f *proxy.Flow, bucketName string, objectName string) {
+	if _, object, _ := GetFlowLabels(f); object != "" || objectName == "" {
+		return
+	}
+	setFlowState(f, flowBucketState, bucketName)
+	setFlowState(f, flowObjectState, util.DecryptObjectName(bucketName, objectName))
+}
+
+// SetFailOpen marks a flow whose request a fail open policy forwarded unencrypted, its response is
+// plaintext and is not decrypted. Clients can't set the mark, it is never part of the request.
+func SetFailOpen(f *proxy.Flow) {
+	setFlowState(f, failOpenState, "true")
+}
+
+func IsFailOpen(f *proxy.Flow) bool {
+	return getFlowState(f, failOpenState) != ""
+}
+
+// flowIdentity returns the lookup of the identity of the bearer token of the flow for the audit log, it
+// runs once on the first audited key use of the flow.
+func flowIdentity(f *proxy.Flow) func() string {
+	resolve, _ := getOrCreateFlowState(f).values.LoadOrStore(flowIdentityState, sync.OnceValue(func() string {
+		return audit.Identity(GetTraceContext(f), f.Request.Header.Get("Authorization"))
+	}))
+	return resolve.(func() string)
+}
+
+// GetFlowLabels returns an empty operation when the labels were not set
+func GetFlowLabels(f *proxy.Flow) (bucket string, object string, operation string) {
+	return getFlowState(f, flowBucketState), getFlowState(f, flowObjectState), getFlowState(f, flowOperationState)
+}
+
+// FlowLogger returns a logger whose entries carry the flow id and the labels of the flow.
+func FlowLogger(f *proxy.Flow) *log.Entry {
+	fields := log.Fields{"flow": f.Id.String()}
+	if bucket, object, operation := GetFlowLabels(f); operation != "" {
+		fields["bucket"] = bucket
+		fields["object"] = object
+		fields["operation"] = operation
+	}
+	return log.WithFields(fields)
+}
+
+// flowContext returns the context of the crypto calls of a flow: the span of the flow, the request id,
+// the key the request selected, the labels of the crypto metrics and the subject of the audit records.
+func flowContext(f *proxy.Flow) context.Context {
+	ctx := context.WithValue(GetTraceContext(f), "requestid", f.Id.String())
+	bucket, object, operation := GetFlowLabels(f)
+	if operation != "" {
+		ctx = crypto.WithMetricLabels(ctx, util.MetricBucketLabel(bucket), operation)
+	}
+	ctx = audit.WithSubject(ctx, audit.Subject{
+		ResolveIdentity: flowIdentity(f),
+		Flow:            f.Id.String(),
+		Bucket:          bucket,
+		Object:          object,
+	})
+	return withRequestKey(f, ctx)
+}
@@ -6,9 +6,17 @@ This software is provided as-is, without warranty or representation for any use
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
 )
@@ -29,7 +37,7 @@ func HandleMetadataRequest(f *proxy.Flow) error {
 
 func HandleMetadataResponse(f *proxy.Flow) error {
 
-	log.Debug(fmt.Sprintf("got metadata response: %s", f.Response.Body))
+	log.Debugf("got metadata response len: %v", len(f.Response.Body))
 
 	// Unmarshal the json contents of the first part.
 	var gcsMetadataMap map[string]interface{}
@@ -38,20 +46,172 @@ func HandleMetadataResponse(f *proxy.Flow) error {
 		return fmt.Errorf("error unmarshalling gcsObjectMetadata: %v", err)
 	}
 
-	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
-	if ok {
-		// overwrite the size & hash parameter with the unencrypted size & hash
-		gcsMetadataMap["size"] = customMetadata["x-unencrypted-content-length"]
-		gcsMetadataMap["md5Hash"] = customMetadata["x-md5Hash"]
+	ctxValue := flowContext(f)
+	rewritten, err := rewriteObjectResource(ctxValue, gcsMetadataMap)
+	if err != nil {
+		return err
+	}
 
+	if rewritten {
 		// Now write the gcs object metadata back to the multipart writer
 		jsonData, err := json.MarshalIndent(gcsMetadataMap, "", "\t")
 		if err != nil {
 			return fmt.Errorf("error marshalling gcsObjectMetadata: %v", err)
 		}
 		f.Response.Body = jsonData
-		log.Debug(fmt.Sprintf("rewrote metadata response: %s", f.Response.Body))
+		log.Debugf("rewrote metadata response len: %v", len(f.Response.Body))
+	}
+
+	return nil
+}
+
+// HandleXmlMetadataResponse reports the plaintext length, hash and metadata in the headers of an XML API
+// HEAD response. Objects the proxy did not write and shredded objects are left as is.
+func HandleXmlMetadataResponse(f *proxy.Flow, op *util.GcsOperation) error {
+	header := f.Response.Header
+	keyName := util.GetMetadataHeader(header, "x-encryption-key")
+	if keyName == "" || crypto.IsScopeKeyShredded(keyName) {
+		return nil
+	}
+
+	generation, _ := strconv.ParseInt(header.Get("X-Goog-Generation"), 10, 64)
+	ctxValue := audit.WithGeneration(flowContext(f), generation)
+
+	// x-md5Hash and x-unencrypted-content-length may be encrypted as well
+	err := util.DecryptMetadataHeaders(ctxValue, keyName, op.Bucket, op.Object, header)
+	if err != nil {
+		return err
+	}
+
+	contentLength := util.GetMetadataHeader(header, "x-unencrypted-content-length")
+	header.Set("Content-Length", contentLength)
+	header.Set("X-Goog-Stored-Content-Length", contentLength)
+	// objects written before x-crc32c was stored only report their md5
+	if crc32c := util.GetMetadataHeader(header, "x-crc32c"); crc32c != "" {
+		header.Set("X-Goog-Hash", util.FormatGoogHashHeader(crc32c, util.GetMetadataHeader(header, "x-md5Hash")))
+	} else {
+		header.Set("X-Goog-Hash", "md5="+util.GetMetadataHeader(header, "x-md5Hash"))
 	}
 
+	// the ciphertext is stored without a content encoding, report the one the client uploaded with
+	storedContentEncoding := util.GetMetadataHeader(header, util.ContentEncodingMetadataKey)
+	if storedContentEncoding == "" {
+		storedContentEncoding = "identity"
+	}
+	header.Set("X-Goog-Stored-Content-Encoding", storedContentEncoding)
+	if storedContentEncoding != "identity" {
+		header.Set("Content-Encoding", storedContentEncoding)
+	}
 	return nil
 }
+
+// patch and update requests carry the custom metadata of the object resource, a resumable session start also the name
+func HandleMetadataUpdateRequest(f *proxy.Flow, op *util.GcsOperation) error {
+	if !util.IsMetadataEncrypted(op.Bucket) && !util.IsNameEncrypted(op.Bucket) || len(f.Request.Body) == 0 {
+		return nil
+	}
+
+	var gcsMetadataMap map[string]interface{}
+	err := json.Unmarshal(f.Request.Body, &gcsMetadataMap)
+	if err != nil {
+		return util.NewGcsError(http.StatusBadRequest, "parseError", "error parsing object resource: %v", err)
+	}
+
+	// a resumable session start names the object in the resource
+	objectName := plaintextObjectName(f, op)
+	if name, ok := gcsMetadataMap["name"].(string); ok && objectName == "" {
+		objectName = name
+	}
+	labelFlowObject(f, op.Bucket, objectName)
+	if op.Type == util.ObjectPatch || op.Type == util.ObjectUpdate {
+		// the values of an existing object have to be readable with the key recorded in its metadata
+		err = useRecordedKey(f, op)
+	} else {
+		err = resolveScopeKey(f, op.Bucket, objectName)
+	}
+	if err != nil {
+		return err
+	}
+
+	// metadata values are bound to the stored name, encrypt the name first
+	err = util.EncryptResourceName(op.Bucket, gcsMetadataMap)
+	if err != nil {
+		return err
+	}
+	ctxValue := flowContext(f)
+	err = util.EncryptObjectMetadata(ctxValue, op.Bucket, storedObjectName(op, gcsMetadataMap), gcsMetadataMap)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(gcsMetadataMap)
+	if err != nil {
+		return fmt.Errorf("error marshalling gcsObjectMetadata: %v", err)
+	}
+	f.Request.Body = jsonData
+	f.Request.Header.Set("Content-Length", strconv.Itoa(len(jsonData)))
+	return nil
+}
+
+// useRecordedKey selects the x-encryption-key of the object a patch or update request changes. Objects
+// without one, or whose scope key was shredded, can't get encrypted values.
+func useRecordedKey(f *proxy.Flow, op *util.GcsOperation) error {
+	attrs, err := util.GetObjectAttrs(flowContext(f), op.Bucket, op.Object, op.Generation)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return util.NewGcsError(http.StatusNotFound, "notFound", "No such object: %v/%v", op.Bucket, plaintextObjectName(f, op))
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the encryption key of the object: %w", err)
+	}
+
+	keyName := attrs.Metadata["x-encryption-key"]
+	if keyName == "" || crypto.IsScopeKeyShredded(keyName) {
+		return util.NewGcsError(http.StatusBadRequest, "invalid",
+			"the encryption key of %v/%v can't be determined, its metadata can't be encrypted", op.Bucket, plaintextObjectName(f, op))
+	}
+	setFlowState(f, requestKeyState, keyName)
+	return nil
+}
+
+// rewriteObjectResource reports the plaintext size, hash, content encoding and metadata of an object
+// resource returned by GCS. Objects the proxy did not write are left as is.
+func rewriteObjectResource(ctx context.Context, gcsMetadataMap map[string]interface{}) (bool, error) {
+	// metadata values are bound to the stored name
+	bucketName, _ := gcsMetadataMap["bucket"].(string)
+	storedName, _ := gcsMetadataMap["name"].(string)
+	nameDecrypted := util.DecryptResourceName(gcsMetadataMap)
+
+	// a listing decrypts the metadata of many objects, each is audited as itself
+	objectName, _ := gcsMetadataMap["name"].(string)
+	generation, _ := strconv.ParseInt(fmt.Sprint(gcsMetadataMap["generation"]), 10, 64)
+	ctx = audit.WithObject(ctx, bucketName, objectName, generation)
+
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	if !ok {
+		return nameDecrypted, nil
+	}
+
+	// x-md5Hash and x-unencrypted-content-length may be encrypted as well, decrypt before they are reported
+	err := util.DecryptObjectMetadata(ctx, bucketName, storedName, gcsMetadataMap)
+	if err != nil {
+		return false, err
+	}
+
+	// overwrite the size & hash parameter with the unencrypted size & hash, shredded objects have neither
+	if keyName, ok := customMetadata["x-encryption-key"].(string); ok && !crypto.IsScopeKeyShredded(keyName) {
+		gcsMetadataMap["size"] = customMetadata["x-unencrypted-content-length"]
+		gcsMetadataMap["md5Hash"] = customMetadata["x-md5Hash"]
+		// the crc32c of the ciphertext would fail the client's check, objects without x-crc32c don't report one
+		if crc32c, ok := customMetadata["x-crc32c"]; ok {
+			gcsMetadataMap["crc32c"] = crc32c
+		} else {
+			delete(gcsMetadataMap, "crc32c")
+		}
+	}
+
+	// the ciphertext is stored without a content encoding, report the one the client uploaded with
+	if contentEncoding, ok := customMetadata[util.ContentEncodingMetadataKey]; ok {
+		gcsMetadataMap["contentEncoding"] = contentEncoding
+	}
+	return true, nil
+}
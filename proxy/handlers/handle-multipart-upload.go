@@ -7,7 +7,6 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -43,7 +42,7 @@ func GetMultipartMimeHeader(part *multipart.Part) textproto.MIMEHeader {
 	return mimeHeader
 }
 
-func HandleMultipartRequest(f *proxy.Flow) error {
+func HandleMultipartRequest(f *proxy.Flow, op *util.GcsOperation) error {
 
 	// Extract the boundary from the Content-Type header.
 	contentType := f.Request.Header.Get("Content-Type")
@@ -115,9 +114,27 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 		gcsMetadataMap["metadata"] = make(map[string]interface{})
 	}
 
+	// client hashes in the object resource take priority over the X-Goog-Hash header
+	clientChecksums := util.GetClientChecksumsFromGcsMetadata(gcsMetadataMap).
+		Merge(util.GetClientChecksumsFromHeader(f.Request.Header))
+
 	bucketName := util.GetBucketNameFromGcsMetadata(gcsMetadataMap)
 	if bucketName == "" {
-		bucketName = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+		bucketName = op.Bucket
+	}
+	objectName, _ := gcsMetadataMap["name"].(string)
+	if objectName == "" {
+		objectName = plaintextObjectName(f, op)
+	}
+	labelFlowObject(f, bucketName, objectName)
+	err = resolveScopeKey(f, bucketName, objectName)
+	if err != nil {
+		return err
+	}
+
+	// GCS can't transcode ciphertext, keep the client's content encoding in the custom metadata instead
+	if contentEncoding := util.MoveContentEncodingToMetadata(gcsMetadataMap, f.Request.URL); contentEncoding != "" {
+		setFlowState(f, contentEncodingState, contentEncoding)
 	}
 
 	//Grab the second part. this contains the unencrypted file content
@@ -136,16 +153,33 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 			return fmt.Errorf("error reading  multipart request: %v", err)
 		}
 
+		// verify the client hashes against the plaintext before we encrypt anything
+		err = clientChecksums.Verify(unencryptedFileContent.Bytes())
+		if err != nil {
+			return err
+		}
+
+		// ciphertext doesn't compress, so compress first if the bucket asks for it
+		payload, err := util.CompressPayload(bucketName, gcsMetadataMap, unencryptedFileContent.Bytes())
+		if err != nil {
+			return fmt.Errorf("error compressing request: %w", err)
+		}
+
+		// pad after compressing, the padding would compress away
+		payload, err = util.PadPayload(bucketName, gcsMetadataMap, payload)
+		if err != nil {
+			return fmt.Errorf("error padding request: %w", err)
+		}
+
 		// Encrypt the intercepted file
 
-		ctx := f.Request.Raw().Context()
-		ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
+		ctxValue := flowContext(f)
 		encryptedData, err = crypto.EncryptBytes(ctxValue,
-			util.GetKMSKeyName(bucketName),
-			unencryptedFileContent.Bytes())
+			util.GetRequestKMSKeyName(ctxValue, bucketName),
+			payload)
 
 		if err != nil {
-			return fmt.Errorf("error encrypting  request: %v", err)
+			return fmt.Errorf("error encrypting  request: %w", err)
 		}
 
 	}
@@ -154,20 +188,35 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 	/// Create multipart request
 	///
 	///
+	ctxValue := flowContext(f)
+
 	// TODO move this into its own method
 	// Access and modify the nested value dynamically
 	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
 	if ok {
 
-		customMetadata["x-unencrypted-content-length"] = len(unencryptedFileContent.String())
+		customMetadata["x-unencrypted-content-length"] = strconv.Itoa(unencryptedFileContent.Len())
 		customMetadata["x-md5Hash"] = crypto.Base64MD5Hash(unencryptedFileContent.Bytes())
-		customMetadata["x-encryption-key"] = util.GetKMSKeyName(bucketName)
+		customMetadata["x-crc32c"] = crypto.Base64Crc32cHash(unencryptedFileContent.Bytes())
+		customMetadata["x-encryption-key"] = util.GetRequestKMSKeyName(ctxValue, bucketName)
 		customMetadata["x-proxy-version"] = cfg.GlobalConfig.GCSProxyVersion
 	}
 
-	log.Debug(string(gcsObjectMetadataJson))
-	log.Debug(gcsMetadata)
-	log.Debug(fmt.Errorf("got metadata: %s", gcsObjectMetadataJson))
+	// the name and custom metadata values are stored encrypted too if the bucket asks for it
+	err = util.EncryptResourceName(bucketName, gcsMetadataMap)
+	if err != nil {
+		return err
+	}
+	err = util.EncryptObjectMetadata(ctxValue, bucketName, storedObjectName(op, gcsMetadataMap), gcsMetadataMap)
+	if err != nil {
+		return err
+	}
+
+	// the plaintext hashes were verified above, have GCS verify the ciphertext instead
+	util.SetCiphertextChecksums(gcsMetadataMap, encryptedData)
+	f.Request.Header.Del("X-Goog-Hash")
+
+	log.Debugf("got metadata part len: %v", len(gcsObjectMetadataJson))
 
 	// Now write the gcs object metadata back to the multipart writer
 	newGcsMetadataJson, err := json.Marshal(gcsMetadata)
@@ -175,7 +224,7 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 	if err != nil {
 		return fmt.Errorf("error marshalling gcsObjectMetadata: %v", err)
 	}
-	log.Debug(fmt.Errorf("rewrote json data to: %s", newGcsMetadataJson))
+	log.Debugf("rewrote metadata part len: %v", len(newGcsMetadataJson))
 
 	writer_part.Write(newGcsMetadataJson)
 
@@ -193,22 +242,15 @@ func HandleMultipartRequest(f *proxy.Flow) error {
 
 	multipartWriter.Close()
 
-	// Save the original content length for rewriting when download.
-	f.Request.Header.Set("gcs-proxy-original-content-length",
-		f.Request.Header.Get("Content-Length"))
-
-	f.Request.Header.Set("gcs-proxy-unencrypted-file-size",
-		strconv.Itoa(unencryptedFileContent.Len()))
-
-	log.Trace(unencryptedFileContent)
-	log.Trace(encryptedRequest)
+	// the plaintext size is only reported to the client, padded buckets don't reveal it to GCS
+	setFlowState(f, unencryptedSizeState, strconv.Itoa(unencryptedFileContent.Len()))
 
 	// update the body to the newly encrypted request
 	f.Request.Body = encryptedRequest.Bytes()
 
 	// save the original md5 has or gsutil/gcloud will delete after upload if it sees it is different
-	f.Request.Header.Set("gcs-proxy-original-md5-hash",
-		crypto.Base64MD5Hash(unencryptedFileContent.Bytes()))
+	setFlowState(f, originalMd5HashState, crypto.Base64MD5Hash(unencryptedFileContent.Bytes()))
+	setFlowState(f, originalCrc32cState, crypto.Base64Crc32cHash(unencryptedFileContent.Bytes()))
 
 	return nil
 }
@@ -222,14 +264,19 @@ func HandleMultipartResponse(f *proxy.Flow) error {
 	if err != nil {
 		return fmt.Errorf("error unmarshalling JSON: %v", err)
 	}
-	log.Debug(jsonResponse)
 
 	// update the response with the orginal md5 hash so gsutil/gcloud does not complain
-	jsonResponse["md5Hash"] = f.Request.Header.Get("gcs-proxy-original-md5-hash")
-	jsonResponse["size"], err = strconv.Atoi(f.Request.Header.Get("gcs-proxy-unencrypted-file-size"))
+	jsonResponse["md5Hash"] = getFlowState(f, originalMd5HashState)
+	jsonResponse["crc32c"] = getFlowState(f, originalCrc32cState)
+	jsonResponse["size"], err = strconv.Atoi(getFlowState(f, unencryptedSizeState))
 	if err != nil {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
+	setContentEncodingResponse(f, jsonResponse)
+	err = decryptUploadResponseMetadata(f, jsonResponse)
+	if err != nil {
+		return err
+	}
 
 	jsonData, err := json.Marshal(jsonResponse)
 	if err != nil {
@@ -0,0 +1,63 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// the objects of a list page whose metadata is decrypted at the same time
+const listDecryptConcurrency = 8
+
+func HandleObjectListResponse(f *proxy.Flow, op *util.GcsOperation) error {
+
+	var jsonResponse map[string]interface{}
+	// turn the response body into a dynamic json map we can use
+	err := json.Unmarshal(f.Response.Body, &jsonResponse)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling object list: %v", err)
+	}
+
+	// no items when there are only prefixes or the bucket is empty
+	items, _ := jsonResponse["items"].([]interface{})
+
+	// objects written with different DEKs each unwrap theirs, bound the KMS calls of a page in flight
+	group, ctxValue := errgroup.WithContext(flowContext(f))
+	group.SetLimit(listDecryptConcurrency)
+	for _, item := range items {
+		gcsMetadataMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group.Go(func() error {
+			_, err := rewriteObjectResource(ctxValue, gcsMetadataMap)
+			if err != nil {
+				return fmt.Errorf("error rewriting gs://%v/%v: %w", gcsMetadataMap["bucket"], gcsMetadataMap["name"], err)
+			}
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
+
+	filterListResponse(f, op, jsonResponse)
+
+	jsonData, err := json.Marshal(jsonResponse)
+	if err != nil {
+		return fmt.Errorf("error marshalling object list: %v", err)
+	}
+	f.Response.Body = jsonData
+	log.Debugf("rewrote %v objects in list response", len(items))
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	listPrefixState      = "list-prefix"
+	plaintextObjectState = "plaintext-object"
+)
+
+// list parameters that compare names, they can't be evaluated on encrypted names
+var unsupportedListParams = []string{"startOffset", "endOffset", "matchGlob"}
+
+// HandleObjectNamesRequest replaces the plaintext object names of a request to a bucket with encrypted
+// names. It runs before the other handlers, so they only see the stored names.
+func HandleObjectNamesRequest(f *proxy.Flow, op *util.GcsOperation) error {
+	if op == nil || !util.IsNameEncrypted(op.Bucket) {
+		return nil
+	}
+
+	if op.Object != "" {
+		encryptedName, err := util.EncryptObjectName(op.Bucket, op.Object)
+		if err != nil {
+			return err
+		}
+		// key scopes match the plaintext name
+		setFlowState(f, plaintextObjectState, op.Object)
+		op.SetObject(f.Request, encryptedName)
+	}
+
+	if op.DestinationObject != "" && util.IsNameEncrypted(op.DestinationBucket) {
+		encryptedName, err := util.EncryptObjectName(op.DestinationBucket, op.DestinationObject)
+		if err != nil {
+			return err
+		}
+		op.SetDestinationObject(f.Request, encryptedName)
+	}
+
+	if op.Type == util.ObjectList {
+		return encryptListQuery(f, op)
+	}
+	return nil
+}
+
+// plaintextObjectName returns the object name of op as the client sent it, HandleObjectNamesRequest
+// replaced it with the stored name.
+func plaintextObjectName(f *proxy.Flow, op *util.GcsOperation) string {
+	if objectName := getFlowState(f, plaintextObjectState); objectName != "" {
+		return objectName
+	}
+	return op.Object
+}
+
+func encryptListQuery(f *proxy.Flow, op *util.GcsOperation) error {
+	query := f.Request.URL.Query()
+
+	for _, param := range unsupportedListParams {
+		if query.Has(param) {
+			return util.NewGcsError(http.StatusBadRequest, "invalid", "%v is not supported in buckets with encrypted object names", param)
+		}
+	}
+	// each path segment is encrypted on its own, so only "/" still separates the stored names
+	if delimiter := query.Get("delimiter"); delimiter != "" && delimiter != "/" {
+		return util.NewGcsError(http.StatusBadRequest, "invalid", "delimiter '%v' is not supported in buckets with encrypted object names, use '/'", delimiter)
+	}
+
+	prefix := query.Get("prefix")
+	if prefix == "" {
+		return nil
+	}
+	encryptedPrefix, partialSegment, err := util.EncryptListPrefix(op.Bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if encryptedPrefix == "" {
+		query.Del("prefix")
+	} else {
+		query.Set("prefix", encryptedPrefix)
+	}
+	f.Request.URL.RawQuery = query.Encode()
+
+	if partialSegment != "" {
+		// the plaintext prefix is needed to filter the response but must not be sent to GCS
+		setFlowState(f, listPrefixState, prefix)
+	}
+	return nil
+}
+
+// filterListResponse drops the objects and prefixes that don't match the partial segment of the list prefix.
+func filterListResponse(f *proxy.Flow, op *util.GcsOperation, jsonResponse map[string]interface{}) {
+	if !util.IsNameEncrypted(op.Bucket) {
+		return
+	}
+
+	if prefixes, ok := jsonResponse["prefixes"].([]interface{}); ok {
+		for i, prefix := range prefixes {
+			if stringPrefix, ok := prefix.(string); ok {
+				prefixes[i] = util.DecryptObjectName(op.Bucket, stringPrefix)
+			}
+		}
+	}
+
+	prefix := getFlowState(f, listPrefixState)
+	if prefix == "" {
+		return
+	}
+
+	if items, ok := jsonResponse["items"].([]interface{}); ok {
+		filteredItems := []interface{}{}
+		for _, item := range items {
+			gcsMetadataMap, _ := item.(map[string]interface{})
+			if name, _ := gcsMetadataMap["name"].(string); strings.HasPrefix(name, prefix) {
+				filteredItems = append(filteredItems, item)
+			}
+		}
+		jsonResponse["items"] = filteredItems
+	}
+
+	if prefixes, ok := jsonResponse["prefixes"].([]interface{}); ok {
+		filteredPrefixes := []interface{}{}
+		for _, listPrefix := range prefixes {
+			if stringPrefix, _ := listPrefix.(string); strings.HasPrefix(stringPrefix, prefix) {
+				filteredPrefixes = append(filteredPrefixes, listPrefix)
+			}
+		}
+		jsonResponse["prefixes"] = filteredPrefixes
+	}
+	log.Debugf("filtered list response to prefix %v", prefix)
+}
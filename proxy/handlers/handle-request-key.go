@@ -0,0 +1,57 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"context"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const requestKeyState = "request-key"
+
+// HandleRequestKey validates the key a request selects with the x-gcsproxy-key header and removes the
+// header, GCS never sees it. It runs before the other handlers so writes encrypt with the selected key.
+func HandleRequestKey(f *proxy.Flow, op *util.GcsOperation) error {
+	if op == nil {
+		return nil
+	}
+
+	keyName, err := util.SelectRequestKey(f.Request.Header, op.Bucket)
+	if err != nil || keyName == "" {
+		return err
+	}
+	log.Debugf("request selected key '%v' for bucket '%v'", keyName, op.Bucket)
+	setFlowState(f, requestKeyState, keyName)
+	return nil
+}
+
+// resolveScopeKey selects the key of the key scope objectName is in, it is wrapped with the key the
+// request selected or the key of the bucket. A scope key selected when a resumable session started is kept.
+func resolveScopeKey(f *proxy.Flow, bucketName string, objectName string) error {
+	if objectName == "" || crypto.IsScopeKey(getFlowState(f, requestKeyState)) {
+		return nil
+	}
+
+	keyName, err := util.GetScopeKeyName(flowContext(f), bucketName, objectName)
+	if err != nil || keyName == "" {
+		return err
+	}
+	log.Debugf("gs://%v/%v is encrypted with scope key '%v'", bucketName, objectName, keyName)
+	setFlowState(f, requestKeyState, keyName)
+	return nil
+}
+
+// withRequestKey adds the key selected by the request to ctx, encryption uses the key of the bucket without it.
+func withRequestKey(f *proxy.Flow, ctx context.Context) context.Context {
+	if keyName := getFlowState(f, requestKeyState); keyName != "" {
+		return util.WithRequestKey(ctx, keyName)
+	}
+	return ctx
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+const testVaultKey = "vault-transit://transit/k"
+
+func TestScopeKeyOfEncryptedName(t *testing.T) {
+	// the fake Vault Transit "ciphertext" is the plaintext behind the vault prefix
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		data := map[string]string{}
+		if strings.HasPrefix(r.URL.Path, "/v1/transit/encrypt/") {
+			data["ciphertext"] = "vault:v1:" + request["plaintext"]
+		} else {
+			data["plaintext"] = strings.TrimPrefix(request["ciphertext"], "vault:v1:")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer vault.Close()
+	crypto.ConfigureVault(crypto.VaultConfig{Addr: vault.URL, Token: "token"})
+
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{
+		KmsBucketKeyMapping: map[string]string{"bkt": testVaultKey},
+		EncryptNamesBuckets: map[string]bool{"bkt": true},
+		KeyScopes:           map[string][]string{"bkt": {"tenants/*/"}},
+	}
+	crypto.ConfigureKeyRegistry(filepath.Join(t.TempDir(), "keys.json"))
+	defer func() {
+		cfg.GlobalConfig = previous
+		crypto.ConfigureKeyRegistry("")
+	}()
+	keysetPath := filepath.Join(t.TempDir(), "names.json")
+	if err := crypto.GenerateNameKeyset(context.Background(), keysetPath, testVaultKey); err != nil {
+		t.Fatalf("GenerateNameKeyset() error = %v", err)
+	}
+	if err := crypto.LoadNameKeyset(context.Background(), keysetPath, testVaultKey); err != nil {
+		t.Fatalf("LoadNameKeyset() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		scopeKey bool
+	}{
+		{
+			name:     "media upload",
+			method:   "POST",
+			url:      "https://storage.googleapis.com/upload/storage/v1/b/bkt/o?uploadType=media&name=tenants/acme/a.txt",
+			body:     "data",
+			scopeKey: true,
+		},
+		{
+			name:   "media upload outside of the scopes",
+			method: "POST",
+			url:    "https://storage.googleapis.com/upload/storage/v1/b/bkt/o?uploadType=media&name=other/a.txt",
+			body:   "data",
+		},
+		{
+			name:     "resumable session with the name in the query",
+			method:   "POST",
+			url:      "https://storage.googleapis.com/upload/storage/v1/b/bkt/o?uploadType=resumable&name=tenants/acme/a.txt",
+			body:     `{"contentType":"text/plain"}`,
+			scopeKey: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestURL, _ := url.Parse(test.url)
+			f := &proxy.Flow{
+				Id:      uuid.NewV4(),
+				Request: &proxy.Request{Method: test.method, URL: requestURL, Header: http.Header{}, Body: []byte(test.body)},
+			}
+			// the flow has no client request to take the context from
+			SetTraceContext(f, context.Background())
+			op := util.RouteGcsRequest(f.Request)
+			if err := HandleObjectNamesRequest(f, op); err != nil {
+				t.Fatalf("HandleObjectNamesRequest() error = %v", err)
+			}
+			if strings.HasPrefix(op.Object, "tenants/") {
+				t.Fatalf("object name %v was not encrypted", op.Object)
+			}
+			var err error
+			switch op.Type {
+			case util.ResumableUploadStart:
+				err = HandleResumablePostRequest(f, op)
+			default:
+				err = ConvertSinglePartUploadtoMultiPartUpload(f, op, nil)
+			}
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if keyName := getFlowState(f, requestKeyState); crypto.IsScopeKey(keyName) != test.scopeKey {
+				t.Errorf("request key = %q, want a scope key %v", keyName, test.scopeKey)
+			}
+		})
+	}
+}
@@ -13,12 +13,59 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
 )
 
+// headers of the resumable session start that apply to the upload as a whole
+var resumableSessionHeaders = []string{
+	"X-Goog-User-Project",
+	"X-Goog-If-Generation-Match",
+	"X-Goog-If-Generation-Not-Match",
+	"X-Goog-If-Metageneration-Match",
+	"X-Goog-If-Metageneration-Not-Match",
+	"X-Upload-Content-Type",
+}
+
+// GCS expires resumable sessions after a week
+const resumableSessionLifetime = 7 * 24 * time.Hour
+
+// the plaintext object resources of resumable sessions by upload id. They are kept in memory, the session
+// file is written to disk.
+var sessionResources = struct {
+	sync.Mutex
+	resources map[string]sessionResource
+}{resources: map[string]sessionResource{}}
+
+type sessionResource struct {
+	resource string
+	started  time.Time
+}
+
+func storeSessionResource(uploadId string, resource string) {
+	sessionResources.Lock()
+	defer sessionResources.Unlock()
+	// sessions that are never uploaded to would stay forever
+	for id, entry := range sessionResources.resources {
+		if time.Since(entry.started) > resumableSessionLifetime {
+			delete(sessionResources.resources, id)
+		}
+	}
+	sessionResources.resources[uploadId] = sessionResource{resource: resource, started: time.Now()}
+}
+
+func loadSessionResource(uploadId string) string {
+	sessionResources.Lock()
+	defer sessionResources.Unlock()
+	entry := sessionResources.resources[uploadId]
+	delete(sessionResources.resources, uploadId)
+	return entry.resource
+}
+
 // this is the raw data to be encoded.
 func HandleResumablePutRequest(f *proxy.Flow) error {
 
@@ -44,15 +91,57 @@ func HandleResumablePutRequest(f *proxy.Flow) error {
 	if err != nil {
 		return fmt.Errorf("error Loading Resumable Data: %v", err)
 	}
+	labelFlowObject(f, resumeData["bucket"], resumeData["name"])
+	// the session stored the name as it was sent to GCS, key scopes match the plaintext name
+	setFlowState(f, plaintextObjectState, util.DecryptObjectName(resumeData["bucket"], resumeData["name"]))
+
+	// the key selected when the session started encrypts the upload
+	if keyName := resumeData[requestKeyState]; keyName != "" {
+		setFlowState(f, requestKeyState, keyName)
+	}
+
+	// hashes sent with the resumable session metadata cover the whole object
+	resumeChecksums := util.ClientChecksums{Md5Hash: resumeData["md5Hash"], Crc32c: resumeData["crc32c"]}
+	err = resumeChecksums.Verify(f.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	// the session start carried the preconditions, predefinedAcl, userProject etc. repeat them on the upload
+	query, err := url.ParseQuery(resumeData["query"])
+	if err != nil {
+		return fmt.Errorf("error parsing resumable session query string: %w", err)
+	}
+	query.Set("name", resumeData["name"])
+
+	// the object resource the session started with in plaintext, it is encrypted with the upload
+	var resource map[string]interface{}
+	if sessionResource := loadSessionResource(uploadId); sessionResource != "" {
+		err = json.Unmarshal([]byte(sessionResource), &resource)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling resumable session resource: %w", err)
+		}
+	}
 
-	url, err := url.Parse(fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%v/o?name=%v", resumeData["bucket"], resumeData["name"]))
+	// keep the endpoint the client used, it may be a regional or custom endpoint
+	url, err := url.Parse(fmt.Sprintf("%v://%v/upload/storage/v1/b/%v/o?%v", f.Request.URL.Scheme, f.Request.URL.Host, url.PathEscape(resumeData["bucket"]), query.Encode()))
 	if err != nil {
-		panic(err) // Handle the error appropriately in a real application
+		return fmt.Errorf("error building upload url: %w", err)
 	}
 	f.Request.URL = url
 
-	ConvertSinglePartUploadtoMultiPartUpload(f)
-	return nil
+	for _, header := range resumableSessionHeaders {
+		if value := resumeData[header]; value != "" && f.Request.Header.Get(header) == "" {
+			f.Request.Header.Set(header, value)
+		}
+	}
+	// the content type of the object was set when the session started
+	if contentType := resumeData["X-Upload-Content-Type"]; contentType != "" {
+		f.Request.Header.Set("Content-Type", contentType)
+	}
+
+	uploadOp := &util.GcsOperation{Type: util.MediaUpload, Bucket: resumeData["bucket"], Object: resumeData["name"]}
+	return ConvertSinglePartUploadtoMultiPartUpload(f, uploadOp, resource)
 }
 
 // TODO eshen remove the function if it's not needed
@@ -68,11 +157,11 @@ func HandleResumablePutResponse(f *proxy.Flow) error {
 	if err != nil {
 		return fmt.Errorf("error unmarshalling JSON: %v", err)
 	}
-	log.Debug(jsonResponse)
 
 	// update the response with the original md5 hash so gsutil/gcloud does not complain
-	jsonResponse["md5Hash"] = f.Request.Header.Get("gcs-proxy-original-md5-hash")
-	jsonResponse["size"], err = strconv.Atoi(f.Request.Header.Get("gcs-proxy-unencrypted-file-size"))
+	jsonResponse["md5Hash"] = getFlowState(f, originalMd5HashState)
+	jsonResponse["crc32c"] = getFlowState(f, originalCrc32cState)
+	jsonResponse["size"], err = strconv.Atoi(getFlowState(f, unencryptedSizeState))
 	if err != nil {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
@@ -114,17 +203,22 @@ func parseContentRangeHeader(rangeStr string) (start int, end int, size int, err
 	return rStart, rEnd, rTotal, nil
 }
 
-func HandleResumablePostRequest(f *proxy.Flow) error {
+func HandleResumablePostRequest(f *proxy.Flow, op *util.GcsOperation) error {
 	// strip X-upload-content-length
 	f.Request.Header.Del("x-upload-content-length")
 	f.Request.Header.Del("X-Upload-Content-Length")
-	return nil //do nothing
+
+	// the resource is encrypted again when the upload is converted to multipart, keep it in plaintext
+	setFlowState(f, sessionResourceState, string(f.Request.Body))
+
+	// the session start carries the custom metadata, don't send it to GCS in plaintext
+	return HandleMetadataUpdateRequest(f, op)
 }
 
-func HandleResumablePostResponse(f *proxy.Flow) error {
+func HandleResumablePostResponse(f *proxy.Flow, op *util.GcsOperation) error {
 
 	// the client posts the file name in the request body. store that and other info in our session file.
-	log.Debugf("HandleResumablePostResponse Request.Body: %s", f.Request.Body)
+	log.Debugf("HandleResumablePostResponse Request.Body len: %v", len(f.Request.Body))
 
 	dataMap := map[string]string{}
 
@@ -132,16 +226,38 @@ func HandleResumablePostResponse(f *proxy.Flow) error {
 		dataMap["name"] = f.Request.URL.Query().Get("name")
 	} else {
 		// Unmarshal the json contents of the first part.
-		err := json.Unmarshal(f.Request.Body, &dataMap)
+		var gcsMetadataMap map[string]interface{}
+		err := json.Unmarshal(f.Request.Body, &gcsMetadataMap)
 		if err != nil {
 			return fmt.Errorf("error unmarshalling gcsObjectMetadata in HandleResumablePostResponse: %v", err)
 		}
+		// the top level strings are used to rebuild the upload url
+		for key, value := range gcsMetadataMap {
+			if stringValue, ok := value.(string); ok {
+				dataMap[key] = stringValue
+			}
+		}
+		if dataMap["name"] == "" {
+			dataMap["name"] = f.Request.URL.Query().Get("name")
+		}
+	}
+
+	// query parameters and headers that have to be repeated when the upload is converted to multipart
+	dataMap["query"] = f.Request.URL.RawQuery
+	for _, header := range resumableSessionHeaders {
+		if value := f.Request.Header.Get(header); value != "" {
+			dataMap[header] = value
+		}
 	}
 
+	// the key header was removed from the request, the upload itself comes without it. Always set, so
+	// a field of the same name in the resource can't select a key.
+	dataMap[requestKeyState] = getFlowState(f, requestKeyState)
+
 	// Check if request body has bucket name as pythonsdk does not give bucket name, coming from python sdk
 	_, exists := dataMap["bucket"]
 	if !exists {
-		dataMap["bucket"] = util.GetBucketNameFromRequestUri(f.Request.URL.Path)
+		dataMap["bucket"] = op.Bucket
 	}
 
 	// uploader id comes from GCS so it is in the Response
@@ -150,8 +266,11 @@ func HandleResumablePostResponse(f *proxy.Flow) error {
 		return fmt.Errorf("missing X-GUploader-UploadID header")
 	}
 
-	StoreResumableData(uploaderId, dataMap)
-	return nil
+	// the whole resource, including custom metadata, is applied when the upload is converted to multipart
+	if resource := getFlowState(f, sessionResourceState); resource != "" {
+		storeSessionResource(uploaderId, resource)
+	}
+	return StoreResumableData(uploaderId, dataMap)
 }
 
 // writes data to a file by id
@@ -160,8 +279,8 @@ func StoreResumableData(id string, dataMap map[string]string) error {
 	// use /tmp
 	filePath := fmt.Sprintf("/tmp/go-gcsproxy-%s.json", id)
 
-	// Open the file for writing (creates the file if it doesn't exist)
-	file, err := os.Create(filePath)
+	// Open the file for writing (creates the file if it doesn't exist), only the proxy may read it
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("error creating file in StoreResumableData: %v", err)
 	}
@@ -182,7 +301,7 @@ func StoreResumableData(id string, dataMap map[string]string) error {
 	// Flush any buffered data to the file
 	file.Sync()
 
-	log.Debug(fmt.Sprintf("wrote ResumableData: %s", jsonData))
+	log.Debugf("wrote ResumableData len: %v", len(jsonData))
 	return nil
 }
 
@@ -217,6 +336,6 @@ func LoadResumableData(id string) (map[string]string, error) {
 		return nil, fmt.Errorf("error unmarshalling ResumableData: %v", err)
 	}
 
-	log.Debug(fmt.Sprintf("read ResumableData: %s", data))
+	log.Debugf("read ResumableData len: %v", len(data))
 	return dataMap, nil
 }
@@ -7,40 +7,64 @@ package handlers
 
 import (
 	"bytes"
-	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/byronwhitlock-google/go-gcsproxy/audit"
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
 	"github.com/byronwhitlock-google/go-gcsproxy/util"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	log "github.com/sirupsen/logrus"
 )
 
-// rangeString = "bytes=0-72355493"
-func parseRangeHeader(header string) (start int, end int, err error) {
-	parts := strings.Split(header, "=")
-	if len(parts) != 2 {
+// errRangeNotSatisfiable is a well formed range that starts after the last byte of the object
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRangeHeader returns the first and last byte of a single range of an object of size bytes:
+// "bytes=0-72355493", "bytes=100-" to the end or "bytes=-100" for the last 100 bytes. A last byte
+// past the end is the end of the object.
+func parseRangeHeader(header string, size int) (start int, end int, err error) {
+	rangeSpec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
 		return 0, 0, fmt.Errorf("invalid Range header format")
 	}
 
-	rangeValues := strings.Split(parts[1], "-")
-	if len(rangeValues) != 2 {
+	startValue, endValue, ok := strings.Cut(rangeSpec, "-")
+	if !ok || (startValue == "" && endValue == "") {
 		return 0, 0, fmt.Errorf("invalid Range header format")
 	}
 
-	s, err := strconv.Atoi(rangeValues[0])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid start value: %w", err)
+	if startValue == "" {
+		suffix, err := strconv.Atoi(endValue)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("invalid suffix length: %v", endValue)
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return max(size-suffix, 0), size - 1, nil
 	}
 
-	e, err := strconv.Atoi(rangeValues[1])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid end value: %w", err)
+	start, err = strconv.Atoi(startValue)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid start value: %v", startValue)
 	}
 
-	return s, e, nil
+	end = size - 1
+	if endValue != "" {
+		end, err = strconv.Atoi(endValue)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid end value: %v", endValue)
+		}
+	}
+
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return start, min(end, size-1), nil
 }
 
 func HandleSimpleDownloadRequest(f *proxy.Flow) error {
@@ -54,51 +78,96 @@ func HandleSimpleDownloadRequest(f *proxy.Flow) error {
 	return nil
 }
 
-func HandleSimpleDownloadResponse(f *proxy.Flow) error {
+func HandleSimpleDownloadResponse(f *proxy.Flow, op *util.GcsOperation) error {
 	log.Debugf("encrypted content len :%v", len(f.Response.Body))
 
-	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-	objectName := util.GetObjectNameFromRequestUri(f.Request.URL.Path)
-	keyID,err := util.GetObjectEncryptionKeyId(f.Request.Raw().Context(), bucketName, objectName)
-	
+	bucketName := op.Bucket
+	objectName := op.Object
+	// the custom metadata of the generation that was downloaded comes with it in the x-goog-meta-* headers,
+	// looking it up again could see another generation and would use the proxy's credentials
+	keyID := util.GetMetadataHeader(f.Response.Header, "x-encryption-key")
+	generation, _ := strconv.ParseInt(f.Response.Header.Get("X-Goog-Generation"), 10, 64)
+	ctxValue := audit.WithGeneration(flowContext(f), generation)
+
 	log.Debug(bucketName, objectName, keyID)
 	// Update the response content with the decrypted content
-	ctx := f.Request.Raw().Context()
-	ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
 	unencryptedBytes, err := crypto.DecryptBytes(ctxValue,
 		keyID,
 		f.Response.Body)
 	if err != nil {
-		return fmt.Errorf("unable to decrypt response body:%v", err)
+		return fmt.Errorf("unable to decrypt response body:%w", err)
 
 	}
 
-	// check if this was as streaming/chunked download
-	byteRangeHeader := f.Request.Header.Get("x-original-byte-range")
-
-	if byteRangeHeader != "" {
-		log.Debugf("Grabbing requested byte range slice %v", byteRangeHeader)
-		start, end, err := parseRangeHeader(byteRangeHeader)
+	// x-goog-meta-* and Content-Disposition headers carry the encrypted metadata values
+	err = util.DecryptMetadataHeaders(ctxValue, keyID, bucketName, objectName, f.Response.Header)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt metadata headers of gs://%v/%v: %w", bucketName, objectName, err)
+	}
 
+	// objects the proxy padded before encrypting them, the padding follows the compressed payload
+	if padding := util.GetMetadataHeader(f.Response.Header, util.PaddingMetadataKey); padding != "" {
+		unencryptedBytes, err = util.UnpadPayload(padding, unencryptedBytes)
 		if err != nil {
-			return err
+			return fmt.Errorf("unable to unpad gs://%v/%v: %w", bucketName, objectName, err)
 		}
+	}
 
-		// bounds checking
-		if start > len(unencryptedBytes) {
-			return fmt.Errorf("requested start byte exceeds object length! sb: %v , len:%v", start, len(unencryptedBytes))
+	// objects the proxy compressed before encrypting them
+	if compression := util.GetMetadataHeader(f.Response.Header, util.CompressionMetadataKey); compression != "" {
+		unencryptedBytes, err = util.Decompress(compression, unencryptedBytes)
+		if err != nil {
+			return fmt.Errorf("unable to decompress gs://%v/%v: %w", bucketName, objectName, err)
 		}
+	}
+
+	// GCS always reports the hashes and length of the stored object, even for ranged reads or transcoded content
+	googHash := util.FormatGoogHashHeader(crypto.Base64Crc32cHash(unencryptedBytes), crypto.Base64MD5Hash(unencryptedBytes))
+	storedContentLength := len(unencryptedBytes)
+
+	// the ciphertext is stored without a content encoding, the client's encoding is in the custom metadata
+	storedContentEncoding := util.GetMetadataHeader(f.Response.Header, util.ContentEncodingMetadataKey)
+	if storedContentEncoding == "" {
+		storedContentEncoding = "identity"
+	}
+	f.Response.Header.Del("Content-Encoding")
+	f.Response.Header.Set("X-Goog-Stored-Content-Encoding", storedContentEncoding)
+
+	// check if this was as streaming/chunked download
+	byteRangeHeader := f.Request.Header.Get("x-original-byte-range")
 
-		if end < 1 || end < start {
-			return fmt.Errorf("invalid byte range request: %v", byteRangeHeader)
+	if isDecompressiveTranscoding(f, storedContentEncoding, f.Response.Header.Get("Cache-Control")) {
+		// emulate GCS decompressive transcoding, it ignores the range and serves the whole decompressed object
+		log.Debugf("transcoding gzip content of gs://%v/%v for a client that does not accept gzip", bucketName, objectName)
+		unencryptedBytes, err = util.Gunzip(unencryptedBytes)
+		if err != nil {
+			return fmt.Errorf("unable to transcode gs://%v/%v: %w", bucketName, objectName, err)
 		}
+		f.Response.Header.Set("Warning", "214 UploadServer gunzipped")
+		byteRangeHeader = ""
+	} else if storedContentEncoding != "identity" {
+		// served as stored, ranges apply to the compressed bytes
+		f.Response.Header.Set("Content-Encoding", storedContentEncoding)
+	}
 
-		if end >= len(unencryptedBytes)-1 {
-			end = len(unencryptedBytes)
+	if byteRangeHeader != "" {
+		log.Debugf("Grabbing requested byte range slice %v", byteRangeHeader)
+		size := len(unencryptedBytes)
+		start, end, err := parseRangeHeader(byteRangeHeader, size)
+
+		if errors.Is(err, errRangeNotSatisfiable) {
+			gcsErr := util.NewGcsError(http.StatusRequestedRangeNotSatisfiable, "requestedRangeNotSatisfiable",
+				"The requested range cannot be satisfied: %v of an object of %v bytes", byteRangeHeader, size)
+			gcsErr.Header = http.Header{"Content-Range": {fmt.Sprintf("bytes */%v", size)}}
+			return gcsErr
+		}
+		if err != nil {
+			return util.NewGcsError(http.StatusBadRequest, "invalid", "invalid Range header '%v': %v", byteRangeHeader, err)
 		}
 
-		unencryptedByteSlice := unencryptedBytes[start:end]
-		unencryptedBytes = unencryptedByteSlice //TODO: Performance/profiling
+		unencryptedBytes = unencryptedBytes[start : end+1] //TODO: Performance/profiling
+		f.Response.StatusCode = http.StatusPartialContent
+		f.Response.Header.Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, size))
 	}
 
 	f.Response.Body = unencryptedBytes
@@ -107,12 +176,18 @@ func HandleSimpleDownloadResponse(f *proxy.Flow) error {
 	log.Debugf("decrypted content len : %v", contentLength)
 
 	// Update content length headers with new length of decrypted data
-	f.Response.Header.Set("X-Goog-Stored-Content-Length", strconv.Itoa(contentLength))
+	f.Response.Header.Set("X-Goog-Stored-Content-Length", strconv.Itoa(storedContentLength))
 	f.Response.Header.Set("Content-Length", strconv.Itoa(contentLength))
 
-	hashValue := crypto.Base64MD5Hash(unencryptedBytes)
-	f.Response.Header.Set("X-Goog-Hash", hashValue)
+	f.Response.Header.Set("X-Goog-Hash", googHash)
 
 	return nil
 
 }
+
+// GCS serves gzip objects decompressed unless the client accepts gzip or the object is Cache-Control: no-transform
+func isDecompressiveTranscoding(f *proxy.Flow, storedContentEncoding string, cacheControl string) bool {
+	return storedContentEncoding == "gzip" &&
+		!util.AcceptsGzip(f.Request.Header) &&
+		!util.IsNoTransform(cacheControl)
+}
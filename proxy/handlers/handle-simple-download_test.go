@@ -0,0 +1,50 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package handlers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	tests := []struct {
+		header         string
+		start          int
+		end            int
+		notSatisfiable bool
+		invalid        bool
+	}{
+		{header: "bytes=0-9", start: 0, end: 9},
+		{header: "bytes=5-5", start: 5, end: 5},
+		{header: "bytes=90-200", start: 90, end: 99},
+		{header: "bytes=10-", start: 10, end: 99},
+		{header: "bytes=-10", start: 90, end: 99},
+		{header: "bytes=-200", start: 0, end: 99},
+		{header: "bytes=100-", notSatisfiable: true},
+		{header: "bytes=100-200", notSatisfiable: true},
+		{header: "bytes=-0", notSatisfiable: true},
+		{header: "bytes=9-5", invalid: true},
+		{header: "bytes=-", invalid: true},
+		{header: "bytes=a-5", invalid: true},
+		{header: "items=0-5", invalid: true},
+	}
+	for _, test := range tests {
+		start, end, err := parseRangeHeader(test.header, 100)
+		switch {
+		case test.notSatisfiable:
+			if !errors.Is(err, errRangeNotSatisfiable) {
+				t.Errorf("parseRangeHeader(%v) error = %v, want %v", test.header, err, errRangeNotSatisfiable)
+			}
+		case test.invalid:
+			if err == nil || errors.Is(err, errRangeNotSatisfiable) {
+				t.Errorf("parseRangeHeader(%v) error = %v, want an invalid range", test.header, err)
+			}
+		case err != nil || start != test.start || end != test.end:
+			t.Errorf("parseRangeHeader(%v) = %v, %v, %v, want %v, %v", test.header, start, end, err, test.start, test.end)
+		}
+	}
+}
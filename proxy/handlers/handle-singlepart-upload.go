@@ -7,10 +7,10 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"mime/multipart"
+	"net/url"
 	"strconv"
 
 	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
@@ -26,11 +26,19 @@ import (
 		3. Change the body to use boundary and add metadata and body(ecnrypted)
 */
 
-func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
+// resource is the object resource of a resumable session, nil for media uploads
+func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow, op *util.GcsOperation, resource map[string]interface{}) error {
 
-	// URL change to use Multipart
-	objectName := f.Request.URL.Query().Get("name")
-	f.Request.URL.RawQuery = "uploadType=multipart&alt=json"
+	// verify the client hashes against the plaintext before we encrypt anything
+	err := util.GetClientChecksumsFromHeader(f.Request.Header).Verify(f.Request.Body)
+	if err != nil {
+		return err
+	}
+	f.Request.Header.Del("X-Goog-Hash")
+
+	// URL change to use Multipart, keeping preconditions, predefinedAcl, userProject etc.
+	objectName := op.Object
+	f.Request.URL.RawQuery = convertToMultipartQuery(f.Request.URL.Query())
 
 	//  Store original headers in variables, useful for generating metadata
 	orgContentType := f.Request.Header.Get("Content-Type")
@@ -45,32 +53,65 @@ func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
 		f.Request.Header.Set(key, value)
 	}
 
-	f.Request.Header.Set("gcs-proxy-original-content-length",
-		f.Request.Header.Get("Content-Length"))
-
-	f.Request.Header.Set("gcs-proxy-unencrypted-file-size",
-		strconv.Itoa(len(f.Request.Body)))
+	// the plaintext size is only reported to the client, padded buckets don't reveal it to GCS
+	setFlowState(f, unencryptedSizeState, strconv.Itoa(len(f.Request.Body)))
 
 	// save the original md5 has or gsutil/gcloud will delete after upload if it sees it is different
-	f.Request.Header.Set("gcs-proxy-original-md5-hash",
-		crypto.Base64MD5Hash(f.Request.Body))
+	setFlowState(f, originalMd5HashState, crypto.Base64MD5Hash(f.Request.Body))
+	setFlowState(f, originalCrc32cState, crypto.Base64Crc32cHash(f.Request.Body))
 
 	f.Request.Header.Del("Expect")
 
 	// Generate Metadata to insert in body
-	metadata := util.GenerateMetadata(f, orgContentType, objectName)
+	bucketName := op.Bucket
+	err = resolveScopeKey(f, bucketName, plaintextObjectName(f, op))
+	if err != nil {
+		return err
+	}
+	ctxValue := flowContext(f)
+	metadata, err := util.GenerateMetadata(ctxValue, f, bucketName, orgContentType, objectName)
+	if err != nil {
+		return err
+	}
+	mergeObjectResource(metadata, resource)
+
+	// a gzip encoded media upload describes the object, the multipart body we send is not encoded
+	if orgContentEncoding := f.Request.Header.Get("Content-Encoding"); orgContentEncoding != "" {
+		metadata["contentEncoding"] = orgContentEncoding
+		f.Request.Header.Del("Content-Encoding")
+	}
+	// GCS can't transcode ciphertext, keep the client's content encoding in the custom metadata instead
+	if contentEncoding := util.MoveContentEncodingToMetadata(metadata, f.Request.URL); contentEncoding != "" {
+		setFlowState(f, contentEncodingState, contentEncoding)
+	}
+
+	// ciphertext doesn't compress, so compress first if the bucket asks for it
+	payload, err := util.CompressPayload(bucketName, metadata, f.Request.Body)
+	if err != nil {
+		return fmt.Errorf("error compressing request: %w", err)
+	}
+
+	// pad after compressing, the padding would compress away
+	payload, err = util.PadPayload(bucketName, metadata, payload)
+	if err != nil {
+		return fmt.Errorf("error padding request: %w", err)
+	}
 
 	// Encrypt data in body
-	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-	ctx := f.Request.Raw().Context()
-	ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
+	err = util.EncryptObjectMetadata(ctxValue, bucketName, objectName, metadata)
+	if err != nil {
+		return err
+	}
 	encryptBody, err := crypto.EncryptBytes(ctxValue,
-		util.GetKMSKeyName(bucketName),
-		f.Request.Body)
+		util.GetRequestKMSKeyName(ctxValue, bucketName),
+		payload)
 	if err != nil {
-		return fmt.Errorf("error encrypting  request: %v", err)
+		return fmt.Errorf("error encrypting  request: %w", err)
 	}
 
+	// have GCS verify the ciphertext arrived intact
+	util.SetCiphertextChecksums(metadata, encryptBody)
+
 	//Write data to request body  to support multipart request
 	encryptedRequest := &bytes.Buffer{}
 	multipartWriter := multipart.NewWriter(encryptedRequest)
@@ -102,6 +143,40 @@ func ConvertSinglePartUploadtoMultiPartUpload(f *proxy.Flow) error {
 	return nil
 }
 
+// the proxy computes the name, bucket, hashes and its own metadata, everything else comes from the resource
+func mergeObjectResource(metadata map[string]interface{}, resource map[string]interface{}) {
+	for key, value := range resource {
+		switch key {
+		case "name", "bucket", "md5Hash", "crc32c":
+			continue
+		case "metadata":
+			customMetadata, _ := metadata["metadata"].(map[string]interface{})
+			resourceMetadata, _ := value.(map[string]interface{})
+			for metadataKey, metadataValue := range resourceMetadata {
+				if _, exists := customMetadata[metadataKey]; !exists {
+					customMetadata[metadataKey] = metadataValue
+				}
+			}
+		default:
+			metadata[key] = value
+		}
+	}
+}
+
+// query parameters that only describe the media or resumable upload, the object name moves to the metadata part
+var mediaUploadQueryParams = []string{"uploadType", "name", "upload_id"}
+
+func convertToMultipartQuery(query url.Values) string {
+	for _, key := range mediaUploadQueryParams {
+		query.Del(key)
+	}
+	query.Set("uploadType", "multipart")
+	if query.Get("alt") == "" {
+		query.Set("alt", "json")
+	}
+	return query.Encode()
+}
+
 func HandleSinglePartUploadResponse(f *proxy.Flow) error {
 	var jsonResponse map[string]interface{}
 	// turn the response body into a dynamic json map we can use
@@ -111,13 +186,18 @@ func HandleSinglePartUploadResponse(f *proxy.Flow) error {
 	}
 
 	// update the response with the orginal md5 hash so gsutil/gcloud does not complain
-	jsonResponse["md5Hash"] = f.Request.Header.Get("Gcs-proxy-original-md5-hash")
-	jsonResponse["size"], err = strconv.Atoi(f.Request.Header.Get("Gcs-proxy-unencrypted-file-size"))
+	jsonResponse["md5Hash"] = getFlowState(f, originalMd5HashState)
+	jsonResponse["crc32c"] = getFlowState(f, originalCrc32cState)
+	jsonResponse["size"], err = strconv.Atoi(getFlowState(f, unencryptedSizeState))
 	if err != nil {
 		return fmt.Errorf("error setting json response: %v", err)
 	}
+	setContentEncodingResponse(f, jsonResponse)
+	err = decryptUploadResponseMetadata(f, jsonResponse)
+	if err != nil {
+		return err
+	}
 
-	log.Debugf("HandleSinglePartUploadResponse response with original size and md5: %v", jsonResponse)
 	jsonData, err := json.Marshal(jsonResponse)
 	if err != nil {
 		return fmt.Errorf("error marshaling to JSON: %v", err)
@@ -127,32 +207,29 @@ func HandleSinglePartUploadResponse(f *proxy.Flow) error {
 	return nil
 }
 
-func HandleSinglePartUploadRequest(f *proxy.Flow) error {
-	bucketName := util.GetBucketNameFromRequestUri(f.Request.URL.Path)
-	ctx := f.Request.Raw().Context()
-	ctxValue := context.WithValue(ctx, "requestid", f.Id.String())
-	encryptedData, err := crypto.EncryptBytes(ctxValue,
-		util.GetKMSKeyName(bucketName),
-		f.Request.Body)
+// the object resource GCS returns has the encrypted name and custom metadata
+func decryptUploadResponseMetadata(f *proxy.Flow, jsonResponse map[string]interface{}) error {
+	// metadata values are bound to the stored name
+	bucketName, _ := jsonResponse["bucket"].(string)
+	storedName, _ := jsonResponse["name"].(string)
+	util.DecryptResourceName(jsonResponse)
 
-	if err != nil {
-		return fmt.Errorf("error encrypting  request: %v", err)
-	}
-
-	f.Request.Header.Set("gcs-proxy-original-content-length",
-		f.Request.Header.Get("Content-Length"))
-
-	f.Request.Header.Set("Content-Length",
-		strconv.Itoa(len(encryptedData)))
-
-	// save the original md5 has or gsutil/gcloud will delete after upload if it sees it is different
-	f.Request.Header.Set("gcs-proxy-original-md5-hash",
-		crypto.Base64MD5Hash(f.Request.Body))
-
-	f.Request.Header.Set("gcs-proxy-unencrypted-file-size",
-		strconv.Itoa(len(f.Request.Body)))
+	ctxValue := flowContext(f)
+	return util.DecryptObjectMetadata(ctxValue, bucketName, storedName, jsonResponse)
+}
 
-	f.Request.Body = encryptedData
+// storedObjectName returns the stored name of the object a request writes, from the object resource or the
+// request. Names were encrypted before, when the bucket encrypts them.
+func storedObjectName(op *util.GcsOperation, gcsMetadataMap map[string]interface{}) string {
+	if name, ok := gcsMetadataMap["name"].(string); ok && name != "" {
+		return name
+	}
+	return op.Object
+}
 
-	return nil
+// the object resource GCS returns has no contentEncoding, report the one the client uploaded with
+func setContentEncodingResponse(f *proxy.Flow, jsonResponse map[string]interface{}) {
+	if contentEncoding := getFlowState(f, contentEncodingState); contentEncoding != "" {
+		jsonResponse["contentEncoding"] = contentEncoding
+	}
 }
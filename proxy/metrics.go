@@ -0,0 +1,70 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// flow metrics are labeled by bucket and GCS operation, never by request or object, so the number of
+// series stays bounded. Only set when metrics are enabled.
+var (
+	Requests      metric.Int64Counter
+	RequestBytes  metric.Int64Counter
+	ResponseBytes metric.Int64Counter
+	Errors        metric.Int64Counter
+	InFlight      metric.Int64UpDownCounter
+)
+
+// recordRequest counts a flow and the bytes the client sent, it is in flight until the flow is done. The
+// flow is labeled when it was classified by startFlowSpan.
+func recordRequest(f *proxy.Flow) {
+	attributes := getFlowMetricAttributes(f)
+
+	ctx := f.Request.Raw().Context()
+	if Requests != nil {
+		Requests.Add(ctx, 1, metric.WithAttributes(attributes...))
+	}
+	if RequestBytes != nil {
+		RequestBytes.Add(ctx, int64(len(f.Request.Body)), metric.WithAttributes(attributes...))
+	}
+	if InFlight != nil {
+		InFlight.Add(ctx, 1, metric.WithAttributes(attributes...))
+		hdl.OnFlowDone(f, func() {
+			InFlight.Add(context.Background(), -1, metric.WithAttributes(attributes...))
+		})
+	}
+}
+
+// recordResponse counts the bytes returned to the client.
+func recordResponse(f *proxy.Flow) {
+	if ResponseBytes != nil && f.Response != nil {
+		ResponseBytes.Add(f.Request.Raw().Context(), int64(len(f.Response.Body)), metric.WithAttributes(getFlowMetricAttributes(f)...))
+	}
+}
+
+// recordError counts a failed flow by the reason of the GCS error, "failOpen" for requests forwarded
+// unencrypted and "upstream" for errors returned by GCS.
+func recordError(f *proxy.Flow, reason string) {
+	if Errors != nil {
+		attributes := append(getFlowMetricAttributes(f), attribute.String("reason", reason))
+		Errors.Add(f.Request.Raw().Context(), 1, metric.WithAttributes(attributes...))
+	}
+}
+
+func getFlowMetricAttributes(f *proxy.Flow) []attribute.KeyValue {
+	bucket, _, operation := hdl.GetFlowLabels(f)
+	if operation == "" {
+		operation = "other"
+	}
+	return []attribute.KeyValue{attribute.String("bucket", util.MetricBucketLabel(bucket)), attribute.String("operation", operation)}
+}
@@ -8,7 +8,6 @@ package proxy
 import (
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
 
-	"github.com/byronwhitlock-google/go-mitmproxy/addon"
 	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
 	"github.com/byronwhitlock-google/go-mitmproxy/web"
 	log "github.com/sirupsen/logrus"
@@ -50,9 +49,25 @@ func (r *ProxyRunner) Start() error {
 	p.AddAddon(&GetReqHeader{})
 
 	if r.config.Dump != "" {
-		dumper := addon.NewDumperWithFilename(r.config.Dump, r.config.DumpLevel)
+		// the dumper of go-mitmproxy writes credentials and plaintext bodies, this one masks and omits them
+		dumper, err := NewRedactingDumper(r.config.Dump, r.config.DumpLevel)
+		if err != nil {
+			log.Fatal(err)
+		}
 		p.AddAddon(dumper)
 	}
 
+	if r.config.EndpointAddr != "" {
+		endpoint, err := NewEndpointRunner(r.config, p.GetCertificate())
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := endpoint.Start(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	return p.Start()
 }
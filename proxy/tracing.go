@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the request sent to GCS by flow id, from the end of the request handlers to the response
+var upstreamRequests sync.Map
+
+type upstreamRequest struct {
+	span     trace.Span
+	start    time.Time
+	duration time.Duration // zero until the response arrived
+}
+
+// startFlowSpan starts the span of a flow as a child of the traceparent of the client and classifies the
+// request. The handlers start their spans from hdl.GetTraceContext.
+func startFlowSpan(f *proxy.Flow) trace.Span {
+	ctx := otel.GetTextMapPropagator().Extract(f.Request.Raw().Context(), propagation.HeaderCarrier(f.Request.Header))
+	ctx, span := crypto.Tracer.Start(ctx, "other", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", f.Request.Method),
+		attribute.Int("http.request.body.size", len(f.Request.Body)),
+	))
+	hdl.SetTraceContext(f, ctx)
+
+	bucket, operation := classifyFlow(ctx, f)
+	span.SetName(operation)
+	span.SetAttributes(attribute.String("bucket", bucket), attribute.String("operation", operation))
+	return span
+}
+
+// endFlowSpan ends the span of a flow with the response sent to the client.
+func endFlowSpan(f *proxy.Flow, span trace.Span) {
+	if f.Response != nil {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", f.Response.StatusCode),
+			attribute.Int("http.response.body.size", len(f.Response.Body)),
+		)
+		if f.Response.StatusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(f.Response.StatusCode))
+		}
+	}
+	span.End()
+}
+
+// classifyFlow returns the bucket and GCS operation of the client request and keeps them as the labels of
+// the flow logs and metrics, the handlers rewrite the request e.g. from a media to a multipart upload.
+func classifyFlow(ctx context.Context, f *proxy.Flow) (string, string) {
+	_, span := crypto.Tracer.Start(ctx, "route")
+	defer span.End()
+
+	bucket, object, operation := "", "", "other"
+	if isGcsHost(f.Request.URL.Host) {
+		op := util.RouteGcsRequest(f.Request)
+		bucket, object, operation = op.Bucket, op.Object, op.Type.String()
+	}
+	span.SetAttributes(attribute.String("bucket", bucket), attribute.String("operation", operation))
+	hdl.SetFlowLabels(f, bucket, object, operation)
+	return bucket, operation
+}
+
+// startUpstreamSpan starts the span of the request sent to GCS and replaces the traceparent of the client
+// with it. Requests the proxy answered itself are not sent.
+func startUpstreamSpan(f *proxy.Flow) {
+	if f.Response != nil {
+		return
+	}
+	ctx, span := crypto.Tracer.Start(hdl.GetTraceContext(f), "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("server.address", f.Request.URL.Host),
+		attribute.Int("http.request.body.size", len(f.Request.Body)),
+	))
+	upstreamRequests.Store(f.Id, &upstreamRequest{span: span, start: time.Now()})
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(f.Request.Header))
+}
+
+// endUpstreamSpan ends the span of the request sent to GCS before the response handlers run.
+func endUpstreamSpan(f *proxy.Flow) {
+	value, ok := upstreamRequests.Load(f.Id)
+	if !ok || value.(*upstreamRequest).duration != 0 {
+		return
+	}
+	upstream := value.(*upstreamRequest)
+	upstream.duration = time.Since(upstream.start)
+	span := upstream.span
+	if f.Response != nil {
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", f.Response.StatusCode),
+			attribute.Int("http.response.body.size", len(f.Response.Body)),
+		)
+		if f.Response.StatusCode >= 400 {
+			span.SetStatus(codes.Error, http.StatusText(f.Response.StatusCode))
+		}
+	}
+	span.End()
+}
+
+// upstreamDuration returns the round trip to GCS of a done flow, zero when the request was not sent.
+func upstreamDuration(f *proxy.Flow) time.Duration {
+	// the upstream span is still open when GCS could not be reached
+	endUpstreamSpan(f)
+	value, ok := upstreamRequests.LoadAndDelete(f.Id)
+	if !ok {
+		return 0
+	}
+	return value.(*upstreamRequest).duration
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package proxy
+
+import (
+	"net/http"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	hdl "github.com/byronwhitlock-google/go-gcsproxy/proxy/handlers"
+	"github.com/byronwhitlock-google/go-gcsproxy/util"
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// counts writes to buckets that are neither mapped nor exempt. only set when OTEL is configured.
+var UnmappedBucketWrites metric.Int64Counter
+
+// enforceUnmappedBucketPolicy checks writes to buckets without a KMS key. In deny mode the
+// write is answered with a 403 and never reaches GCS, in report mode it is logged and counted.
+// Returns false when the request was rejected.
+func enforceUnmappedBucketPolicy(f *proxy.Flow, op *util.GcsOperation) bool {
+	mode := cfg.GlobalConfig.UnmappedBucketMode
+	if mode == cfg.UnmappedBucketAllow || op == nil || !op.IsObjectWrite() {
+		return true
+	}
+
+	for _, bucketName := range op.WrittenBuckets() {
+		if util.GetKMSKeyName(bucketName) != "" || util.IsPlaintextBucket(bucketName) {
+			continue
+		}
+
+		if UnmappedBucketWrites != nil {
+			// not labeled by bucket, clients could add a series for every bucket name they make up
+			UnmappedBucketWrites.Add(f.Request.Raw().Context(), 1, metric.WithAttributes(attribute.String("mode", mode)))
+		}
+
+		if mode == cfg.UnmappedBucketReport {
+			hdl.FlowLogger(f).Warnf("report only: plaintext write to unmapped bucket '%v' %v %v", bucketName, f.Request.Method, f.Request.URL.Path)
+			continue
+		}
+
+		hdl.FlowLogger(f).Errorf("denied plaintext write to unmapped bucket '%v' %v %v", bucketName, f.Request.Method, f.Request.URL.Path)
+		replyGcsError(f, util.NewGcsError(http.StatusForbidden, "forbidden",
+			"go-gcsproxy has no encryption key for bucket '%v' and it is not allowed to receive plaintext writes", bucketName))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="content-encoding.txt"
+  # Create a gzip encoded file, the proxy stores it encrypted and transcodes it like GCS does
+  echo "This file is stored with Content-Encoding: gzip." > $TESTFILE
+  gzip -c $TESTFILE > $TESTFILE.gz
+}
+
+teardown() {
+  rm -f $TESTFILE $TESTFILE.gz downloaded_content
+}
+
+# Helper function to download the object using curl, extra arguments are passed to curl
+download_object() {
+  curl -s https://storage.googleapis.com/$BUCKET/$TESTFILE \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY "$@"
+}
+
+@test "Setup - gcloud storage cp gzip encoded" {
+  run gcloud storage cp --content-encoding=gzip --content-type=text/plain $TESTFILE.gz gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Content encoding: download without Accept-Encoding is decompressed" {
+  run download_object
+  assert_success
+  assert_output "$(cat $TESTFILE)"
+}
+
+@test "Content encoding: decompressed download reports the stored encoding" {
+  #NOTE DO NOT TRY A PIPE USING CURL. `curl...| grep` does not work. YOU WILL HAVE BEEN WARNED.
+  run download_object -D - -o /dev/null
+  assert_success
+  assert_output --partial "X-Goog-Stored-Content-Encoding: gzip"
+  assert_output --partial "Warning: 214 UploadServer gunzipped"
+}
+
+@test "Content encoding: download with Accept-Encoding gzip is not decompressed" {
+  download_object -H "Accept-Encoding: gzip" -o downloaded_content
+  run cmp downloaded_content $TESTFILE.gz
+  assert_success
+}
+
+@test "Content encoding: gcloud storage cat" {
+  run gcloud storage cat gs://$BUCKET/$TESTFILE
+  assert_success
+  assert_output "$(cat $TESTFILE)"
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
@@ -0,0 +1,62 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="copy-compose.txt"
+  # Create two temporary files with some content
+  echo "first part of the composed object" > $TESTFILE
+  echo "second part of the composed object" > $TESTFILE.2
+}
+
+teardown() {
+  # Remove the temporary files
+  rm $TESTFILE $TESTFILE.2
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+  run gcloud storage cp $TESTFILE.2 gs://$BUCKET/$TESTFILE.2
+  assert_success
+}
+
+# copies, rewrites and composes of a mapped bucket can't be encrypted yet and are rejected
+@test "Copy: gcloud storage cp between objects is rejected" {
+  run gcloud storage cp gs://$BUCKET/$TESTFILE gs://$BUCKET/$TESTFILE.copy
+  assert_failure
+
+  run gcloud storage ls gs://$BUCKET/$TESTFILE.copy
+  assert_failure
+}
+
+@test "Copy: XML API copy is rejected" {
+  run curl -s -o /dev/null -w "%{http_code}" -X PUT \
+          https://storage.googleapis.com/$BUCKET/$TESTFILE.xmlcopy \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          -H "x-goog-copy-source: $BUCKET/$TESTFILE" \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output "501"
+}
+
+@test "Copy: gcloud storage mv is rejected and keeps the source" {
+  run gcloud storage mv gs://$BUCKET/$TESTFILE gs://$BUCKET/$TESTFILE.moved
+  assert_failure
+
+  run gcloud storage cat gs://$BUCKET/$TESTFILE
+  assert_success
+  assert_output "$(cat $TESTFILE)"
+}
+
+@test "Compose: gcloud storage objects compose is rejected" {
+  run gcloud storage objects compose gs://$BUCKET/$TESTFILE gs://$BUCKET/$TESTFILE.2 gs://$BUCKET/$TESTFILE.composed
+  assert_failure
+
+  run gcloud storage ls gs://$BUCKET/$TESTFILE.composed
+  assert_failure
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE gs://$BUCKET/$TESTFILE.2
+  assert_success
+}
@@ -0,0 +1,75 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="custom-metadata.txt"
+  # Create a temporary file with some content
+  echo "This file has custom metadata and a content disposition." > $TESTFILE
+}
+
+teardown() {
+  # Remove the temporary file
+  rm $TESTFILE
+}
+
+@test "Setup - gcloud storage cp with custom metadata" {
+  run gcloud storage cp --custom-metadata=color=blue,owner=alice \
+        --content-disposition="attachment; filename=report.txt" \
+        $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Custom metadata: XML API HEAD returns the plaintext values" {
+  #NOTE DO NOT TRY A PIPE USING CURL. `curl...| grep` does not work. YOU WILL HAVE BEEN WARNED.
+  run curl -s -I https://storage.googleapis.com/$BUCKET/$TESTFILE \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output --partial "X-Goog-Meta-Color: blue"
+  assert_output --partial "X-Goog-Meta-Owner: alice"
+  assert_output --partial "Content-Disposition: attachment; filename=report.txt"
+  refute_output --partial "gcsproxy-enc:"
+}
+
+@test "Custom metadata: JSON API returns the plaintext values" {
+  run curl -s https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$TESTFILE \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_success
+  assert_output --partial '"color": "blue"'
+  assert_output --partial '"owner": "alice"'
+  refute_output --partial "gcsproxy-enc:"
+}
+
+@test "Custom metadata: patch keeps the other values readable" {
+  run gcloud storage objects update gs://$BUCKET/$TESTFILE --update-custom-metadata=color=green
+  assert_success
+
+  run gcloud storage objects describe gs://$BUCKET/$TESTFILE --format="value(custom_fields.color,custom_fields.owner)"
+  assert_success
+  assert_output --partial "green"
+  assert_output --partial "alice"
+}
+
+@test "Custom metadata: values in the reserved encrypted format are rejected" {
+  run curl -s -o /dev/null -w "%{http_code}" -X PATCH \
+          https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$TESTFILE \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          -H "Content-Type: application/json" \
+          --data '{"metadata": {"color": "gcsproxy-enc:v2:AAAA"}}' \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output "400"
+}
+
+@test "Custom metadata: content round trip" {
+  run gcloud storage cat gs://$BUCKET/$TESTFILE
+  assert_success
+  assert_output "$(cat $TESTFILE)"
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
@@ -0,0 +1,55 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="object-hashes.txt"
+  # Create a temporary file with some content
+  echo "The proxy reports the hashes of the plaintext, not of the ciphertext." > $TESTFILE
+}
+
+teardown() {
+  # Remove the temporary file
+  rm $TESTFILE
+}
+
+@test "Setup - gcloud storage cp" {
+  run gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE
+  assert_success
+}
+
+@test "Object hashes: XML API HEAD returns the plaintext crc32c and md5" {
+  local expected_crc32c=$(gcloud storage hash $TESTFILE --skip-md5 --format="value(crc32c_hash)")
+  local expected_md5=$(gcloud storage hash $TESTFILE --skip-crc32c --format="value(md5_hash)")
+
+  #NOTE DO NOT TRY A PIPE USING CURL. `curl...| grep` does not work. YOU WILL HAVE BEEN WARNED.
+  run curl -s -I https://storage.googleapis.com/$BUCKET/$TESTFILE \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output --partial "crc32c=$expected_crc32c"
+  assert_output --partial "md5=$expected_md5"
+}
+
+@test "Object hashes: JSON API returns the plaintext crc32c and size" {
+  local expected_crc32c=$(gcloud storage hash $TESTFILE --skip-md5 --format="value(crc32c_hash)")
+  local expected_size=$(wc -c < $TESTFILE)
+  expected_size=$(xargs <<< $expected_size)
+
+  run gcloud storage objects describe gs://$BUCKET/$TESTFILE --format="value(crc32c_hash,size)"
+  assert_success
+  assert_output --partial "$expected_crc32c"
+  assert_output --partial "$expected_size"
+}
+
+@test "Object hashes: gcloud storage cp validates the download" {
+  run gcloud storage cp gs://$BUCKET/$TESTFILE $TESTFILE.downloaded
+  assert_success
+  run cmp $TESTFILE $TESTFILE.downloaded
+  assert_success
+  rm $TESTFILE.downloaded
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE
+  assert_success
+}
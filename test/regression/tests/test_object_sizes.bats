@@ -0,0 +1,66 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="object-sizes"
+  # Create files at the edges of the compression and padding policies
+  : > $TESTFILE.empty
+  printf "x" > $TESTFILE.byte
+  head -c 4096 /dev/zero > $TESTFILE.block
+  head -c 4097 /dev/urandom > $TESTFILE.random
+  yes "compressible line" | head -c 1048576 > $TESTFILE.compressible
+}
+
+teardown() {
+  rm -f $TESTFILE.* downloaded_content
+}
+
+# Helper function to upload a file, download it again and compare both
+round_trip() {
+  gcloud storage cp $1 gs://$BUCKET/$1 || return 1
+  gcloud storage cp gs://$BUCKET/$1 downloaded_content || return 1
+  cmp $1 downloaded_content
+}
+
+@test "Object sizes: empty object" {
+  run round_trip $TESTFILE.empty
+  assert_success
+}
+
+@test "Object sizes: single byte" {
+  run round_trip $TESTFILE.byte
+  assert_success
+}
+
+@test "Object sizes: padding block size" {
+  run round_trip $TESTFILE.block
+  assert_success
+}
+
+@test "Object sizes: incompressible" {
+  run round_trip $TESTFILE.random
+  assert_success
+}
+
+@test "Object sizes: compressible" {
+  run round_trip $TESTFILE.compressible
+  assert_success
+}
+
+@test "Object sizes: reported size is the plaintext size" {
+  run gcloud storage objects describe gs://$BUCKET/$TESTFILE.compressible --format="value(size)"
+  assert_success
+  assert_output "1048576"
+
+  #NOTE DO NOT TRY A PIPE USING CURL. `curl...| grep` does not work. YOU WILL HAVE BEEN WARNED.
+  run curl -s -I https://storage.googleapis.com/$BUCKET/$TESTFILE.random \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output --partial "X-Goog-Meta-X-Unencrypted-Content-Length: 4097"
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE.*
+  assert_success
+}
@@ -0,0 +1,85 @@
+load '../helpers/bats-support/load'
+load '../helpers/bats-assert/load'
+
+setup() {
+  export TESTFILE="upload-apis.txt"
+  # Create a temporary file with some content
+  echo "Uploaded and downloaded with every API the proxy encrypts." > $TESTFILE
+}
+
+teardown() {
+  # Remove the temporary file
+  rm $TESTFILE
+}
+
+# Helper function to download an object with the JSON API media download
+json_download() {
+  curl -s "https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$1?alt=media" \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY
+}
+
+# Helper function to download an object with the XML API
+xml_download() {
+  curl -s https://storage.googleapis.com/$BUCKET/$1 \
+        -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+        --cacert $CA_BUNDLE \
+        --proxy $HTTPS_PROXY
+}
+
+@test "Upload APIs: JSON API media upload" {
+  run curl -s -o /dev/null -w "%{http_code}" -X POST \
+          "https://storage.googleapis.com/upload/storage/v1/b/$BUCKET/o?uploadType=media&name=$TESTFILE.media" \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          -H "Content-Type: text/plain" \
+          --data-binary @$TESTFILE \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output "200"
+
+  run json_download $TESTFILE.media
+  assert_output "$(cat $TESTFILE)"
+  run xml_download $TESTFILE.media
+  assert_output "$(cat $TESTFILE)"
+}
+
+# XML API uploads are not encrypted yet, writes to a mapped bucket fail closed
+@test "Upload APIs: XML API PUT is rejected" {
+  run curl -s -o /dev/null -w "%{http_code}" -X PUT \
+          https://storage.googleapis.com/$BUCKET/$TESTFILE.xml \
+          -H "Authorization: Bearer $(gcloud auth print-access-token)" \
+          -H "Content-Type: text/plain" \
+          --data-binary @$TESTFILE \
+          --cacert $CA_BUNDLE \
+          --proxy $HTTPS_PROXY
+  assert_output "501"
+}
+
+@test "Upload APIs: gcloud storage cp resumable upload" {
+  # uploads larger than the threshold are resumable
+  run env CLOUDSDK_STORAGE_RESUMABLE_THRESHOLD=1 gcloud storage cp $TESTFILE gs://$BUCKET/$TESTFILE.resumable
+  assert_success
+
+  run json_download $TESTFILE.resumable
+  assert_output "$(cat $TESTFILE)"
+}
+
+@test "Upload APIs: object names with slashes and spaces" {
+  run gcloud storage cp $TESTFILE "gs://$BUCKET/dir with space/$TESTFILE"
+  assert_success
+
+  run gcloud storage cat "gs://$BUCKET/dir with space/$TESTFILE"
+  assert_success
+  assert_output "$(cat $TESTFILE)"
+
+  run gcloud storage ls "gs://$BUCKET/dir with space/"
+  assert_success
+  assert_output --partial "dir with space/$TESTFILE"
+}
+
+@test "Teardown - gcloud storage rm" {
+  run gcloud storage rm gs://$BUCKET/$TESTFILE.media gs://$BUCKET/$TESTFILE.resumable \
+        "gs://$BUCKET/dir with space/$TESTFILE"
+  assert_success
+}
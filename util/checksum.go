@@ -0,0 +1,100 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClientChecksums holds the base64 encoded hashes a client supplied for the plaintext of an upload.
+// Empty values were not supplied by the client.
+type ClientChecksums struct {
+	Md5Hash string
+	Crc32c  string
+}
+
+// GetClientChecksumsFromHeader parses X-Goog-Hash headers in the format
+// "crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ==". The header may also be repeated per hash.
+func GetClientChecksumsFromHeader(header http.Header) ClientChecksums {
+	var checksums ClientChecksums
+	for _, headerValue := range header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(headerValue, ",") {
+			name, value, found := strings.Cut(strings.TrimSpace(hash), "=")
+			if !found {
+				continue
+			}
+			switch strings.ToLower(name) {
+			case "md5":
+				checksums.Md5Hash = value
+			case "crc32c":
+				checksums.Crc32c = value
+			}
+		}
+	}
+	return checksums
+}
+
+// GetClientChecksumsFromGcsMetadata reads the md5Hash and crc32c fields of a JSON API object resource.
+func GetClientChecksumsFromGcsMetadata(gcsMetadataMap map[string]interface{}) ClientChecksums {
+	var checksums ClientChecksums
+	if value, ok := gcsMetadataMap["md5Hash"].(string); ok {
+		checksums.Md5Hash = value
+	}
+	if value, ok := gcsMetadataMap["crc32c"].(string); ok {
+		checksums.Crc32c = value
+	}
+	return checksums
+}
+
+// Merge fills any missing hashes from other.
+func (c ClientChecksums) Merge(other ClientChecksums) ClientChecksums {
+	if c.Md5Hash == "" {
+		c.Md5Hash = other.Md5Hash
+	}
+	if c.Crc32c == "" {
+		c.Crc32c = other.Crc32c
+	}
+	return c
+}
+
+// Verify compares the client supplied hashes against the plaintext. The returned error
+// matches what GCS returns for a mismatched upload.
+func (c ClientChecksums) Verify(plaintext []byte) error {
+	if c.Md5Hash != "" {
+		calculated := crypto.Base64MD5Hash(plaintext)
+		if calculated != c.Md5Hash {
+			log.Errorf("client md5 hash %v does not match plaintext md5 hash %v", c.Md5Hash, calculated)
+			return NewGcsError(http.StatusBadRequest, "invalid",
+				"Provided MD5 hash \"%v\" doesn't match calculated MD5 hash \"%v\".", c.Md5Hash, calculated)
+		}
+	}
+	if c.Crc32c != "" {
+		calculated := crypto.Base64Crc32cHash(plaintext)
+		if calculated != c.Crc32c {
+			log.Errorf("client crc32c %v does not match plaintext crc32c %v", c.Crc32c, calculated)
+			return NewGcsError(http.StatusBadRequest, "invalid",
+				"Provided CRC32C \"%v\" doesn't match calculated CRC32C \"%v\".", c.Crc32c, calculated)
+		}
+	}
+	return nil
+}
+
+// SetCiphertextChecksums replaces the hashes in a JSON API object resource with the hashes of the
+// ciphertext so GCS verifies the encrypted payload arrived intact.
+func SetCiphertextChecksums(gcsMetadataMap map[string]interface{}, ciphertext []byte) {
+	gcsMetadataMap["md5Hash"] = crypto.Base64MD5Hash(ciphertext)
+	gcsMetadataMap["crc32c"] = crypto.Base64Crc32cHash(ciphertext)
+}
+
+// FormatGoogHashHeader formats hashes for the X-Goog-Hash header.
+func FormatGoogHashHeader(crc32c string, md5Hash string) string {
+	return fmt.Sprintf("crc32c=%v,md5=%v", crc32c, md5Hash)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// CompressionMetadataKey records the algorithm the plaintext was compressed with before it was encrypted.
+const CompressionMetadataKey = "x-compression"
+
+// EncodeAll and DecodeAll are safe for concurrent use, so one encoder and decoder serve all flows
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// CompressPayload compresses plaintext with the compression configured for bucketName and records the
+// algorithm in the custom metadata of the object resource. Content the client already encoded is left as is.
+func CompressPayload(bucketName string, gcsMetadataMap map[string]interface{}, plaintext []byte) ([]byte, error) {
+	algorithm := GetCompression(bucketName)
+	if algorithm == cfg.CompressionNone {
+		return plaintext, nil
+	}
+
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	if !ok {
+		customMetadata = map[string]interface{}{}
+		gcsMetadataMap["metadata"] = customMetadata
+	}
+	if _, encoded := customMetadata[ContentEncodingMetadataKey]; encoded {
+		log.Debugf("not compressing content that is already %v encoded", customMetadata[ContentEncodingMetadataKey])
+		return plaintext, nil
+	}
+
+	compressed, err := Compress(algorithm, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	customMetadata[CompressionMetadataKey] = algorithm
+	log.Debugf("compressed %v bytes to %v bytes with %v", len(plaintext), len(compressed), algorithm)
+	return compressed, nil
+}
+
+func Compress(algorithm string, plaintext []byte) ([]byte, error) {
+	switch algorithm {
+	case cfg.CompressionZstd:
+		return zstdEncoder.EncodeAll(plaintext, nil), nil
+
+	case cfg.CompressionGzip:
+		compressed := &bytes.Buffer{}
+		writer := gzip.NewWriter(compressed)
+		if _, err := writer.Write(plaintext); err != nil {
+			return nil, fmt.Errorf("error compressing with gzip: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing with gzip: %w", err)
+		}
+		return compressed.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression '%v'", algorithm)
+}
+
+func Decompress(algorithm string, compressed []byte) ([]byte, error) {
+	switch algorithm {
+	case cfg.CompressionZstd:
+		plaintext, err := zstdDecoder.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing with zstd: %w", err)
+		}
+		return plaintext, nil
+
+	case cfg.CompressionGzip:
+		return Gunzip(compressed)
+	}
+	return nil, fmt.Errorf("unsupported compression '%v'", algorithm)
+}
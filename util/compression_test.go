@@ -0,0 +1,105 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+func TestCompressPayload(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{Compression: map[string]string{
+		"gzip": cfg.CompressionGzip,
+		"zstd": cfg.CompressionZstd,
+	}}
+	defer func() { cfg.GlobalConfig = previous }()
+	plaintext := bytes.Repeat([]byte("compressible "), 100)
+
+	tests := []struct {
+		name      string
+		bucket    string
+		metadata  map[string]interface{}
+		algorithm string // empty when the plaintext is not compressed
+	}{
+		{name: "no compression", bucket: "plain"},
+		{name: "gzip", bucket: "gzip", algorithm: cfg.CompressionGzip},
+		{name: "zstd", bucket: "zstd", algorithm: cfg.CompressionZstd},
+		{name: "already encoded", bucket: "zstd", metadata: map[string]interface{}{ContentEncodingMetadataKey: "gzip"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcsMetadataMap := map[string]interface{}{}
+			if test.metadata != nil {
+				gcsMetadataMap["metadata"] = test.metadata
+			}
+			compressed, err := CompressPayload(test.bucket, gcsMetadataMap, plaintext)
+			if err != nil {
+				t.Fatalf("CompressPayload() error = %v", err)
+			}
+
+			customMetadata, _ := gcsMetadataMap["metadata"].(map[string]interface{})
+			if test.algorithm == "" {
+				if !bytes.Equal(compressed, plaintext) || customMetadata[CompressionMetadataKey] != nil {
+					t.Errorf("CompressPayload() compressed the plaintext, metadata %v", customMetadata)
+				}
+				return
+			}
+			if customMetadata[CompressionMetadataKey] != test.algorithm {
+				t.Errorf("CompressPayload() recorded %v, want %v", customMetadata[CompressionMetadataKey], test.algorithm)
+			}
+			if len(compressed) >= len(plaintext) {
+				t.Errorf("CompressPayload() = %v bytes, want less than %v", len(compressed), len(plaintext))
+			}
+			decompressed, err := Decompress(test.algorithm, compressed)
+			if err != nil {
+				t.Fatalf("Decompress() error = %v", err)
+			}
+			if !bytes.Equal(decompressed, plaintext) {
+				t.Errorf("Decompress() did not return the plaintext")
+			}
+		})
+	}
+}
+
+func TestGetCompression(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{Compression: map[string]string{"*": cfg.CompressionGzip, "fast": cfg.CompressionZstd}}
+	defer func() { cfg.GlobalConfig = previous }()
+
+	tests := map[string]string{
+		"fast":  cfg.CompressionZstd,
+		"other": cfg.CompressionGzip,
+		"":      cfg.CompressionGzip,
+	}
+	for bucketName, want := range tests {
+		if got := GetCompression(bucketName); got != want {
+			t.Errorf("GetCompression(%q) = %v, want %v", bucketName, got, want)
+		}
+	}
+
+	cfg.GlobalConfig = &cfg.Config{}
+	if got := GetCompression("fast"); got != cfg.CompressionNone {
+		t.Errorf("GetCompression() without a setting = %v, want %v", got, cfg.CompressionNone)
+	}
+}
+
+func TestCompressionErrors(t *testing.T) {
+	if _, err := Compress("brotli", []byte("a")); err == nil {
+		t.Errorf("Compress() of an unsupported algorithm succeeded")
+	}
+	if _, err := Decompress("brotli", []byte("a")); err == nil {
+		t.Errorf("Decompress() of an unsupported algorithm succeeded")
+	}
+	for _, algorithm := range []string{cfg.CompressionGzip, cfg.CompressionZstd} {
+		if _, err := Decompress(algorithm, []byte("not compressed")); err == nil {
+			t.Errorf("Decompress(%v) of invalid data succeeded", algorithm)
+		}
+	}
+}
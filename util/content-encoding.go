@@ -0,0 +1,95 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ContentEncodingMetadataKey records the contentEncoding the client gave the object. The ciphertext is
+// stored without a contentEncoding so GCS never tries to transcode it, the proxy does that on download.
+const ContentEncodingMetadataKey = "x-content-encoding"
+
+// MoveContentEncodingToMetadata moves the contentEncoding of an object resource, or the contentEncoding
+// query parameter of an insert, into the custom metadata and returns it. Identity encoding is dropped.
+func MoveContentEncodingToMetadata(gcsMetadataMap map[string]interface{}, requestUrl *url.URL) string {
+	contentEncoding, _ := gcsMetadataMap["contentEncoding"].(string)
+	delete(gcsMetadataMap, "contentEncoding")
+
+	query := requestUrl.Query()
+	if query.Has("contentEncoding") {
+		if contentEncoding == "" {
+			contentEncoding = query.Get("contentEncoding")
+		}
+		query.Del("contentEncoding")
+		requestUrl.RawQuery = query.Encode()
+	}
+
+	if contentEncoding == "" || strings.EqualFold(contentEncoding, "identity") {
+		return ""
+	}
+
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	if !ok {
+		customMetadata = map[string]interface{}{}
+		gcsMetadataMap["metadata"] = customMetadata
+	}
+	customMetadata[ContentEncodingMetadataKey] = contentEncoding
+	return contentEncoding
+}
+
+// AcceptsGzip reports whether the Accept-Encoding request header allows a gzip response.
+func AcceptsGzip(header http.Header) bool {
+	for _, headerValue := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(headerValue, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			// "gzip;q=0" explicitly refuses gzip
+			if qValue, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				if q, err := strconv.ParseFloat(qValue, 64); err == nil && q == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// IsNoTransform reports whether an object's Cache-Control metadata stops GCS from transcoding it.
+func IsNoTransform(cacheControl string) bool {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return true
+		}
+	}
+	return false
+}
+
+// Gunzip decompresses a gzip stream, concatenated members are read as one stream like GCS does.
+func Gunzip(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("error reading gzip header: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing gzip content: %w", err)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMoveContentEncodingToMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource map[string]interface{}
+		rawQuery string
+		want     string
+		query    string
+	}{
+		{"resource", map[string]interface{}{"contentEncoding": "gzip"}, "uploadType=multipart", "gzip", "uploadType=multipart"},
+		{"query", map[string]interface{}{}, "contentEncoding=gzip&uploadType=media", "gzip", "uploadType=media"},
+		{"resource wins", map[string]interface{}{"contentEncoding": "br"}, "contentEncoding=gzip", "br", ""},
+		{"identity", map[string]interface{}{"contentEncoding": "identity"}, "", "", ""},
+		{"none", map[string]interface{}{}, "uploadType=media", "", "uploadType=media"},
+	}
+
+	for _, test := range tests {
+		requestUrl := &url.URL{Path: "/upload/storage/v1/b/bkt/o", RawQuery: test.rawQuery}
+		got := MoveContentEncodingToMetadata(test.resource, requestUrl)
+		if got != test.want || requestUrl.RawQuery != test.query || test.resource["contentEncoding"] != nil {
+			t.Errorf("%v: MoveContentEncodingToMetadata() = %q, query %q, resource %v", test.name, got, requestUrl.RawQuery, test.resource)
+		}
+		customMetadata, _ := test.resource["metadata"].(map[string]interface{})
+		if test.want != "" && customMetadata[ContentEncodingMetadataKey] != test.want {
+			t.Errorf("%v: metadata = %v, want %v", test.name, customMetadata, test.want)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding []string
+		want           bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, true},
+		{[]string{"deflate, GZIP;q=0.5"}, true},
+		{[]string{"*"}, true},
+		{[]string{"gzip;q=0"}, false},
+		{[]string{"br", "gzip"}, true},
+		{[]string{"identity"}, false},
+		{[]string{"x-gzip"}, false},
+	}
+	for _, test := range tests {
+		header := http.Header{"Accept-Encoding": test.acceptEncoding}
+		if got := AcceptsGzip(header); got != test.want {
+			t.Errorf("AcceptsGzip(%q) = %v, want %v", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func TestIsNoTransform(t *testing.T) {
+	tests := map[string]bool{
+		"":                         false,
+		"no-transform":             true,
+		"public, No-Transform":     true,
+		"no-cache, max-age=60":     false,
+		"no-transformation-at-all": false,
+	}
+	for cacheControl, want := range tests {
+		if got := IsNoTransform(cacheControl); got != want {
+			t.Errorf("IsNoTransform(%q) = %v, want %v", cacheControl, got, want)
+		}
+	}
+}
+
+func TestGunzipConcatenatedMembers(t *testing.T) {
+	var compressed bytes.Buffer
+	for _, member := range []string{"first ", "second"} {
+		writer := gzip.NewWriter(&compressed)
+		writer.Write([]byte(member))
+		writer.Close()
+	}
+	plaintext, err := Gunzip(compressed.Bytes())
+	if err != nil || string(plaintext) != "first second" {
+		t.Errorf("Gunzip() = %q, %v, want both members", plaintext, err)
+	}
+	if _, err := Gunzip([]byte("not gzip")); err == nil {
+		t.Errorf("Gunzip() of invalid data succeeded")
+	}
+}
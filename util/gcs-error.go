@@ -0,0 +1,149 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GcsError is an error that should be returned to the client as a GCS style error response
+// instead of being forwarded upstream.
+// https://cloud.google.com/storage/docs/json_api/v1/status-codes
+type GcsError struct {
+	Code    int    // http status code
+	Reason  string // GCS error reason e.g. invalid, forbidden
+	Message string
+	Header  http.Header // sent with the error response e.g. the Content-Range of a 416, may be nil
+}
+
+func NewGcsError(code int, reason string, format string, args ...interface{}) *GcsError {
+	return &GcsError{
+		Code:    code,
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *GcsError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Code, e.Reason, e.Message)
+}
+
+// Json returns the error in the GCS JSON API error envelope.
+func (e *GcsError) Json() []byte {
+	envelope := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    e.Code,
+			"message": e.Message,
+			"errors": []map[string]interface{}{
+				{
+					"domain":  "global",
+					"reason":  e.Reason,
+					"message": e.Message,
+				},
+			},
+		},
+	}
+	jsonData, _ := json.Marshal(envelope)
+	return jsonData
+}
+
+// ToGcsError maps an error from a handler to the GCS error the client should see.
+// KMS and GCS API errors must be wrapped with %w to be classified, anything unknown is a 500.
+func ToGcsError(err error) *GcsError {
+	var gcsErr *GcsError
+	if errors.As(err, &gcsErr) {
+		return gcsErr
+	}
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return NewGcsError(http.StatusNotFound, "notFound", "No such object.")
+	}
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return NewGcsError(http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+	}
+	if errors.Is(err, crypto.ErrScopeKeyShredded) {
+		return NewGcsError(http.StatusGone, "gone", "The object was shredded: %v", err)
+	}
+
+	// only errors of KMS calls are reported as KMS errors, the proxy calls GCS with the same REST client
+	var kmsErr *crypto.KmsError
+	if errors.As(err, &kmsErr) {
+		return kmsToGcsError(kmsErr)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewGcsError(http.StatusServiceUnavailable, "backendError", "Request timed out: %v", err)
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			return NewGcsError(http.StatusForbidden, "forbidden", "Permission denied: %v", apiErr.Message)
+		case apiErr.Code == http.StatusNotFound:
+			return NewGcsError(http.StatusNotFound, "notFound", "Not found: %v", apiErr.Message)
+		case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+			return NewGcsError(http.StatusServiceUnavailable, "backendError", "Service unavailable: %v", apiErr.Message)
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return NewGcsError(http.StatusServiceUnavailable, "backendError", "Service unavailable: %v", err)
+	}
+
+	return NewGcsError(http.StatusInternalServerError, "backendError", "%v", err)
+}
+
+// kmsToGcsError maps the error of a KMS or Vault call, a key that can't be found or used is forbidden.
+func kmsToGcsError(err *crypto.KmsError) *GcsError {
+	if errors.Is(err, crypto.ErrKmsCircuitOpen) {
+		return NewGcsError(http.StatusServiceUnavailable, "backendError", "Key management service unavailable: %v", err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewGcsError(http.StatusServiceUnavailable, "backendError", "Key management service timed out: %v", err)
+	}
+
+	var vaultErr *crypto.VaultError
+	if errors.As(err, &vaultErr) {
+		switch {
+		case vaultErr.Code == http.StatusTooManyRequests || vaultErr.Code >= 500:
+			return NewGcsError(http.StatusServiceUnavailable, "backendError", "Key management service unavailable: %v", vaultErr)
+		case vaultErr.Code >= 400:
+			return NewGcsError(http.StatusForbidden, "forbidden", "Permission denied: %v", vaultErr)
+		}
+	}
+
+	// Cloud KMS uses gRPC
+	if grpcStatus, ok := status.FromError(err.Err); ok && grpcStatus.Code() != codes.Unknown {
+		switch grpcStatus.Code() {
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return NewGcsError(http.StatusForbidden, "forbidden", "Permission denied: %v", grpcStatus.Message())
+		case codes.NotFound:
+			return NewGcsError(http.StatusForbidden, "forbidden", "Encryption key not found: %v", grpcStatus.Message())
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+			return NewGcsError(http.StatusServiceUnavailable, "backendError", "Key management service unavailable: %v", grpcStatus.Message())
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return NewGcsError(http.StatusServiceUnavailable, "backendError", "Key management service unavailable: %v", err)
+	}
+
+	return NewGcsError(http.StatusInternalServerError, "backendError", "%v", err)
+}
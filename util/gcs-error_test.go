@@ -0,0 +1,94 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToGcsError(t *testing.T) {
+	kmsError := func(err error) error {
+		return fmt.Errorf("error encrypting data: %w", &crypto.KmsError{Key: "k", Operation: "encrypt", Err: err})
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		code   int
+		reason string
+	}{
+		{"gcs error", NewGcsError(http.StatusBadRequest, "invalid", "bad"), http.StatusBadRequest, "invalid"},
+		{"wrapped gcs error", fmt.Errorf("wrapped: %w", NewGcsError(http.StatusConflict, "conflict", "c")), http.StatusConflict, "conflict"},
+		{"object not found", fmt.Errorf("attrs: %w", storage.ErrObjectNotExist), http.StatusNotFound, "notFound"},
+		{"bucket not found", storage.ErrBucketNotExist, http.StatusNotFound, "notFound"},
+		{"shredded", fmt.Errorf("error decrypting data: %w", crypto.ErrScopeKeyShredded), http.StatusGone, "gone"},
+		{"deadline", fmt.Errorf("read: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "backendError"},
+		{"gcs forbidden", &googleapi.Error{Code: http.StatusForbidden}, http.StatusForbidden, "forbidden"},
+		{"gcs unauthorized", &googleapi.Error{Code: http.StatusUnauthorized}, http.StatusForbidden, "forbidden"},
+		{"gcs not found", &googleapi.Error{Code: http.StatusNotFound}, http.StatusNotFound, "notFound"},
+		{"gcs rate limited", &googleapi.Error{Code: http.StatusTooManyRequests}, http.StatusServiceUnavailable, "backendError"},
+		{"gcs unavailable", &googleapi.Error{Code: http.StatusBadGateway}, http.StatusServiceUnavailable, "backendError"},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusServiceUnavailable, "backendError"},
+		{"unknown", errors.New("boom"), http.StatusInternalServerError, "backendError"},
+
+		// KMS and Vault
+		{"kms circuit open", kmsError(crypto.ErrKmsCircuitOpen), http.StatusServiceUnavailable, "backendError"},
+		{"kms timeout", kmsError(fmt.Errorf("KMS call cancelled: %w", context.DeadlineExceeded)), http.StatusServiceUnavailable, "backendError"},
+		{"kms permission denied", kmsError(status.Error(codes.PermissionDenied, "denied")), http.StatusForbidden, "forbidden"},
+		{"kms unauthenticated", kmsError(status.Error(codes.Unauthenticated, "no token")), http.StatusForbidden, "forbidden"},
+		{"kms key not found", kmsError(status.Error(codes.NotFound, "no key")), http.StatusForbidden, "forbidden"},
+		{"kms unavailable", kmsError(status.Error(codes.Unavailable, "down")), http.StatusServiceUnavailable, "backendError"},
+		{"kms quota", kmsError(status.Error(codes.ResourceExhausted, "quota")), http.StatusServiceUnavailable, "backendError"},
+		{"kms invalid", kmsError(status.Error(codes.InvalidArgument, "bad")), http.StatusInternalServerError, "backendError"},
+		{"vault forbidden", kmsError(&crypto.VaultError{Code: http.StatusForbidden}), http.StatusForbidden, "forbidden"},
+		{"vault unavailable", kmsError(&crypto.VaultError{Code: http.StatusServiceUnavailable}), http.StatusServiceUnavailable, "backendError"},
+		{"kms network", kmsError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), http.StatusServiceUnavailable, "backendError"},
+		{"kms googleapi", kmsError(&googleapi.Error{Code: http.StatusNotFound}), http.StatusInternalServerError, "backendError"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcsErr := ToGcsError(test.err)
+			if gcsErr.Code != test.code || gcsErr.Reason != test.reason {
+				t.Errorf("ToGcsError(%v) = %v %v, want %v %v", test.err, gcsErr.Code, gcsErr.Reason, test.code, test.reason)
+			}
+		})
+	}
+}
+
+func TestGcsErrorJson(t *testing.T) {
+	var envelope struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Errors  []struct {
+				Domain  string `json:"domain"`
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	err := json.Unmarshal(NewGcsError(http.StatusForbidden, "forbidden", "no access to %v", "k").Json(), &envelope)
+	if err != nil {
+		t.Fatalf("Json() is not JSON: %v", err)
+	}
+	if envelope.Error.Code != http.StatusForbidden || envelope.Error.Message != "no access to k" ||
+		len(envelope.Error.Errors) != 1 || envelope.Error.Errors[0].Reason != "forbidden" || envelope.Error.Errors[0].Domain != "global" {
+		t.Errorf("Json() = %+v, want the GCS error envelope", envelope)
+	}
+}
@@ -0,0 +1,506 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// https://cloud.google.com/storage/docs/json_api/v1/objects
+// https://cloud.google.com/storage/docs/xml-api/overview
+type GcsOperationType int
+
+const (
+	UnknownOperation GcsOperationType = iota
+
+	// JSON API uploads
+	MultipartUpload       // uploadType=multipart, VERB=POST, path=/upload/storage/v1/b/bucket/o
+	MediaUpload           // uploadType=media,     VERB=POST, path=/upload/storage/v1/b/bucket/o
+	ResumableUploadStart  // uploadType=resumable, VERB=POST, path=/upload/storage/v1/b/bucket/o
+	ResumableUploadChunk  // uploadType=resumable, VERB=PUT,  path=/upload/storage/v1/b/bucket/o?upload_id=
+	ResumableUploadCancel // uploadType=resumable, VERB=DELETE, path=/upload/storage/v1/b/bucket/o?upload_id=
+	UnknownUpload         // any other request to an upload endpoint
+
+	// JSON API objects
+	ObjectDownload // VERB=GET, path=/storage/v1/b/bucket/o/object?alt=media or path=/download/storage/v1/b/bucket/o/object
+	ObjectMetadata // VERB=GET, path=/storage/v1/b/bucket/o/object
+	ObjectList     // VERB=GET, path=/storage/v1/b/bucket/o
+	ObjectPatch    // VERB=PATCH, path=/storage/v1/b/bucket/o/object
+	ObjectUpdate   // VERB=PUT, path=/storage/v1/b/bucket/o/object
+	ObjectDelete   // VERB=DELETE, path=/storage/v1/b/bucket/o/object
+	ObjectCompose  // VERB=POST, path=/storage/v1/b/bucket/o/object/compose
+	ObjectCopy     // VERB=POST, path=/storage/v1/b/bucket/o/object/copyTo/b/bucket/o/object
+	ObjectRewrite  // VERB=POST, path=/storage/v1/b/bucket/o/object/rewriteTo/b/bucket/o/object
+	ObjectRestore  // VERB=POST, path=/storage/v1/b/bucket/o/object/restore
+	ObjectAcl      // path=/storage/v1/b/bucket/o/object/acl
+	ObjectWatch    // VERB=POST, path=/storage/v1/b/bucket/o/watch
+
+	// JSON API buckets, projects and batches
+	BucketOperation  // path=/storage/v1/b or /storage/v1/b/bucket and its acl, iam, notification configs
+	ProjectOperation // path=/storage/v1/projects/...
+	Batch            // VERB=POST, path=/batch/storage/v1
+
+	// XML API, path=/bucket/object or virtual hosted bucket.storage.googleapis.com/object
+	XmlObjectDownload        // VERB=GET
+	XmlObjectMetadata        // VERB=HEAD
+	XmlObjectUpload          // VERB=PUT
+	XmlObjectCopy            // VERB=PUT, x-goog-copy-source header
+	XmlObjectDelete          // VERB=DELETE
+	XmlObjectAcl             // ?acl
+	XmlResumableUploadStart  // VERB=POST, x-goog-resumable: start
+	XmlMultipartUploadStart  // VERB=POST, ?uploads
+	XmlMultipartUploadPart   // VERB=PUT, ?uploadId=&partNumber=
+	XmlMultipartUploadFinish // VERB=POST, ?uploadId=
+	XmlMultipartUploadAbort  // VERB=DELETE, ?uploadId=
+	XmlFormUpload            // VERB=POST, path=/bucket, multipart/form-data policy document upload
+	XmlBucketOperation       // path=/bucket
+	XmlServiceOperation      // path=/
+)
+
+var gcsOperationNames = map[GcsOperationType]string{
+	UnknownOperation:         "unknown",
+	MultipartUpload:          "multipartUpload",
+	MediaUpload:              "mediaUpload",
+	ResumableUploadStart:     "resumableUploadStart",
+	ResumableUploadChunk:     "resumableUploadChunk",
+	ResumableUploadCancel:    "resumableUploadCancel",
+	UnknownUpload:            "unknownUpload",
+	ObjectDownload:           "objectDownload",
+	ObjectMetadata:           "objectMetadata",
+	ObjectList:               "objectList",
+	ObjectPatch:              "objectPatch",
+	ObjectUpdate:             "objectUpdate",
+	ObjectDelete:             "objectDelete",
+	ObjectCompose:            "objectCompose",
+	ObjectCopy:               "objectCopy",
+	ObjectRewrite:            "objectRewrite",
+	ObjectRestore:            "objectRestore",
+	ObjectAcl:                "objectAcl",
+	ObjectWatch:              "objectWatch",
+	BucketOperation:          "bucketOperation",
+	ProjectOperation:         "projectOperation",
+	Batch:                    "batch",
+	XmlObjectDownload:        "xmlObjectDownload",
+	XmlObjectMetadata:        "xmlObjectMetadata",
+	XmlObjectUpload:          "xmlObjectUpload",
+	XmlObjectCopy:            "xmlObjectCopy",
+	XmlObjectDelete:          "xmlObjectDelete",
+	XmlObjectAcl:             "xmlObjectAcl",
+	XmlResumableUploadStart:  "xmlResumableUploadStart",
+	XmlMultipartUploadStart:  "xmlMultipartUploadStart",
+	XmlMultipartUploadPart:   "xmlMultipartUploadPart",
+	XmlMultipartUploadFinish: "xmlMultipartUploadFinish",
+	XmlMultipartUploadAbort:  "xmlMultipartUploadAbort",
+	XmlFormUpload:            "xmlFormUpload",
+	XmlBucketOperation:       "xmlBucketOperation",
+	XmlServiceOperation:      "xmlServiceOperation",
+}
+
+func (t GcsOperationType) String() string {
+	return gcsOperationNames[t]
+}
+
+// GcsOperation is a classified GCS request. Bucket and object names are unescaped.
+type GcsOperation struct {
+	Type              GcsOperationType
+	Bucket            string
+	Object            string // empty for bucket operations and multipart uploads, which name the object in the body
+	Generation        int64  // 0 when the request does not target a specific generation
+	DestinationBucket string // copy and rewrite
+	DestinationObject string // copy and rewrite
+	SourceBucket      string // XML copies, named by the x-goog-copy-source header
+	SourceObject      string // XML copies
+	UploadId          string // resumable and XML multipart uploads
+
+	// the requests of a batch, nil when the batch body can't be parsed
+	BatchOperations []*GcsOperation
+
+	// start and end of the escaped object names in the request path, zero when not in the path
+	objectPath            [2]int
+	destinationObjectPath [2]int
+}
+
+func (op *GcsOperation) isXmlApi() bool {
+	return op.Type >= XmlObjectDownload
+}
+
+// SetObject renames the object a request targets, in the path and in the name query parameter.
+func (op *GcsOperation) SetObject(req *proxy.Request, object string) {
+	if op.objectPath[1] > 0 {
+		op.replaceInPath(req, op.objectPath, object)
+	}
+	query := req.URL.Query()
+	if query.Has("name") {
+		query.Set("name", object)
+		req.URL.RawQuery = query.Encode()
+	}
+	op.Object = object
+}
+
+// SetDestinationObject renames the destination object of a copy or rewrite.
+func (op *GcsOperation) SetDestinationObject(req *proxy.Request, object string) {
+	if op.destinationObjectPath[1] > 0 {
+		op.replaceInPath(req, op.destinationObjectPath, object)
+	}
+	op.DestinationObject = object
+}
+
+func (op *GcsOperation) replaceInPath(req *proxy.Request, span [2]int, object string) {
+	// the JSON API escapes the slashes in object names, the XML API keeps them
+	escapedObject := url.PathEscape(object)
+	if op.isXmlApi() {
+		segments := strings.Split(object, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		escapedObject = strings.Join(segments, "/")
+	}
+
+	escapedPath := req.URL.EscapedPath()
+	newEscapedPath := escapedPath[:span[0]] + escapedObject + escapedPath[span[1]:]
+	path, err := url.PathUnescape(newEscapedPath)
+	if err != nil {
+		log.Errorf("invalid escaped path %v: %v", newEscapedPath, err)
+		return
+	}
+
+	// the span of a later group moves with the new length
+	shift := len(newEscapedPath) - len(escapedPath)
+	if op.destinationObjectPath[0] > span[0] {
+		op.destinationObjectPath[0] += shift
+		op.destinationObjectPath[1] += shift
+	}
+
+	req.URL.Path = path
+	req.URL.RawPath = newEscapedPath
+}
+
+// IsObjectWrite reports if the operation writes object data, uploads as well as copies, rewrites and
+// composes. A batch is a write when one of its requests is, or when its requests can't be parsed.
+func (op *GcsOperation) IsObjectWrite() bool {
+	switch op.Type {
+	case MultipartUpload, MediaUpload, ResumableUploadStart, ResumableUploadChunk, UnknownUpload,
+		ObjectCompose, ObjectCopy, ObjectRewrite,
+		XmlObjectUpload, XmlObjectCopy, XmlResumableUploadStart, XmlMultipartUploadStart, XmlMultipartUploadPart,
+		XmlMultipartUploadFinish, XmlFormUpload:
+		return true
+	case Batch:
+		if op.BatchOperations == nil {
+			return true
+		}
+		for _, batchOp := range op.BatchOperations {
+			if batchOp.IsObjectWrite() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsObjectRead reports if the response of the operation carries object data or object resources, whose
+// size, hashes and metadata the proxy reports in plaintext. Patches and updates return the resource too.
+// A batch is a read when one of its requests is.
+func (op *GcsOperation) IsObjectRead() bool {
+	switch op.Type {
+	case ObjectDownload, ObjectMetadata, ObjectList, ObjectPatch, ObjectUpdate, ObjectRestore,
+		XmlObjectDownload, XmlObjectMetadata:
+		return true
+	case Batch:
+		for _, batchOp := range op.BatchOperations {
+			if batchOp.IsObjectRead() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Buckets returns every bucket the operation reads or writes, the source and destination of a copy
+// and the buckets of all requests of a batch.
+func (op *GcsOperation) Buckets() []string {
+	var buckets []string
+	for _, bucket := range []string{op.Bucket, op.DestinationBucket, op.SourceBucket} {
+		if bucket != "" {
+			buckets = append(buckets, bucket)
+		}
+	}
+	for _, batchOp := range op.BatchOperations {
+		buckets = append(buckets, batchOp.Buckets()...)
+	}
+	return buckets
+}
+
+// WrittenBuckets returns the buckets an object write stores data in, the destination of a copy or rewrite.
+func (op *GcsOperation) WrittenBuckets() []string {
+	if op.Type == Batch {
+		var buckets []string
+		for _, batchOp := range op.BatchOperations {
+			if batchOp.IsObjectWrite() {
+				buckets = append(buckets, batchOp.WrittenBuckets()...)
+			}
+		}
+		return buckets
+	}
+	if op.DestinationBucket != "" {
+		return []string{op.DestinationBucket}
+	}
+	if op.Bucket != "" {
+		return []string{op.Bucket}
+	}
+	return nil
+}
+
+// gcsRoute maps a request to an operation. Routes are matched in order, the first match wins.
+type gcsRoute struct {
+	method  string                        // empty matches any method
+	path    *regexp.Regexp                // matched against the escaped path, named groups: bucket, object, destBucket, destObject
+	matches func(req *proxy.Request) bool // optional extra check on the query string or headers
+	opType  GcsOperationType
+}
+
+const (
+	bucketGroup     = `(?P<bucket>[^/]+)`
+	objectGroup     = `(?P<object>.+)`
+	destBucketGroup = `(?P<destBucket>[^/]+)`
+	destObjectGroup = `(?P<destObject>.+)`
+)
+
+func routePath(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+func queryEquals(key string, value string) func(req *proxy.Request) bool {
+	return func(req *proxy.Request) bool {
+		return req.URL.Query().Get(key) == value
+	}
+}
+
+func queryHas(key string) func(req *proxy.Request) bool {
+	return func(req *proxy.Request) bool {
+		return req.URL.Query().Has(key)
+	}
+}
+
+func headerEquals(key string, value string) func(req *proxy.Request) bool {
+	return func(req *proxy.Request) bool {
+		return strings.EqualFold(req.Header.Get(key), value)
+	}
+}
+
+func headerPrefix(key string, prefix string) func(req *proxy.Request) bool {
+	return func(req *proxy.Request) bool {
+		return strings.HasPrefix(strings.ToLower(req.Header.Get(key)), prefix)
+	}
+}
+
+func headerHas(key string) func(req *proxy.Request) bool {
+	return func(req *proxy.Request) bool {
+		return req.Header.Get(key) != ""
+	}
+}
+
+var (
+	uploadPath          = routePath(`/upload/storage/v1/b/` + bucketGroup + `/o`)
+	resumableUploadPath = routePath(`/resumable/upload/storage/v1/b/` + bucketGroup + `/o`)
+	objectPath          = routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup)
+	xmlObjectPath       = routePath(`/` + bucketGroup + `/` + objectGroup)
+)
+
+// Path style routes. Virtual hosted XML requests are rewritten to path style before matching.
+var gcsRoutes = []gcsRoute{
+	// JSON API uploads
+	{"POST", uploadPath, queryEquals("uploadType", "multipart"), MultipartUpload},
+	{"POST", uploadPath, queryEquals("uploadType", "media"), MediaUpload},
+	{"POST", uploadPath, queryEquals("uploadType", "resumable"), ResumableUploadStart},
+	{"PUT", uploadPath, queryHas("upload_id"), ResumableUploadChunk},
+	{"POST", uploadPath, queryHas("upload_id"), ResumableUploadChunk}, // some clients POST chunks
+	{"DELETE", uploadPath, queryHas("upload_id"), ResumableUploadCancel},
+	{"POST", resumableUploadPath, nil, ResumableUploadStart},
+	{"PUT", resumableUploadPath, nil, ResumableUploadChunk},
+	{"DELETE", resumableUploadPath, nil, ResumableUploadCancel},
+	{"", uploadPath, nil, UnknownUpload},
+	{"", resumableUploadPath, nil, UnknownUpload},
+
+	// JSON API downloads
+	{"GET", routePath(`/download/storage/v1/b/` + bucketGroup + `/o/` + objectGroup), nil, ObjectDownload},
+	{"GET", objectPath, queryEquals("alt", "media"), ObjectDownload},
+
+	// JSON API objects, sub resources before the object itself since object names may contain slashes
+	{"POST", routePath(`/storage/v1/b/` + bucketGroup + `/o/watch`), nil, ObjectWatch},
+	{"GET", routePath(`/storage/v1/b/` + bucketGroup + `/o`), nil, ObjectList},
+	{"POST", routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup + `/compose`), nil, ObjectCompose},
+	{"POST", routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup + `/copyTo/b/` + destBucketGroup + `/o/` + destObjectGroup), nil, ObjectCopy},
+	{"POST", routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup + `/rewriteTo/b/` + destBucketGroup + `/o/` + destObjectGroup), nil, ObjectRewrite},
+	{"POST", routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup + `/restore`), nil, ObjectRestore},
+	{"", routePath(`/storage/v1/b/` + bucketGroup + `/o/` + objectGroup + `/acl(/[^/]+)?`), nil, ObjectAcl},
+	{"GET", objectPath, nil, ObjectMetadata},
+	{"PATCH", objectPath, nil, ObjectPatch},
+	{"PUT", objectPath, nil, ObjectUpdate},
+	{"DELETE", objectPath, nil, ObjectDelete},
+
+	// JSON API buckets, projects and batches
+	{"", routePath(`/storage/v1/b`), nil, BucketOperation},
+	{"", routePath(`/storage/v1/b/` + bucketGroup + `(/.*)?`), nil, BucketOperation},
+	{"", routePath(`/storage/v1/projects/.*`), nil, ProjectOperation},
+	{"POST", routePath(`/batch(/storage/v1)?`), nil, Batch},
+	{"", routePath(`/(resumable/)?upload/.*`), nil, UnknownUpload},
+	{"", routePath(`/(download/)?storage/v1/.*`), nil, UnknownOperation},
+
+	// XML API objects
+	{"", xmlObjectPath, queryHas("acl"), XmlObjectAcl},
+	{"PUT", xmlObjectPath, queryHas("uploadId"), XmlMultipartUploadPart},
+	{"POST", xmlObjectPath, queryHas("uploads"), XmlMultipartUploadStart},
+	{"POST", xmlObjectPath, queryHas("uploadId"), XmlMultipartUploadFinish},
+	{"DELETE", xmlObjectPath, queryHas("uploadId"), XmlMultipartUploadAbort},
+	{"POST", xmlObjectPath, headerEquals("x-goog-resumable", "start"), XmlResumableUploadStart},
+	{"PUT", xmlObjectPath, headerHas("x-goog-copy-source"), XmlObjectCopy},
+	{"PUT", xmlObjectPath, nil, XmlObjectUpload},
+	{"GET", xmlObjectPath, nil, XmlObjectDownload},
+	{"HEAD", xmlObjectPath, nil, XmlObjectMetadata},
+	{"DELETE", xmlObjectPath, nil, XmlObjectDelete},
+
+	// XML API buckets
+	{"POST", routePath(`/` + bucketGroup + `/?`), headerPrefix("Content-Type", "multipart/form-data"), XmlFormUpload},
+	{"", routePath(`/` + bucketGroup + `/?`), nil, XmlBucketOperation},
+	{"", routePath(`/?`), nil, XmlServiceOperation},
+}
+
+// RouteGcsRequest classifies a request to a GCS host. It never modifies the request.
+func RouteGcsRequest(req *proxy.Request) *GcsOperation {
+	escapedPath := req.URL.EscapedPath()
+
+	// virtual hosted XML requests carry the bucket in the host: bucket.storage.googleapis.com/object
+	hostBucketLen := 0
+	if bucketName, found := strings.CutSuffix(req.URL.Hostname(), ".storage.googleapis.com"); found {
+		hostBucketLen = len("/" + url.PathEscape(bucketName))
+		escapedPath = "/" + url.PathEscape(bucketName) + escapedPath
+	}
+
+	op := &GcsOperation{Type: UnknownOperation}
+	for _, route := range gcsRoutes {
+		if route.method != "" && route.method != req.Method {
+			continue
+		}
+		groups := route.path.FindStringSubmatchIndex(escapedPath)
+		if groups == nil {
+			continue
+		}
+		if route.matches != nil && !route.matches(req) {
+			continue
+		}
+
+		op.Type = route.opType
+		for i, name := range route.path.SubexpNames() {
+			start, end := groups[2*i], groups[2*i+1]
+			if start < 0 {
+				continue
+			}
+			value, err := url.PathUnescape(escapedPath[start:end])
+			if err != nil {
+				value = escapedPath[start:end]
+			}
+			// spans are kept relative to the request path, without the virtual hosted bucket
+			span := [2]int{start - hostBucketLen, end - hostBucketLen}
+			switch name {
+			case "bucket":
+				op.Bucket = value
+			case "object":
+				op.Object = value
+				op.objectPath = span
+			case "destBucket":
+				op.DestinationBucket = value
+			case "destObject":
+				op.DestinationObject = value
+				op.destinationObjectPath = span
+			}
+		}
+		break
+	}
+
+	query := req.URL.Query()
+	if op.Object == "" && query.Get("name") != "" {
+		// media and resumable uploads name the object in the query string
+		op.Object = query.Get("name")
+	}
+	if generation, err := strconv.ParseInt(query.Get("generation"), 10, 64); err == nil {
+		op.Generation = generation
+	}
+	op.UploadId = query.Get("upload_id")
+	if op.UploadId == "" {
+		op.UploadId = query.Get("uploadId")
+	}
+
+	switch op.Type {
+	case XmlObjectCopy:
+		op.SourceBucket, op.SourceObject = parseCopySource(req.Header.Get("x-goog-copy-source"))
+	case Batch:
+		batchOps, err := routeBatchRequest(req)
+		if err != nil {
+			log.Warnf("unable to parse batch request: %v", err)
+		} else {
+			op.BatchOperations = batchOps
+		}
+	}
+
+	log.Debugf("RouteGcsRequest %v %v: %v gs://%v/%v", req.Method, escapedPath, op.Type, op.Bucket, op.Object)
+	return op
+}
+
+// parseCopySource splits the escaped bucket/object, or /bucket/object, of an x-goog-copy-source header
+func parseCopySource(copySource string) (string, string) {
+	escapedBucket, escapedObject, _ := strings.Cut(strings.TrimPrefix(copySource, "/"), "/")
+	bucket, err := url.PathUnescape(escapedBucket)
+	if err != nil {
+		bucket = escapedBucket
+	}
+	object, err := url.PathUnescape(escapedObject)
+	if err != nil {
+		object = escapedObject
+	}
+	return bucket, object
+}
+
+// routeBatchRequest classifies the requests of a JSON API batch, every part of its multipart/mixed body
+// is an HTTP request.
+func routeBatchRequest(req *proxy.Request) ([]*GcsOperation, error) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("batch request is not multipart: '%v'", req.Header.Get("Content-Type"))
+	}
+
+	batchOps := []*GcsOperation{}
+	reader := multipart.NewReader(bytes.NewReader(req.Body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return batchOps, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch request: %w", err)
+		}
+		partReq, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid request in batch: %w", err)
+		}
+		if partReq.URL.Host == "" {
+			partReq.URL.Host = req.URL.Host
+		}
+		batchOps = append(batchOps, RouteGcsRequest(&proxy.Request{Method: partReq.Method, URL: partReq.URL, Header: partReq.Header}))
+	}
+}
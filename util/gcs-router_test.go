@@ -0,0 +1,203 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/byronwhitlock-google/go-mitmproxy/proxy"
+)
+
+func TestRouteGcsRequest(t *testing.T) {
+	const host = "https://storage.googleapis.com"
+
+	tests := []struct {
+		method string
+		url    string
+		header http.Header
+		want   GcsOperation
+	}{
+		// JSON API uploads
+		{"POST", host + "/upload/storage/v1/b/bkt/o?uploadType=multipart", nil,
+			GcsOperation{Type: MultipartUpload, Bucket: "bkt"}},
+		{"POST", host + "/upload/storage/v1/b/bkt/o?uploadType=media&name=dir%2Fobj", nil,
+			GcsOperation{Type: MediaUpload, Bucket: "bkt", Object: "dir/obj"}},
+		{"POST", host + "/upload/storage/v1/b/bkt/o?uploadType=resumable&name=obj", nil,
+			GcsOperation{Type: ResumableUploadStart, Bucket: "bkt", Object: "obj"}},
+		{"PUT", host + "/upload/storage/v1/b/bkt/o?uploadType=resumable&upload_id=u1", nil,
+			GcsOperation{Type: ResumableUploadChunk, Bucket: "bkt", UploadId: "u1"}},
+		{"DELETE", host + "/upload/storage/v1/b/bkt/o?upload_id=u1", nil,
+			GcsOperation{Type: ResumableUploadCancel, Bucket: "bkt", UploadId: "u1"}},
+		{"POST", host + "/upload/storage/v1/b/bkt/o?uploadType=other", nil,
+			GcsOperation{Type: UnknownUpload, Bucket: "bkt"}},
+
+		// JSON API objects
+		{"GET", host + "/storage/v1/b/bkt/o/dir%2Fobj?alt=media", nil,
+			GcsOperation{Type: ObjectDownload, Bucket: "bkt", Object: "dir/obj"}},
+		{"GET", host + "/download/storage/v1/b/bkt/o/obj?generation=5", nil,
+			GcsOperation{Type: ObjectDownload, Bucket: "bkt", Object: "obj", Generation: 5}},
+		{"GET", host + "/storage/v1/b/bkt/o/obj", nil,
+			GcsOperation{Type: ObjectMetadata, Bucket: "bkt", Object: "obj"}},
+		{"GET", host + "/storage/v1/b/bkt/o?prefix=dir", nil,
+			GcsOperation{Type: ObjectList, Bucket: "bkt"}},
+		{"PATCH", host + "/storage/v1/b/bkt/o/obj", nil,
+			GcsOperation{Type: ObjectPatch, Bucket: "bkt", Object: "obj"}},
+		{"PUT", host + "/storage/v1/b/bkt/o/obj", nil,
+			GcsOperation{Type: ObjectUpdate, Bucket: "bkt", Object: "obj"}},
+		{"DELETE", host + "/storage/v1/b/bkt/o/obj", nil,
+			GcsOperation{Type: ObjectDelete, Bucket: "bkt", Object: "obj"}},
+		{"POST", host + "/storage/v1/b/bkt/o/obj/compose", nil,
+			GcsOperation{Type: ObjectCompose, Bucket: "bkt", Object: "obj"}},
+		{"POST", host + "/storage/v1/b/src/o/a%2Fb/copyTo/b/dst/o/c%2Fd", nil,
+			GcsOperation{Type: ObjectCopy, Bucket: "src", Object: "a/b", DestinationBucket: "dst", DestinationObject: "c/d"}},
+		{"POST", host + "/storage/v1/b/src/o/a/rewriteTo/b/dst/o/b", nil,
+			GcsOperation{Type: ObjectRewrite, Bucket: "src", Object: "a", DestinationBucket: "dst", DestinationObject: "b"}},
+		{"POST", host + "/storage/v1/b/bkt/o/obj/restore?generation=7", nil,
+			GcsOperation{Type: ObjectRestore, Bucket: "bkt", Object: "obj", Generation: 7}},
+		{"GET", host + "/storage/v1/b/bkt/o/obj/acl", nil,
+			GcsOperation{Type: ObjectAcl, Bucket: "bkt", Object: "obj"}},
+		{"POST", host + "/storage/v1/b/bkt/o/watch", nil,
+			GcsOperation{Type: ObjectWatch, Bucket: "bkt"}},
+
+		// JSON API buckets and projects
+		{"GET", host + "/storage/v1/b?project=p", nil,
+			GcsOperation{Type: BucketOperation}},
+		{"GET", host + "/storage/v1/b/bkt/iam", nil,
+			GcsOperation{Type: BucketOperation, Bucket: "bkt"}},
+		{"GET", host + "/storage/v1/projects/p/serviceAccount", nil,
+			GcsOperation{Type: ProjectOperation}},
+
+		// XML API
+		{"GET", host + "/bkt/dir/obj", nil,
+			GcsOperation{Type: XmlObjectDownload, Bucket: "bkt", Object: "dir/obj"}},
+		{"GET", "https://bkt.storage.googleapis.com/dir/obj", nil,
+			GcsOperation{Type: XmlObjectDownload, Bucket: "bkt", Object: "dir/obj"}},
+		{"HEAD", host + "/bkt/obj", nil,
+			GcsOperation{Type: XmlObjectMetadata, Bucket: "bkt", Object: "obj"}},
+		{"PUT", host + "/bkt/obj", nil,
+			GcsOperation{Type: XmlObjectUpload, Bucket: "bkt", Object: "obj"}},
+		{"PUT", host + "/bkt/obj", http.Header{"X-Goog-Copy-Source": {"/src/a%20b"}},
+			GcsOperation{Type: XmlObjectCopy, Bucket: "bkt", Object: "obj", SourceBucket: "src", SourceObject: "a b"}},
+		{"DELETE", host + "/bkt/obj", nil,
+			GcsOperation{Type: XmlObjectDelete, Bucket: "bkt", Object: "obj"}},
+		{"GET", host + "/bkt/obj?acl", nil,
+			GcsOperation{Type: XmlObjectAcl, Bucket: "bkt", Object: "obj"}},
+		{"POST", host + "/bkt/obj", http.Header{"X-Goog-Resumable": {"start"}},
+			GcsOperation{Type: XmlResumableUploadStart, Bucket: "bkt", Object: "obj"}},
+		{"POST", host + "/bkt/obj?uploads", nil,
+			GcsOperation{Type: XmlMultipartUploadStart, Bucket: "bkt", Object: "obj"}},
+		{"PUT", host + "/bkt/obj?uploadId=u2&partNumber=1", nil,
+			GcsOperation{Type: XmlMultipartUploadPart, Bucket: "bkt", Object: "obj", UploadId: "u2"}},
+		{"POST", host + "/bkt/obj?uploadId=u2", nil,
+			GcsOperation{Type: XmlMultipartUploadFinish, Bucket: "bkt", Object: "obj", UploadId: "u2"}},
+		{"DELETE", host + "/bkt/obj?uploadId=u2", nil,
+			GcsOperation{Type: XmlMultipartUploadAbort, Bucket: "bkt", Object: "obj", UploadId: "u2"}},
+		{"POST", host + "/bkt", http.Header{"Content-Type": {"multipart/form-data; boundary=b"}},
+			GcsOperation{Type: XmlFormUpload, Bucket: "bkt"}},
+		{"GET", host + "/bkt/", nil,
+			GcsOperation{Type: XmlBucketOperation, Bucket: "bkt"}},
+		{"GET", host + "/", nil,
+			GcsOperation{Type: XmlServiceOperation}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.url, func(t *testing.T) {
+			requestURL, _ := url.Parse(test.url)
+			op := RouteGcsRequest(&proxy.Request{Method: test.method, URL: requestURL, Header: test.header})
+			op.objectPath, op.destinationObjectPath = [2]int{}, [2]int{}
+			if !reflect.DeepEqual(*op, test.want) {
+				t.Errorf("RouteGcsRequest() = %+v, want %+v", *op, test.want)
+			}
+		})
+	}
+}
+
+func TestRouteBatchRequest(t *testing.T) {
+	body := strings.Join([]string{
+		"--batch",
+		"Content-Type: application/http",
+		"",
+		"DELETE /storage/v1/b/bkt/o/a HTTP/1.1",
+		"",
+		"",
+		"--batch",
+		"Content-Type: application/http",
+		"",
+		"POST /storage/v1/b/src/o/b/rewriteTo/b/dst/o/c HTTP/1.1",
+		"",
+		"",
+		"--batch--",
+		"",
+	}, "\r\n")
+	batchURL, _ := url.Parse("https://storage.googleapis.com/batch/storage/v1")
+	header := http.Header{"Content-Type": {"multipart/mixed; boundary=batch"}}
+
+	op := RouteGcsRequest(&proxy.Request{Method: "POST", URL: batchURL, Header: header, Body: []byte(body)})
+	if op.Type != Batch || len(op.BatchOperations) != 2 {
+		t.Fatalf("RouteGcsRequest() = %v with %v operations, want a batch of 2", op.Type, len(op.BatchOperations))
+	}
+	if op.BatchOperations[0].Type != ObjectDelete || op.BatchOperations[1].Type != ObjectRewrite {
+		t.Errorf("batch operations = %v, %v, want objectDelete, objectRewrite",
+			op.BatchOperations[0].Type, op.BatchOperations[1].Type)
+	}
+	if !op.IsObjectWrite() {
+		t.Errorf("IsObjectWrite() of a batch with a rewrite = false")
+	}
+	if op.BatchOperations[0].IsObjectWrite() || op.BatchOperations[0].IsObjectRead() {
+		t.Errorf("a delete is an object write or read")
+	}
+	if buckets := op.WrittenBuckets(); !reflect.DeepEqual(buckets, []string{"dst"}) {
+		t.Errorf("WrittenBuckets() = %v, want [dst]", buckets)
+	}
+	if buckets := op.Buckets(); !reflect.DeepEqual(buckets, []string{"bkt", "src", "dst"}) {
+		t.Errorf("Buckets() = %v, want [bkt src dst]", buckets)
+	}
+
+	// a batch that can't be parsed may contain anything
+	op = RouteGcsRequest(&proxy.Request{Method: "POST", URL: batchURL, Header: http.Header{}, Body: []byte(body)})
+	if op.BatchOperations != nil || !op.IsObjectWrite() {
+		t.Errorf("RouteGcsRequest() of an unparsable batch = %+v, want an object write", op)
+	}
+}
+
+func TestSetObject(t *testing.T) {
+	tests := []struct {
+		method      string
+		url         string
+		object      string
+		destination string
+		wantPath    string
+		wantQuery   string
+	}{
+		{"GET", "https://storage.googleapis.com/storage/v1/b/bkt/o/a%2Fb?alt=media",
+			"x/y", "", "/storage/v1/b/bkt/o/x%2Fy", "alt=media"},
+		{"GET", "https://storage.googleapis.com/bkt/a/b",
+			"x y/z", "", "/bkt/x%20y/z", ""},
+		{"GET", "https://bkt.storage.googleapis.com/a",
+			"x/y", "", "/x/y", ""},
+		{"POST", "https://storage.googleapis.com/upload/storage/v1/b/bkt/o?name=a&uploadType=media",
+			"x/y", "", "/upload/storage/v1/b/bkt/o", "name=x%2Fy&uploadType=media"},
+		{"POST", "https://storage.googleapis.com/storage/v1/b/src/o/a/copyTo/b/dst/o/b",
+			"long/name", "other", "/storage/v1/b/src/o/long%2Fname/copyTo/b/dst/o/other", ""},
+	}
+
+	for _, test := range tests {
+		requestURL, _ := url.Parse(test.url)
+		req := &proxy.Request{Method: test.method, URL: requestURL}
+		op := RouteGcsRequest(req)
+		op.SetObject(req, test.object)
+		if test.destination != "" {
+			op.SetDestinationObject(req, test.destination)
+		}
+		if req.URL.EscapedPath() != test.wantPath || req.URL.RawQuery != test.wantQuery {
+			t.Errorf("SetObject(%v) = %v?%v, want %v?%v", test.url, req.URL.EscapedPath(), req.URL.RawQuery, test.wantPath, test.wantQuery)
+		}
+	}
+}
@@ -13,10 +13,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"cloud.google.com/go/storage"
 	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 )
@@ -39,7 +43,7 @@ func updateGcsMetadata(ctx context.Context, authHeader string, bucketName string
 
 	bearerToken, err := parseBearerToken(authHeader)
 	if err != nil {
-		return fmt.Errorf("error parsing bearer token:%v", err)
+		return fmt.Errorf("error parsing bearer token:%w", err)
 	}
 
 	// lets use the google SDK so we get some error handling and such.
@@ -49,7 +53,7 @@ func updateGcsMetadata(ctx context.Context, authHeader string, bucketName string
 	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: bearerToken})
 	client, err := storage.NewClient(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
-		return fmt.Errorf("failed to create client: %v", err)
+		return fmt.Errorf("failed to create client: %w", err)
 	}
 	defer client.Close()
 
@@ -66,32 +70,54 @@ func updateGcsMetadata(ctx context.Context, authHeader string, bucketName string
 		},
 	}
 	if _, err := obj.Update(ctx, objectAttrsToUpdate); err != nil {
-		return fmt.Errorf("failed to update object metadata: %v", err)
+		return fmt.Errorf("failed to update object metadata: %w", err)
 	}
-	log.Debug("Object metadata updated successfully for gs://%v/%v.", bucketName, objectName)
+	log.Debugf("Object metadata updated successfully for gs://%v/%v.", bucketName, objectName)
 	return nil
 }
 
+var (
+	storageClientMutex sync.Mutex
+	storageClient      *storage.Client // shared by the lookups of the proxy, it outlives the requests
+)
 
-func GetObjectEncryptionKeyId(ctx context.Context, bucketName string, objectName string) (string,error) {
+// getStorageClient returns the client the proxy reads metadata with, it uses the proxy's credentials.
+func getStorageClient() (*storage.Client, error) {
+	storageClientMutex.Lock()
+	defer storageClientMutex.Unlock()
+	if storageClient == nil {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %w", err)
+		}
+		storageClient = client
+	}
+	return storageClient, nil
+}
+
+// generation 0 is the live version of the object
+func GetObjectAttrs(ctx context.Context, bucketName string, objectName string, generation int64) (_ *storage.ObjectAttrs, err error) {
+	ctx, span := crypto.Tracer.Start(ctx, "getObjectAttrs", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("bucket", bucketName)))
+	defer func() { crypto.EndSpan(span, err) }()
 
 	// lets use the google SDK so we get some error handling and such.
-	// Create a new storage client with the bearer token
-	log.Debugf("updating  gs://%v/%v metadata.", bucketName, objectName)
-	
-	client, err := storage.NewClient(ctx)
+	log.Debugf("fetching gs://%v/%v metadata.", bucketName, objectName)
+
+	client, err := getStorageClient()
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return nil, err
 	}
-	defer client.Close()
 
 	// Get a handle to the object
 	obj := client.Bucket(bucketName).Object(objectName)
+	if generation != 0 {
+		obj = obj.Generation(generation)
+	}
 
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		return "",fmt.Errorf("failed to get object attributes: %v", err)
+		return nil, fmt.Errorf("failed to get object attributes: %w", err)
 	}
-	log.Debug("Encryption Key ID %v fetched successfully for gs://%v/%v.",attrs.Metadata["x-encryption-key"], bucketName, objectName)
-	return attrs.Metadata["x-encryption-key"], nil
+	return attrs, nil
 }
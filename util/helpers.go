@@ -6,6 +6,7 @@ This software is provided as-is, without warranty or representation for any use
 package util
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/textproto"
@@ -18,7 +19,26 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// GetKMSKeyName returns the key of bucketName from the static mapping, or from the bucket's key label
+// when it is not mapped. An empty key means the bucket is not encrypted.
 func GetKMSKeyName(bucketName string) string {
+	if keyName := getStaticKMSKeyName(bucketName); keyName != "" || !IsKeyLabelEnabled() || bucketName == "" {
+		return keyName
+	}
+	// ResolveBucketKey looked the label up for the request, or rejected the request when it couldn't
+	return getLabelKeyName(bucketName)
+}
+
+// MetricBucketLabel returns the bucket label of metrics, the bucket when it is mapped and "other" for any
+// other bucket, so clients can't add a series for every bucket name they make up.
+func MetricBucketLabel(bucketName string) string {
+	if bucketName == "" || GetKMSKeyName(bucketName) == "" {
+		return "other"
+	}
+	return bucketName
+}
+
+func getStaticKMSKeyName(bucketName string) string {
 
 	bucketMap := cfg.GlobalConfig.KmsBucketKeyMapping
 
@@ -43,6 +63,53 @@ func GetKMSKeyName(bucketName string) string {
 
 }
 
+// IsFailOpen reports if writes to bucketName should be forwarded unencrypted when they can't be encrypted.
+// The bucket's own policy wins over the global (*) policy, the default is fail closed.
+func IsFailOpen(bucketName string) bool {
+	failurePolicy := cfg.GlobalConfig.FailurePolicy
+
+	if value, exists := failurePolicy[bucketName]; exists {
+		return value == cfg.FailOpen
+	}
+	if value, exists := failurePolicy["*"]; exists {
+		return value == cfg.FailOpen
+	}
+	return false
+}
+
+// GetCompression returns the algorithm objects written to bucketName are compressed with before encryption.
+// The bucket's own setting wins over the global (*) setting, the default is no compression.
+func GetCompression(bucketName string) string {
+	compression := cfg.GlobalConfig.Compression
+
+	if value, exists := compression[bucketName]; exists {
+		return value
+	}
+	if value, exists := compression["*"]; exists {
+		return value
+	}
+	return cfg.CompressionNone
+}
+
+// GetPadding returns the padding policy of objects written to bucketName: none, pow2 or a block size.
+// The bucket's own setting wins over the global (*) setting, the default is no padding.
+func GetPadding(bucketName string) string {
+	padding := cfg.GlobalConfig.Padding
+
+	if value, exists := padding[bucketName]; exists {
+		return value
+	}
+	if value, exists := padding["*"]; exists {
+		return value
+	}
+	return cfg.PaddingNone
+}
+
+// IsPlaintextBucket reports if bucketName is exempt from encryption and may receive unencrypted writes.
+func IsPlaintextBucket(bucketName string) bool {
+	return cfg.GlobalConfig.PlaintextBuckets[bucketName]
+}
+
 func GetBucketNameFromGcsMetadata(bucketNameMap map[string]interface{}) string {
 	var bucketNamePath string
 
@@ -75,58 +142,25 @@ func GenerateHeadersList(f *proxy.Flow) (map[string]string, string) {
 	return defaultMap, boundary
 }
 
-// f.Request.URL.Path
-// "/download/storage/v1/b/ehorning-axlearn/o/README.md"
-// "/bucket-name/object-path"
-func GetBucketNameFromRequestUri(urlPath string) string {
-	var bucketName string
-	if strings.Contains(urlPath, "/b/") {
-		//Splits for the filepath with b in between
-		arr := strings.Split(urlPath, "/b/") //["/download/storage/v1/","ehorning-axlearn/o/README.md"]
-
-		//Splits for the filepath with o in between to get exact path
-		res := strings.Split(arr[1], "/o") // ["ehorning-axlearn/","/README.md"]
-
-		// Adding this because there might be a path for bucket, so grabbing only bucket name
-		bucketName = strings.Split(res[0], "/")[0]
-	} else {
-		// handle path=/bucket-name/object-path
-		bucketName = strings.Split(urlPath, "/")[1]
-	}
-	log.Debugf("getBucketNameFromRequestUri bucketName: %v", bucketName)
-	return bucketName
-}
-
-func GetObjectNameFromRequestUri(urlPath string) string {
-	var objectName string
-	if strings.Contains(urlPath, "/o/") {
-		//Splits for the filepath with b in between
-		arr := strings.Split(urlPath, "/o/") //["/download/storage/v1/ehorning-axlearn","README.md"]
-		// Adding this because there might be a path for bucket, so grabbing only bucket name
-		objectName = arr[1]
-	} else {
-		// handle path=/bucket-name/object-path
-		objectName = ""
-	}
-	log.Debugf("GetObjectNameFromRequestUri objectName: %v", objectName)
-	return objectName
-}
-
 // TODO: move this back to handle-singlepart-upload for clarity
-func GenerateMetadata(f *proxy.Flow, contentType string, objectName string) map[string]interface{} {
-	bucketName := GetBucketNameFromRequestUri(f.Request.URL.Path)
+func GenerateMetadata(ctx context.Context, f *proxy.Flow, bucketName string, contentType string, objectName string) (map[string]interface{}, error) {
+	md5Hash := crypto.Base64MD5Hash(f.Request.Body)
+	crc32c := crypto.Base64Crc32cHash(f.Request.Body)
+	contentLength := strconv.Itoa(len(f.Request.Body))
+
 	defaultMap := map[string]interface{}{
 		"bucket":      bucketName,
 		"contentType": contentType,
 		"name":        objectName,
 		"metadata": map[string]interface{}{
-			"x-unencrypted-content-length": len(f.Request.Body),
-			"x-md5Hash":                    crypto.Base64MD5Hash(f.Request.Body),
-			"x-encryption-key":             GetKMSKeyName(bucketName),
+			"x-unencrypted-content-length": contentLength,
+			"x-md5Hash":                    md5Hash,
+			"x-crc32c":                     crc32c,
+			"x-encryption-key":             GetRequestKMSKeyName(ctx, bucketName),
 			"x-proxy-version":              cfg.GlobalConfig.GCSProxyVersion,
 		},
 	}
-	return defaultMap
+	return defaultMap, nil
 }
 
 func CreateFirstMultipartMimeHeader() textproto.MIMEHeader {
@@ -0,0 +1,31 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+func TestMetricBucketLabel(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{
+		KmsBucketKeyMapping: map[string]string{"mapped": "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+	}
+	defer func() { cfg.GlobalConfig = previous }()
+
+	tests := map[string]string{
+		"mapped":   "mapped",
+		"unmapped": "other",
+		"":         "other",
+	}
+	for bucketName, want := range tests {
+		if got := MetricBucketLabel(bucketName); got != want {
+			t.Errorf("MetricBucketLabel(%q) = %v, want %v", bucketName, got, want)
+		}
+	}
+}
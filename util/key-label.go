@@ -0,0 +1,180 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// buckets whose labels could not be read are looked up again after this long, not after the label TTL
+const failedKeyLabelTTL = 10 * time.Second
+
+// a lookup of the labels of a bucket fails after this long, the requests waiting for it are rejected
+const keyLabelTimeout = 10 * time.Second
+
+// buckets whose key is cached, clients can name any number of buckets
+const maxKeyLabelEntries = 10000
+
+type keyLabelEntry struct {
+	keyName string // of the last successful lookup, empty for buckets without the label
+	err     error  // of the last lookup
+	expiry  time.Time
+}
+
+var (
+	keyLabelMutex   sync.Mutex
+	keyLabels       = map[string]keyLabelEntry{} // by bucket
+	keyLabelLookups singleflight.Group           // by bucket, concurrent misses share one lookup
+)
+
+// IsKeyLabelEnabled reports if keys of buckets missing from the static mapping are read from a bucket label.
+func IsKeyLabelEnabled() bool {
+	return cfg.GlobalConfig.KeyLabel != ""
+}
+
+// ResolveBucketKey reads the key label of bucketName when the cache entry expired, unless the static mapping
+// has a key for it. Requests that need the key of a bucket resolve it before GetKMSKeyName is asked for it.
+// A bucket whose labels can't be read must not be mistaken for an unmapped bucket, so the error is returned.
+func ResolveBucketKey(ctx context.Context, bucketName string) error {
+	if !IsKeyLabelEnabled() || bucketName == "" || getStaticKMSKeyName(bucketName) != "" {
+		return nil
+	}
+
+	keyLabelMutex.Lock()
+	entry, ok := keyLabels[bucketName]
+	keyLabelMutex.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.err
+	}
+
+	// the lookup is shared, a request that goes away must not fail the others waiting for it
+	lookup := keyLabelLookups.DoChan(bucketName, func() (interface{}, error) {
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), keyLabelTimeout)
+		defer cancel()
+		keyName, err := readKeyLabel(lookupCtx, bucketName)
+		return nil, storeKeyLabel(bucketName, keyName, err)
+	})
+	select {
+	case result := <-lookup:
+		return result.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// storeKeyLabel caches the result of a lookup. A failed lookup keeps the key of the last successful one,
+// requests that resolved the bucket before still see it.
+func storeKeyLabel(bucketName string, keyName string, err error) error {
+	keyLabelMutex.Lock()
+	defer keyLabelMutex.Unlock()
+	entry := keyLabels[bucketName]
+	if _, ok := keyLabels[bucketName]; !ok && len(keyLabels) >= maxKeyLabelEntries {
+		evictKeyLabels()
+	}
+	entry.err = err
+	if err != nil {
+		log.Errorf("unable to read the %v label of bucket '%v': %v", cfg.GlobalConfig.KeyLabel, bucketName, err)
+		entry.expiry = time.Now().Add(failedKeyLabelTTL)
+	} else {
+		entry.keyName = keyName
+		entry.expiry = time.Now().Add(cfg.GlobalConfig.KeyLabelTTL)
+	}
+	keyLabels[bucketName] = entry
+	return err
+}
+
+// evictKeyLabels removes the expired entries, or the entry that expires first when none expired.
+func evictKeyLabels() {
+	now := time.Now()
+	var firstBucket string
+	var firstExpiry time.Time
+	for bucketName, entry := range keyLabels {
+		if now.After(entry.expiry) {
+			delete(keyLabels, bucketName)
+		} else if firstBucket == "" || entry.expiry.Before(firstExpiry) {
+			firstBucket, firstExpiry = bucketName, entry.expiry
+		}
+	}
+	if len(keyLabels) >= maxKeyLabelEntries {
+		delete(keyLabels, firstBucket)
+	}
+}
+
+// getLabelKeyName returns the key of the last successful lookup of bucketName, it never reads the label.
+func getLabelKeyName(bucketName string) string {
+	keyLabelMutex.Lock()
+	defer keyLabelMutex.Unlock()
+	return keyLabels[bucketName].keyName
+}
+
+// readKeyLabel returns the key named by the label, label values can't contain "/" so they are the last
+// part of the key name and the key label prefix is the rest.
+func readKeyLabel(ctx context.Context, bucketName string) (_ string, err error) {
+	ctx, span := crypto.Tracer.Start(ctx, "getBucketAttrs", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("bucket", bucketName)))
+	defer func() { crypto.EndSpan(span, err) }()
+
+	log.Debugf("fetching gs://%v labels.", bucketName)
+
+	client, err := getStorageClient()
+	if err != nil {
+		return "", err
+	}
+
+	attrs, err := client.Bucket(bucketName).Attrs(ctx)
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get bucket attributes: %w", err)
+	}
+
+	label := attrs.Labels[cfg.GlobalConfig.KeyLabel]
+	if label == "" && cfg.GlobalConfig.KeyMetadataObject != "" {
+		label, err = readKeyMetadata(ctx, client, bucketName)
+		if err != nil {
+			return "", err
+		}
+	}
+	if label == "" {
+		return "", nil
+	}
+	keyName := cfg.GlobalConfig.KeyLabelPrefix + label
+	log.Debugf("bucket '%v' is encrypted with %v from its %v label", bucketName, keyName, cfg.GlobalConfig.KeyLabel)
+	return keyName, nil
+}
+
+// readKeyMetadata returns the key named in the custom metadata of the key metadata object of bucketName. It
+// selects a key under the key label prefix just like the label, so object writers can't pick any key.
+func readKeyMetadata(ctx context.Context, client *storage.Client, bucketName string) (string, error) {
+	attrs, err := client.Bucket(bucketName).Object(cfg.GlobalConfig.KeyMetadataObject).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get the attributes of gs://%v/%v: %w", bucketName, cfg.GlobalConfig.KeyMetadataObject, err)
+	}
+
+	keyName := attrs.Metadata[cfg.GlobalConfig.KeyLabel]
+	if strings.Contains(keyName, "/") {
+		return "", fmt.Errorf("the %v metadata of gs://%v/%v contains a '/', it names a key under the key label prefix",
+			cfg.GlobalConfig.KeyLabel, bucketName, cfg.GlobalConfig.KeyMetadataObject)
+	}
+	return keyName, nil
+}
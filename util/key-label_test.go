@@ -0,0 +1,49 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+func TestKeyLabelCache(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{KeyLabel: "gcsproxy-kms-key", KeyLabelPrefix: "keys/", KeyLabelTTL: time.Minute}
+	keyLabels = map[string]keyLabelEntry{}
+	defer func() {
+		cfg.GlobalConfig = previous
+		keyLabels = map[string]keyLabelEntry{}
+	}()
+
+	storeKeyLabel("expired", "keys/old", nil)
+	keyLabels["expired"] = keyLabelEntry{keyName: "keys/old", expiry: time.Now().Add(-time.Second)}
+	for i := 0; i < maxKeyLabelEntries; i++ {
+		storeKeyLabel(fmt.Sprintf("bkt-%v", i), "keys/k", nil)
+	}
+	if len(keyLabels) != maxKeyLabelEntries {
+		t.Errorf("cache holds %v buckets, want %v", len(keyLabels), maxKeyLabelEntries)
+	}
+	if _, ok := keyLabels["expired"]; ok {
+		t.Errorf("the expired entry was not evicted")
+	}
+
+	// the entry that expires first makes room for a new bucket
+	keyLabels["bkt-0"] = keyLabelEntry{keyName: "keys/k", expiry: time.Now().Add(time.Second)}
+	storeKeyLabel("new", "keys/new", nil)
+	if _, ok := keyLabels["bkt-0"]; ok || len(keyLabels) != maxKeyLabelEntries {
+		t.Errorf("cache holds %v buckets and bkt-0, want the entry that expires first evicted", len(keyLabels))
+	}
+
+	// cached buckets are not read again
+	if err := ResolveBucketKey(context.Background(), "new"); err != nil || GetKMSKeyName("new") != "keys/new" {
+		t.Errorf("ResolveBucketKey() of a cached bucket = %v with key %v, want keys/new", err, GetKMSKeyName("new"))
+	}
+}
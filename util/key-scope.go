@@ -0,0 +1,135 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+)
+
+// ShreddedMetadataKey marks objects whose scope key was destroyed, the value is the time of the shred.
+const ShreddedMetadataKey = "x-gcsproxy-shredded"
+
+// GetScopeKeyName returns the scope key of gs://bucketName/objectName, empty for objects outside of the key
+// scopes. New scopes get a key wrapped with the key the object would be encrypted with otherwise.
+func GetScopeKeyName(ctx context.Context, bucketName string, objectName string) (string, error) {
+	prefix, ok := MatchKeyScope(bucketName, objectName)
+	if !ok {
+		return "", nil
+	}
+	keyEncryptionKey := GetRequestKMSKeyName(ctx, bucketName)
+	if keyEncryptionKey == "" {
+		return "", nil
+	}
+	return crypto.GetScopeKey(ctx, bucketName, prefix, keyEncryptionKey)
+}
+
+// MatchKeyScope returns the scope objectName is in, the first matching prefix of the bucket with its *
+// segments replaced by the segments of the name, e.g. tenants/acme/ for tenants/*/ and tenants/acme/a.txt.
+// The bucket's own scopes replace the * scopes.
+func MatchKeyScope(bucketName string, objectName string) (string, bool) {
+	prefixes, exists := cfg.GlobalConfig.KeyScopes[bucketName]
+	if !exists {
+		prefixes = cfg.GlobalConfig.KeyScopes["*"]
+	}
+
+	for _, prefix := range prefixes {
+		if scope, ok := matchScopePrefix(prefix, objectName); ok {
+			return scope, true
+		}
+	}
+	return "", false
+}
+
+func matchScopePrefix(prefix string, objectName string) (string, bool) {
+	var scope strings.Builder
+	rest := objectName
+	for _, segment := range strings.SplitAfter(prefix, "/") {
+		if segment == "*/" || segment == "*" {
+			end := strings.Index(rest, "/")
+			if end <= 0 {
+				// the object must be inside the scope, tenants/*/ doesn't match tenants/acme
+				return "", false
+			}
+			if segment == "*" {
+				end--
+			}
+			segment = rest[:end+1]
+		}
+		if !strings.HasPrefix(rest, segment) {
+			return "", false
+		}
+		scope.WriteString(segment)
+		rest = rest[len(segment):]
+	}
+	return scope.String(), true
+}
+
+// ShredKeyScope destroys the keys of the key scopes under scope, gs://BUCKET/PREFIX, and marks the objects
+// encrypted with them. The keys are destroyed first, objects that could not be marked are unreadable all
+// the same and are marked when the command runs again.
+func ShredKeyScope(ctx context.Context, scope string) error {
+	bucketName, prefix, _ := strings.Cut(strings.TrimPrefix(scope, "gs://"), "/")
+	if !strings.HasPrefix(scope, "gs://") || bucketName == "" {
+		return fmt.Errorf("invalid scope '%v', expected gs://BUCKET/PREFIX", scope)
+	}
+
+	keys, err := crypto.ShredScopeKeys(bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	shreddedKeys := map[string]string{}
+	for _, key := range keys {
+		shreddedKeys[crypto.ScopeKeyScheme+key.Id] = key.Shredded.Format(time.RFC3339)
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	defer client.Close()
+
+	// every generation of a versioned object was encrypted with the key of its scope
+	var marked, failed int
+	objects := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Versions: true})
+	for {
+		attrs, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list gs://%v/%v: %w", bucketName, prefix, err)
+		}
+		shredded, ok := shreddedKeys[attrs.Metadata["x-encryption-key"]]
+		if !ok || attrs.Metadata[ShreddedMetadataKey] != "" {
+			continue
+		}
+
+		_, err = client.Bucket(bucketName).Object(attrs.Name).Generation(attrs.Generation).
+			Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{ShreddedMetadataKey: shredded}})
+		if err != nil {
+			log.Errorf("unable to mark gs://%v/%v#%v as shredded: %v", bucketName, attrs.Name, attrs.Generation, err)
+			failed++
+			continue
+		}
+		marked++
+	}
+
+	log.Infof("shredded %v keys under gs://%v/%v, marked %v objects", len(keys), bucketName, prefix, marked)
+	if failed > 0 {
+		return fmt.Errorf("%v objects could not be marked as shredded, their keys are destroyed, run shred again to mark them", failed)
+	}
+	return nil
+}
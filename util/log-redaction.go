@@ -0,0 +1,85 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// headers whose values are credentials, they are never logged
+var redactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Vault-Token",
+	"X-Goog-Encryption-Key",
+	"X-Goog-Copy-Source-Encryption-Key",
+}
+
+// credentials in log messages: bearer tokens and the signatures, access tokens and resumable upload ids in
+// URLs, an upload id is enough to write to the upload session.
+var redactedPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b((?:bearer|basic)\s+)[^\s"',\]]+`),
+	regexp.MustCompile(`(?i)\b((?:x-goog-signature|x-amz-signature|signature|access_token|upload_id)=)[^&\s"',\]]+`),
+}
+
+// RedactingFormatter masks credentials in the message and fields of every log entry before Formatter
+// formats it, whatever the log level.
+type RedactingFormatter struct {
+	Formatter log.Formatter
+}
+
+func (r *RedactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redactedEntry := *entry
+	redactedEntry.Message = RedactString(entry.Message)
+	redactedEntry.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			redactedEntry.Data[key] = RedactString(v)
+		case http.Header:
+			redactedEntry.Data[key] = RedactHeader(v)
+		case error:
+			redactedEntry.Data[key] = RedactString(v.Error())
+		default:
+			redactedEntry.Data[key] = value
+		}
+	}
+	return r.Formatter.Format(&redactedEntry)
+}
+
+// RedactString masks bearer tokens and signed URL signatures in s.
+func RedactString(s string) string {
+	for _, pattern := range redactedPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+// RedactHeader returns a copy of header with credentials masked, e.g. the Authorization header and the
+// upload id in the Location of a resumable upload.
+func RedactHeader(header http.Header) http.Header {
+	redactedHeader := make(http.Header, len(header))
+	for name, values := range header {
+		redactedValues := make([]string, len(values))
+		for i, value := range values {
+			redactedValues[i] = RedactString(value)
+		}
+		redactedHeader[name] = redactedValues
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := redactedHeader[name]; ok {
+			redactedHeader[name] = []string{redacted}
+		}
+	}
+	return redactedHeader
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+)
+
+const (
+	// encrypted metadata values are stored as a prefix followed by the base64 encoded ciphertext
+	encryptedValuePrefix = "gcsproxy-enc:"
+	// v2 values share the DEK of their object resource and are bound to the object and the field
+	encryptedValuePrefixV2 = encryptedValuePrefix + "v2:"
+
+	contentDispositionField = "content-disposition"
+)
+
+// custom metadata written by the proxy, it has to stay readable to decrypt the object
+var proxyMetadataKeys = map[string]bool{
+	"x-unencrypted-content-length": true,
+	"x-md5Hash":                    true,
+	"x-crc32c":                     true,
+	"x-encryption-key":             true,
+	"x-proxy-version":              true,
+	ContentEncodingMetadataKey:     true,
+	CompressionMetadataKey:         true,
+	PaddingMetadataKey:             true,
+	ShreddedMetadataKey:            true,
+}
+
+// IsMetadataEncrypted reports if custom metadata values of objects written to bucketName are encrypted.
+func IsMetadataEncrypted(bucketName string) bool {
+	buckets := cfg.GlobalConfig.EncryptMetadataBuckets
+	return buckets[bucketName] || buckets["*"]
+}
+
+// EncryptObjectMetadata encrypts the custom metadata values of an object resource, and contentDisposition
+// when configured, with the KMS key of bucketName. All values share one DEK and are bound to the stored
+// object name. Null values delete a key in a patch and are kept.
+func EncryptObjectMetadata(ctx context.Context, bucketName string, objectName string, gcsMetadataMap map[string]interface{}) error {
+	keyName := GetRequestKMSKeyName(ctx, bucketName)
+	if keyName == "" {
+		return nil
+	}
+	customMetadata, _ := gcsMetadataMap["metadata"].(map[string]interface{})
+	contentDisposition, hasContentDisposition := gcsMetadataMap["contentDisposition"].(string)
+
+	// values in the encrypted format would be decrypted on every read, clients can't store them
+	for key, value := range customMetadata {
+		if stringValue, ok := value.(string); ok && !proxyMetadataKeys[key] && strings.HasPrefix(stringValue, encryptedValuePrefix) {
+			return reservedValueError(key)
+		}
+	}
+	if strings.HasPrefix(contentDisposition, encryptedValuePrefix) {
+		return reservedValueError("contentDisposition")
+	}
+
+	// the proxy's own values that have to be hidden share the DEK of the object's other values
+	cipher := NewMetadataCipher(ctx, keyName, bucketName, objectName)
+	for _, key := range encryptedProxyMetadataKeys(bucketName) {
+		if stringValue, ok := customMetadata[key].(string); ok && !strings.HasPrefix(stringValue, encryptedValuePrefix) {
+			encryptedValue, err := cipher.Encrypt(key, stringValue)
+			if err != nil {
+				return fmt.Errorf("error encrypting %v: %w", key, err)
+			}
+			customMetadata[key] = encryptedValue
+		}
+	}
+
+	if !IsMetadataEncrypted(bucketName) {
+		return nil
+	}
+
+	for key, value := range customMetadata {
+		stringValue, ok := value.(string)
+		if !ok || proxyMetadataKeys[key] {
+			continue
+		}
+		encryptedValue, err := cipher.Encrypt(key, stringValue)
+		if err != nil {
+			return fmt.Errorf("error encrypting metadata '%v': %w", key, err)
+		}
+		customMetadata[key] = encryptedValue
+	}
+
+	if hasContentDisposition && cfg.GlobalConfig.EncryptContentDisposition {
+		encryptedValue, err := cipher.Encrypt(contentDispositionField, contentDisposition)
+		if err != nil {
+			return fmt.Errorf("error encrypting contentDisposition: %w", err)
+		}
+		gcsMetadataMap["contentDisposition"] = encryptedValue
+	}
+	return nil
+}
+
+func reservedValueError(field string) error {
+	return NewGcsError(http.StatusBadRequest, "invalid",
+		"the value of '%v' starts with '%v', which is reserved for values encrypted by go-gcsproxy", field, encryptedValuePrefix)
+}
+
+// DecryptObjectMetadata decrypts the custom metadata values and contentDisposition of an object resource
+// returned by GCS with the key recorded in its x-encryption-key metadata. objectName is the stored name.
+// The values of shredded objects can't be decrypted anymore and are left as stored, so they are still listed.
+func DecryptObjectMetadata(ctx context.Context, bucketName string, objectName string, gcsMetadataMap map[string]interface{}) error {
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	keyName, _ := customMetadata["x-encryption-key"].(string)
+	if crypto.IsScopeKeyShredded(keyName) {
+		return nil
+	}
+	cipher := NewMetadataCipher(ctx, keyName, bucketName, objectName)
+
+	for key, value := range customMetadata {
+		stringValue, ok := value.(string)
+		if !ok {
+			continue
+		}
+		decryptedValue, err := cipher.Decrypt(key, stringValue)
+		if err != nil {
+			return fmt.Errorf("error decrypting metadata '%v': %w", key, err)
+		}
+		customMetadata[key] = decryptedValue
+	}
+
+	if contentDisposition, ok := gcsMetadataMap["contentDisposition"].(string); ok {
+		decryptedValue, err := cipher.Decrypt(contentDispositionField, contentDisposition)
+		if err != nil {
+			return fmt.Errorf("error decrypting contentDisposition: %w", err)
+		}
+		gcsMetadataMap["contentDisposition"] = decryptedValue
+	}
+	return nil
+}
+
+// DecryptMetadataHeaders decrypts x-goog-meta-* and Content-Disposition headers of a download or HEAD
+// request of the stored object bucketName/objectName.
+func DecryptMetadataHeaders(ctx context.Context, keyName string, bucketName string, objectName string, header http.Header) error {
+	cipher := NewMetadataCipher(ctx, keyName, bucketName, objectName)
+	for name, values := range header {
+		canonicalName := http.CanonicalHeaderKey(name)
+		field, isMetadata := strings.CutPrefix(canonicalName, "X-Goog-Meta-")
+		if !isMetadata && canonicalName != "Content-Disposition" {
+			continue
+		}
+		if !isMetadata {
+			field = contentDispositionField
+		}
+		for i, value := range values {
+			decryptedValue, err := cipher.Decrypt(field, value)
+			if err != nil {
+				return fmt.Errorf("error decrypting header '%v': %w", name, err)
+			}
+			values[i] = decryptedValue
+		}
+	}
+	return nil
+}
+
+// GetMetadataHeader returns the custom metadata value of key from the x-goog-meta-* headers of an XML API
+// or media download response.
+func GetMetadataHeader(header http.Header, key string) string {
+	return header.Get("X-Goog-Meta-" + key)
+}
+
+// encryptedProxyMetadataKeys returns the metadata written by the proxy that is encrypted. A plaintext md5
+// allows confirmation attacks against known files, so x-md5Hash and x-crc32c are encrypted when md5_metadata
+// is encrypted.
+// x-unencrypted-content-length would reveal what the padding hides, so it is encrypted in padded buckets.
+func encryptedProxyMetadataKeys(bucketName string) []string {
+	var keys []string
+	if cfg.GlobalConfig.Md5Metadata == cfg.Md5MetadataEncrypted {
+		keys = append(keys, "x-md5Hash", "x-crc32c")
+	}
+	if GetPadding(bucketName) != cfg.PaddingNone {
+		keys = append(keys, "x-unencrypted-content-length")
+	}
+	return keys
+}
+
+// MetadataCipher encrypts the metadata values of one stored object with a single DEK. Values are bound
+// to the object and their field, so they can't be copied to another object or field.
+type MetadataCipher struct {
+	bucketName string
+	objectName string
+	envelope   *crypto.ResourceEnvelope
+}
+
+func NewMetadataCipher(ctx context.Context, keyName string, bucketName string, objectName string) *MetadataCipher {
+	return &MetadataCipher{
+		bucketName: bucketName,
+		objectName: objectName,
+		envelope:   crypto.NewResourceEnvelope(ctx, keyName),
+	}
+}
+
+// Encrypt encrypts the value of field, a custom metadata key or contentDisposition.
+func (c *MetadataCipher) Encrypt(field string, value string) (string, error) {
+	encryptedBytes, err := c.envelope.Encrypt([]byte(value), c.associatedData(field))
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefixV2 + base64.StdEncoding.EncodeToString(encryptedBytes), nil
+}
+
+// Decrypt returns values that were not encrypted by the proxy as is.
+func (c *MetadataCipher) Decrypt(field string, value string) (string, error) {
+	if encodedValue, found := strings.CutPrefix(value, encryptedValuePrefixV2); found {
+		encryptedBytes, err := base64.StdEncoding.DecodeString(encodedValue)
+		if err != nil {
+			return "", fmt.Errorf("invalid encrypted value: %w", err)
+		}
+		decryptedBytes, err := c.envelope.Decrypt(encryptedBytes, c.associatedData(field))
+		if err != nil {
+			return "", err
+		}
+		return string(decryptedBytes), nil
+	}
+	return value, nil
+}
+
+// associatedData binds a value to the object and field, header names are case insensitive so fields are too
+func (c *MetadataCipher) associatedData(field string) []byte {
+	return []byte(c.bucketName + "/" + c.objectName + "\x00" + strings.ToLower(field))
+}
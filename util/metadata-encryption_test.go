@@ -0,0 +1,140 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+func TestMetadataCipher(t *testing.T) {
+	startTestVault(t)
+	ctx := context.Background()
+
+	cipher := NewMetadataCipher(ctx, testVaultKey, "bkt", "obj")
+	encryptedValue, err := cipher.Encrypt("Color", "blue")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if !strings.HasPrefix(encryptedValue, encryptedValuePrefixV2) {
+		t.Fatalf("Encrypt() = %v, want the %v prefix", encryptedValue, encryptedValuePrefixV2)
+	}
+
+	tests := []struct {
+		name    string
+		object  string
+		field   string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "same field", object: "obj", field: "Color", value: encryptedValue, want: "blue"},
+		{name: "field is case insensitive", object: "obj", field: "color", value: encryptedValue, want: "blue"},
+		{name: "other field", object: "obj", field: "size", value: encryptedValue, wantErr: true},
+		{name: "other object", object: "obj2", field: "Color", value: encryptedValue, wantErr: true},
+		{name: "plaintext", object: "obj", field: "Color", value: "blue", want: "blue"},
+		{name: "invalid base64", object: "obj", field: "Color", value: encryptedValuePrefixV2 + "!", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decryptedValue, err := NewMetadataCipher(ctx, testVaultKey, "bkt", test.object).Decrypt(test.field, test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Decrypt() = %v, want an error", decryptedValue)
+				}
+				return
+			}
+			if err != nil || decryptedValue != test.want {
+				t.Errorf("Decrypt() = %v, %v, want %v", decryptedValue, err, test.want)
+			}
+		})
+	}
+}
+
+func TestEncryptObjectMetadata(t *testing.T) {
+	calls := startTestVault(t)
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{
+		KmsBucketKeyMapping:       map[string]string{"bkt": testVaultKey},
+		EncryptMetadataBuckets:    map[string]bool{"bkt": true},
+		EncryptContentDisposition: true,
+		Md5Metadata:               cfg.Md5MetadataEncrypted,
+	}
+	defer func() { cfg.GlobalConfig = previous }()
+	ctx := context.Background()
+
+	gcsMetadataMap := map[string]interface{}{
+		"contentDisposition": "attachment; filename=secret.txt",
+		"metadata": map[string]interface{}{
+			"color":            "blue",
+			"deleted":          nil,
+			"x-md5Hash":        "XUFAKrxLKna5cZ2REBfFkg==",
+			"x-encryption-key": testVaultKey,
+		},
+	}
+	err := EncryptObjectMetadata(ctx, "bkt", "obj", gcsMetadataMap)
+	if err != nil {
+		t.Fatalf("EncryptObjectMetadata() error = %v", err)
+	}
+	customMetadata := gcsMetadataMap["metadata"].(map[string]interface{})
+	for _, key := range []string{"color", "x-md5Hash"} {
+		if value := customMetadata[key].(string); !strings.HasPrefix(value, encryptedValuePrefixV2) {
+			t.Errorf("metadata %v = %v, want it encrypted", key, value)
+		}
+	}
+	if value := gcsMetadataMap["contentDisposition"].(string); !strings.HasPrefix(value, encryptedValuePrefixV2) {
+		t.Errorf("contentDisposition = %v, want it encrypted", value)
+	}
+	if customMetadata["x-encryption-key"] != testVaultKey || customMetadata["deleted"] != nil {
+		t.Errorf("metadata = %v, want x-encryption-key and null values as is", customMetadata)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("KMS was called %v times, want the values to share one DEK", calls.Load())
+	}
+
+	err = DecryptObjectMetadata(ctx, "bkt", "obj", gcsMetadataMap)
+	if err != nil {
+		t.Fatalf("DecryptObjectMetadata() error = %v", err)
+	}
+	if customMetadata["color"] != "blue" || customMetadata["x-md5Hash"] != "XUFAKrxLKna5cZ2REBfFkg==" ||
+		gcsMetadataMap["contentDisposition"] != "attachment; filename=secret.txt" {
+		t.Errorf("DecryptObjectMetadata() = %v, want the original values", gcsMetadataMap)
+	}
+
+	// the values are bound to the object name
+	err = EncryptObjectMetadata(ctx, "bkt", "obj", gcsMetadataMap)
+	if err != nil {
+		t.Fatalf("EncryptObjectMetadata() error = %v", err)
+	}
+	if err = DecryptObjectMetadata(ctx, "bkt", "renamed", gcsMetadataMap); err == nil {
+		t.Errorf("DecryptObjectMetadata() of another object succeeded")
+	}
+}
+
+func TestEncryptObjectMetadataReservedPrefix(t *testing.T) {
+	startTestVault(t)
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{KmsBucketKeyMapping: map[string]string{"bkt": testVaultKey}}
+	defer func() { cfg.GlobalConfig = previous }()
+
+	tests := []map[string]interface{}{
+		{"metadata": map[string]interface{}{"color": encryptedValuePrefixV2 + "AAAA"}},
+		{"metadata": map[string]interface{}{"color": encryptedValuePrefix + "v9:AAAA"}},
+		{"contentDisposition": encryptedValuePrefix + "v1:AAAA"},
+	}
+	for _, gcsMetadataMap := range tests {
+		err := EncryptObjectMetadata(context.Background(), "bkt", "obj", gcsMetadataMap)
+		var gcsErr *GcsError
+		if !errors.As(err, &gcsErr) || gcsErr.Code != http.StatusBadRequest {
+			t.Errorf("EncryptObjectMetadata(%v) error = %v, want a 400", gcsMetadataMap, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+)
+
+// IsNameEncrypted reports if object names in bucketName are stored encrypted.
+func IsNameEncrypted(bucketName string) bool {
+	buckets := cfg.GlobalConfig.EncryptNamesBuckets
+	return (buckets[bucketName] || buckets["*"]) && GetKMSKeyName(bucketName) != ""
+}
+
+// EncryptObjectName encrypts each path segment of an object name, so prefix and "/" delimiter listings
+// still work on the stored names. Segments are bound to the bucket, empty segments stay empty.
+func EncryptObjectName(bucketName string, objectName string) (string, error) {
+	segments := strings.Split(objectName, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		encryptedSegment, err := crypto.EncryptName([]byte(segment), []byte(bucketName))
+		if err != nil {
+			return "", fmt.Errorf("error encrypting object name: %w", err)
+		}
+		segments[i] = base64.RawURLEncoding.EncodeToString(encryptedSegment)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// DecryptObjectName decrypts the path segments of a stored object name. Segments the proxy did not
+// encrypt, e.g. objects written before encrypt_names was turned on, are returned as is.
+func DecryptObjectName(bucketName string, objectName string) string {
+	segments := strings.Split(objectName, "/")
+	for i, segment := range segments {
+		encryptedSegment, err := base64.RawURLEncoding.DecodeString(segment)
+		if err != nil || segment == "" {
+			continue
+		}
+		decryptedSegment, err := crypto.DecryptName(encryptedSegment, []byte(bucketName))
+		if err != nil {
+			continue
+		}
+		segments[i] = string(decryptedSegment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// EncryptListPrefix encrypts the complete segments of a list prefix. The trailing partial segment can't be
+// matched on the stored names, it is returned so the listing can be filtered after the names are decrypted.
+func EncryptListPrefix(bucketName string, prefix string) (encryptedPrefix string, partialSegment string, err error) {
+	lastSlash := strings.LastIndex(prefix, "/")
+	if lastSlash < 0 {
+		return "", prefix, nil
+	}
+	encryptedPrefix, err = EncryptObjectName(bucketName, prefix[:lastSlash])
+	if err != nil {
+		return "", "", err
+	}
+	return encryptedPrefix + "/", prefix[lastSlash+1:], nil
+}
+
+// EncryptResourceName encrypts the name of an object resource in an upload or session start.
+func EncryptResourceName(bucketName string, gcsMetadataMap map[string]interface{}) error {
+	name, ok := gcsMetadataMap["name"].(string)
+	if !ok || name == "" || !IsNameEncrypted(bucketName) {
+		return nil
+	}
+	encryptedName, err := EncryptObjectName(bucketName, name)
+	if err != nil {
+		return err
+	}
+	gcsMetadataMap["name"] = encryptedName
+	return nil
+}
+
+// DecryptResourceName reports the plaintext name in an object resource returned by GCS, including the
+// id, selfLink and mediaLink that embed it. It reports if the name was encrypted.
+func DecryptResourceName(gcsMetadataMap map[string]interface{}) bool {
+	bucketName, _ := gcsMetadataMap["bucket"].(string)
+	encryptedName, ok := gcsMetadataMap["name"].(string)
+	if !ok || !IsNameEncrypted(bucketName) {
+		return false
+	}
+	name := DecryptObjectName(bucketName, encryptedName)
+	if name == encryptedName {
+		return false
+	}
+	gcsMetadataMap["name"] = name
+
+	if id, ok := gcsMetadataMap["id"].(string); ok {
+		gcsMetadataMap["id"] = strings.Replace(id, encryptedName, name, 1)
+	}
+	for _, link := range []string{"selfLink", "mediaLink"} {
+		if value, ok := gcsMetadataMap[link].(string); ok {
+			gcsMetadataMap[link] = strings.Replace(value, url.PathEscape(encryptedName), url.PathEscape(name), 1)
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+)
+
+const testVaultKey = "vault-transit://transit/k"
+
+// startTestVault serves the Transit encrypt and decrypt endpoints with a "ciphertext" that is the plaintext
+// behind the vault prefix, and counts the calls.
+func startTestVault(t *testing.T) *atomic.Int64 {
+	t.Helper()
+	calls := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, `{"errors":["invalid request"]}`, http.StatusBadRequest)
+			return
+		}
+		data := map[string]string{}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/encrypt/k"):
+			data["ciphertext"] = "vault:v1:" + request["plaintext"]
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/decrypt/k"):
+			data["plaintext"] = strings.TrimPrefix(request["ciphertext"], "vault:v1:")
+		default:
+			http.Error(w, `{"errors":["unknown path"]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+	crypto.ConfigureVault(crypto.VaultConfig{Addr: server.URL, Token: "token"})
+	return calls
+}
+
+func TestObjectNameEncryption(t *testing.T) {
+	startTestVault(t)
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{
+		KmsBucketKeyMapping: map[string]string{"bkt": testVaultKey, "other": testVaultKey},
+		EncryptNamesBuckets: map[string]bool{"bkt": true, "other": true},
+	}
+	defer func() { cfg.GlobalConfig = previous }()
+	keysetPath := filepath.Join(t.TempDir(), "names.json")
+	ctx := context.Background()
+	if err := crypto.GenerateNameKeyset(ctx, keysetPath, testVaultKey); err != nil {
+		t.Fatalf("GenerateNameKeyset() error = %v", err)
+	}
+	if err := crypto.GenerateNameKeyset(ctx, keysetPath, testVaultKey); err == nil {
+		t.Errorf("GenerateNameKeyset() overwrote the keyset")
+	}
+	if err := crypto.LoadNameKeyset(ctx, keysetPath, testVaultKey); err != nil {
+		t.Fatalf("LoadNameKeyset() error = %v", err)
+	}
+
+	for _, name := range []string{"object", "dir/sub/object", "dir/", "/leading//double", "ünïcode name"} {
+		encryptedName, err := EncryptObjectName("bkt", name)
+		if err != nil {
+			t.Fatalf("EncryptObjectName(%q) error = %v", name, err)
+		}
+		if strings.Count(encryptedName, "/") != strings.Count(name, "/") {
+			t.Errorf("EncryptObjectName(%q) = %q, want the segments kept", name, encryptedName)
+		}
+		if again, _ := EncryptObjectName("bkt", name); again != encryptedName {
+			t.Errorf("EncryptObjectName(%q) is not deterministic", name)
+		}
+		if other, _ := EncryptObjectName("other", name); name != "dir/" && other == encryptedName {
+			t.Errorf("EncryptObjectName(%q) is the same in another bucket", name)
+		}
+		if decryptedName := DecryptObjectName("bkt", encryptedName); decryptedName != name {
+			t.Errorf("DecryptObjectName(%q) = %q, want %q", encryptedName, decryptedName, name)
+		}
+	}
+
+	// names written before encrypt_names was turned on are returned as is
+	if name := DecryptObjectName("bkt", "plain/name"); name != "plain/name" {
+		t.Errorf("DecryptObjectName() of a plaintext name = %q", name)
+	}
+
+	encryptedPrefix, partialSegment, err := EncryptListPrefix("bkt", "dir/sub/obj")
+	encryptedDir, _ := EncryptObjectName("bkt", "dir/sub")
+	if err != nil || encryptedPrefix != encryptedDir+"/" || partialSegment != "obj" {
+		t.Errorf("EncryptListPrefix() = %q, %q, %v, want %q, obj", encryptedPrefix, partialSegment, err, encryptedDir+"/")
+	}
+
+	resource := map[string]interface{}{"bucket": "bkt", "name": "dir/object"}
+	if err := EncryptResourceName("bkt", resource); err != nil {
+		t.Fatalf("EncryptResourceName() error = %v", err)
+	}
+	encryptedName := resource["name"].(string)
+	resource["id"] = "bkt/" + encryptedName + "/1"
+	resource["selfLink"] = "https://www.googleapis.com/storage/v1/b/bkt/o/" + strings.ReplaceAll(encryptedName, "/", "%2F")
+	if !DecryptResourceName(resource) || resource["name"] != "dir/object" || resource["id"] != "bkt/dir/object/1" ||
+		resource["selfLink"] != "https://www.googleapis.com/storage/v1/b/bkt/o/dir%2Fobject" {
+		t.Errorf("DecryptResourceName() = %v, want the plaintext name in name, id and selfLink", resource)
+	}
+}
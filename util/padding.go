@@ -0,0 +1,81 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// PaddingMetadataKey records the format of padded payloads. v1 is the 8 byte big endian length of the
+// payload, the payload and zeros up to the padded length. The real length only exists inside the ciphertext.
+const PaddingMetadataKey = "x-padding"
+
+const (
+	paddingFormat       = "v1"
+	paddingLengthPrefix = 8
+)
+
+// PadPayload pads payload with the padding policy of bucketName and records the padding in the custom
+// metadata of the object resource.
+func PadPayload(bucketName string, gcsMetadataMap map[string]interface{}, payload []byte) ([]byte, error) {
+	policy := GetPadding(bucketName)
+	if policy == cfg.PaddingNone {
+		return payload, nil
+	}
+
+	paddedLength, err := paddedLength(policy, paddingLengthPrefix+len(payload))
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, paddedLength)
+	binary.BigEndian.PutUint64(padded, uint64(len(payload)))
+	copy(padded[paddingLengthPrefix:], payload)
+
+	customMetadata, ok := gcsMetadataMap["metadata"].(map[string]interface{})
+	if !ok {
+		customMetadata = map[string]interface{}{}
+		gcsMetadataMap["metadata"] = customMetadata
+	}
+	customMetadata[PaddingMetadataKey] = paddingFormat
+	log.Debugf("padded %v bytes to %v bytes with %v", len(payload), paddedLength, policy)
+	return padded, nil
+}
+
+// UnpadPayload returns the payload of a padded plaintext.
+func UnpadPayload(format string, padded []byte) ([]byte, error) {
+	if format != paddingFormat {
+		return nil, fmt.Errorf("unsupported padding format '%v'", format)
+	}
+	if len(padded) < paddingLengthPrefix {
+		return nil, fmt.Errorf("padded payload is too short")
+	}
+	length := binary.BigEndian.Uint64(padded)
+	if length > uint64(len(padded)-paddingLengthPrefix) {
+		return nil, fmt.Errorf("padded payload length %v exceeds the plaintext", length)
+	}
+	return padded[paddingLengthPrefix : paddingLengthPrefix+int(length)], nil
+}
+
+func paddedLength(policy string, length int) (int, error) {
+	if policy == cfg.PaddingPow2 {
+		if length <= 1 {
+			return 1, nil
+		}
+		return 1 << bits.Len(uint(length-1)), nil
+	}
+
+	blockSize, err := strconv.Atoi(policy)
+	if err != nil || blockSize < 1 {
+		return 0, fmt.Errorf("invalid padding '%v'", policy)
+	}
+	return (length + blockSize - 1) / blockSize * blockSize, nil
+}
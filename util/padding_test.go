@@ -0,0 +1,115 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+)
+
+func TestPadPayload(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{Padding: map[string]string{
+		"pow2":    cfg.PaddingPow2,
+		"block":   "100",
+		"invalid": "zero",
+	}}
+	defer func() { cfg.GlobalConfig = previous }()
+
+	tests := []struct {
+		name         string
+		bucket       string
+		payload      []byte
+		paddedLength int // 0 when the payload is not padded
+		wantErr      string
+	}{
+		{name: "no padding", bucket: "plain", payload: []byte("hello")},
+		{name: "pow2", bucket: "pow2", payload: []byte("hello"), paddedLength: 16},
+		{name: "pow2 exact", bucket: "pow2", payload: make([]byte, 8), paddedLength: 16},
+		{name: "pow2 empty", bucket: "pow2", payload: []byte{}, paddedLength: 8},
+		{name: "block", bucket: "block", payload: []byte("hello"), paddedLength: 100},
+		{name: "block exceeded", bucket: "block", payload: make([]byte, 93), paddedLength: 200},
+		{name: "invalid", bucket: "invalid", payload: []byte("hello"), wantErr: "invalid padding"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcsMetadataMap := map[string]interface{}{}
+			padded, err := PadPayload(test.bucket, gcsMetadataMap, test.payload)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("PadPayload() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PadPayload() error = %v", err)
+			}
+
+			if test.paddedLength == 0 {
+				if !bytes.Equal(padded, test.payload) || len(gcsMetadataMap) != 0 {
+					t.Errorf("PadPayload() = %q with metadata %v, want the payload as is", padded, gcsMetadataMap)
+				}
+				return
+			}
+			if len(padded) != test.paddedLength {
+				t.Errorf("PadPayload() length = %v, want %v", len(padded), test.paddedLength)
+			}
+			format := gcsMetadataMap["metadata"].(map[string]interface{})[PaddingMetadataKey].(string)
+			unpadded, err := UnpadPayload(format, padded)
+			if err != nil {
+				t.Fatalf("UnpadPayload() error = %v", err)
+			}
+			if !bytes.Equal(unpadded, test.payload) {
+				t.Errorf("UnpadPayload() = %q, want %q", unpadded, test.payload)
+			}
+		})
+	}
+}
+
+func TestGetPadding(t *testing.T) {
+	previous := cfg.GlobalConfig
+	cfg.GlobalConfig = &cfg.Config{Padding: map[string]string{"*": cfg.PaddingPow2, "padded": "4096"}}
+	defer func() { cfg.GlobalConfig = previous }()
+
+	tests := map[string]string{
+		"padded": "4096",
+		"other":  cfg.PaddingPow2,
+		"":       cfg.PaddingPow2,
+	}
+	for bucketName, want := range tests {
+		if got := GetPadding(bucketName); got != want {
+			t.Errorf("GetPadding(%q) = %v, want %v", bucketName, got, want)
+		}
+	}
+
+	cfg.GlobalConfig = &cfg.Config{}
+	if got := GetPadding("padded"); got != cfg.PaddingNone {
+		t.Errorf("GetPadding() without a setting = %v, want %v", got, cfg.PaddingNone)
+	}
+}
+
+func TestUnpadPayloadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		padded  []byte
+		wantErr string
+	}{
+		{"unknown format", "v2", make([]byte, 16), "unsupported padding format"},
+		{"too short", paddingFormat, make([]byte, 4), "too short"},
+		{"length exceeds", paddingFormat, []byte{0, 0, 0, 0, 0, 0, 0, 9, 'a'}, "exceeds the plaintext"},
+	}
+	for _, test := range tests {
+		_, err := UnpadPayload(test.format, test.padded)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%v: UnpadPayload() error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
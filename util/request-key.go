@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"net/http"
+
+	cfg "github.com/byronwhitlock-google/go-gcsproxy/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestKeyHeader selects the key of a write from the keys allowed for the bucket, e.g. a key per tenant.
+const RequestKeyHeader = "X-Gcsproxy-Key"
+
+// the key selected by the request header travels in the context like the request id
+type requestKeyContextKey struct{}
+
+// WithRequestKey returns a context that encrypts with keyName instead of the key of the bucket.
+func WithRequestKey(ctx context.Context, keyName string) context.Context {
+	return context.WithValue(ctx, requestKeyContextKey{}, keyName)
+}
+
+// GetRequestKMSKeyName returns the key selected for the request, or the key of bucketName.
+func GetRequestKMSKeyName(ctx context.Context, bucketName string) string {
+	if keyName, ok := ctx.Value(requestKeyContextKey{}).(string); ok && keyName != "" {
+		return keyName
+	}
+	return GetKMSKeyName(bucketName)
+}
+
+// SelectRequestKey removes the key header from a request to bucketName and returns the key it selects,
+// empty when the request has none. Keys that are not allowed for the bucket are rejected with a 403.
+func SelectRequestKey(header http.Header, bucketName string) (string, error) {
+	keyName := header.Get(RequestKeyHeader)
+	header.Del(RequestKeyHeader)
+	if keyName == "" {
+		return "", nil
+	}
+
+	if !IsRequestKeyAllowed(bucketName, keyName) {
+		log.Warnf("rejecting %v '%v', it is not allowed for bucket '%v'", RequestKeyHeader, keyName, bucketName)
+		return "", NewGcsError(http.StatusForbidden, "forbidden", "Key '%v' is not allowed for bucket '%v'.", keyName, bucketName)
+	}
+	return keyName, nil
+}
+
+// IsRequestKeyAllowed reports if keyName may be selected for bucketName. The bucket's own allowlist wins
+// over the global (*) allowlist, the key of the bucket is always allowed.
+func IsRequestKeyAllowed(bucketName string, keyName string) bool {
+	if GetKMSKeyName(bucketName) == "" {
+		return false
+	}
+	if keyName == GetKMSKeyName(bucketName) {
+		return true
+	}
+
+	requestKeys := cfg.GlobalConfig.RequestKeys
+	allowedKeys, exists := requestKeys[bucketName]
+	if !exists {
+		allowedKeys = requestKeys["*"]
+	}
+	for _, allowedKey := range allowedKeys {
+		if keyName == allowedKey {
+			return true
+		}
+	}
+	return false
+}
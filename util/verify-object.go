@@ -0,0 +1,56 @@
+/*
+Copyright 2025 Google.
+
+This software is provided as-is, without warranty or representation for any use or purpose.
+*/
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/byronwhitlock-google/go-gcsproxy/crypto"
+)
+
+// VerifyObjectFile checks a plaintext copy of an object, e.g. a restore from backup, against the
+// x-md5Hash metadata the proxy stored for it. Encrypted hashes are decrypted with the object's key.
+func VerifyObjectFile(ctx context.Context, gcsUri string, filePath string) error {
+	bucketName, objectName, found := strings.Cut(strings.TrimPrefix(gcsUri, "gs://"), "/")
+	if !found || bucketName == "" || objectName == "" {
+		return fmt.Errorf("invalid object '%v', expected gs://BUCKET/OBJECT", gcsUri)
+	}
+
+	plaintext, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading %v: %w", filePath, err)
+	}
+
+	// the name keyset is loaded when encrypt_names is configured
+	storedName := objectName
+	if IsNameEncrypted(bucketName) {
+		storedName, err = EncryptObjectName(bucketName, objectName)
+		if err != nil {
+			return err
+		}
+	}
+
+	attrs, err := GetObjectAttrs(ctx, bucketName, storedName, 0)
+	if err != nil {
+		return err
+	}
+	storedMd5Hash, ok := attrs.Metadata["x-md5Hash"]
+	if !ok {
+		return fmt.Errorf("%v has no x-md5Hash metadata, it was not written by go-gcsproxy", gcsUri)
+	}
+
+	md5Hash, err := NewMetadataCipher(ctx, attrs.Metadata["x-encryption-key"], bucketName, storedName).Decrypt("x-md5Hash", storedMd5Hash)
+	if err != nil {
+		return fmt.Errorf("error decrypting x-md5Hash of %v: %w", gcsUri, err)
+	}
+	if md5Hash != crypto.Base64MD5Hash(plaintext) {
+		return fmt.Errorf("md5 hash of %v does not match %v", filePath, gcsUri)
+	}
+	return nil
+}